@@ -0,0 +1,178 @@
+package mutex
+
+import (
+	"sort"
+
+	"github.com/sjansen/stopgap/internal/rqx"
+	"github.com/sjansen/stopgap/internal/storage"
+	"github.com/sjansen/stopgap/internal/time"
+)
+
+// HoldStats summarizes how long a mutex has been held in the past.
+type HoldStats struct {
+	Samples int
+	Median  time.Duration
+	P90     time.Duration
+}
+
+// WaitEstimate predicts how long a queued requester will wait for a
+// mutex, assuming everyone ahead of them holds it for a typical time.
+type WaitEstimate struct {
+	Median time.Duration
+	P90    time.Duration
+}
+
+// QueueStatus describes a requester's place in a mutex's wait queue.
+type QueueStatus struct {
+	Position int
+	// Estimate is nil if the mutex has never been unlocked, or its
+	// history has expired.
+	Estimate *WaitEstimate
+}
+
+// holdHistory is what can be learned about holds from a mutex's events.
+// A hold lasts from when the mutex is locked until it is fully unlocked,
+// however many shared holders join in between.
+type holdHistory struct {
+	durations []time.Duration
+	// current is when the current hold started, if the mutex is locked.
+	current *time.Time
+	// holders counts the shared holders of the current hold.
+	holders int
+}
+
+// HoldStats computes how long the named mutex is usually held, using
+// the lock and unlock events in its history.
+func (m *Manager) HoldStats(rqx *rqx.RequestContext, name string) (HoldStats, error) {
+	h, err := m.holdHistory(rqx, name)
+	if err != nil {
+		return HoldStats{}, err
+	}
+	return h.stats(), nil
+}
+
+// QueuePosition returns the requester's place in the named mutex's wait
+// queue, starting at 1, along with how long they can expect to wait.
+func (m *Manager) QueuePosition(rqx *rqx.RequestContext, name string) (QueueStatus, error) {
+	position, err := m.Mutexes.GetQueuePosition(rqx, name)
+	if err != nil {
+		return QueueStatus{}, err
+	}
+	return m.queueStatus(rqx, name, position)
+}
+
+func (m *Manager) queueStatus(rqx *rqx.RequestContext, name string, position int) (QueueStatus, error) {
+	h, err := m.holdHistory(rqx, name)
+	if err != nil {
+		return QueueStatus{}, err
+	}
+	return QueueStatus{
+		Position: position,
+		Estimate: h.estimate(position, m.now()),
+	}, nil
+}
+
+func (m *Manager) holdHistory(rqx *rqx.RequestContext, name string) (*holdHistory, error) {
+	events, err := m.Mutexes.GetMutexHistory(rqx, name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &holdHistory{}
+	for _, e := range events {
+		shared := storage.LockMode(e.Data["mode"]) == storage.LockShared
+		switch e.Type {
+		case "mutex-locked":
+			h.start(e.Created, shared)
+		case "mutex-handed-off":
+			h.end(e.Created)
+			h.start(e.Created, shared)
+		case "mutex-transferred":
+			h.end(e.Created)
+			h.start(e.Created, false)
+		case "mutex-unlocked":
+			if shared && h.holders > 1 {
+				h.holders--
+			} else {
+				h.end(e.Created)
+			}
+		}
+	}
+	return h, nil
+}
+
+// start begins a hold, or when a shared lock is joined by another holder,
+// counts them as part of the current hold.
+func (h *holdHistory) start(t time.Time, shared bool) {
+	if !shared {
+		h.current = &t
+		h.holders = 0
+		return
+	}
+	if h.current == nil {
+		h.current = &t
+	}
+	h.holders++
+}
+
+func (h *holdHistory) end(t time.Time) {
+	// Without the start, usually because it expired, there's nothing to
+	// measure.
+	if h.current != nil {
+		h.durations = append(h.durations, t.Sub(*h.current))
+	}
+	h.current = nil
+	h.holders = 0
+}
+
+func (h *holdHistory) stats() HoldStats {
+	if len(h.durations) < 1 {
+		return HoldStats{}
+	}
+
+	sorted := make([]time.Duration, len(h.durations))
+	copy(sorted, h.durations)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	return HoldStats{
+		Samples: len(sorted),
+		Median:  percentile(sorted, 50),
+		P90:     percentile(sorted, 90),
+	}
+}
+
+// estimate assumes the current holder will hold the mutex for a typical
+// time, less the time they've already held it, and that each requester
+// ahead in the queue will too.
+func (h *holdHistory) estimate(position int, now time.Time) *WaitEstimate {
+	stats := h.stats()
+	if stats.Samples < 1 {
+		return nil
+	}
+
+	var elapsed time.Duration
+	if h.current != nil {
+		elapsed = now.Sub(*h.current)
+	}
+	wait := func(hold time.Duration) time.Duration {
+		remaining := hold - elapsed
+		if remaining < 0 {
+			remaining = 0
+		}
+		return remaining + time.Duration(position-1)*hold
+	}
+	return &WaitEstimate{
+		Median: wait(stats.Median),
+		P90:    wait(stats.P90),
+	}
+}
+
+// percentile uses the nearest-rank method on sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,134 @@
+package mutex_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sjansen/stopgap/internal/domain/mutex"
+	"github.com/sjansen/stopgap/internal/rqx"
+	"github.com/sjansen/stopgap/internal/storage"
+	"github.com/sjansen/stopgap/internal/time"
+)
+
+func TestWaitEstimate(t *testing.T) {
+	require := require.New(t)
+
+	start := time.Date(2019, 1, 1, 9, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time {
+		return start.Add(time.Duration(minutes) * time.Minute)
+	}
+	deps := newDependencies()
+	deps.manager.Now = func() time.Time { return at(155) }
+	bob := &rqx.RequestContext{Ctx: context.TODO(), EUser: rqx.User{SlackID: "UBob"}}
+
+	// GIVEN a mutex with no history
+	// WHEN someone waits for it
+	deps.repo.Retries = 1
+	result, err := deps.manager.LockMutex(bob, "conch", "deploying", storage.LockExclusive, true)
+	// THEN there should be no estimate
+	require.NoError(err)
+	require.Equal(1, result.Position)
+	require.Nil(result.Estimate)
+
+	// GIVEN a mutex that has been held for 10, 20, 30, 40 and 50 minutes,
+	// and locked again 5 minutes ago
+	deps.repo.History["conch"] = []*storage.Event{
+		{Type: "mutex-unlocked", Created: at(-5)},
+		{Type: "mutex-locked", Created: at(0)},
+		{Type: "mutex-unlocked", Created: at(10)},
+		{Type: "mutex-locked", Created: at(10)},
+		{Type: "mutex-queue-joined", Created: at(15)},
+		{Type: "mutex-handed-off", Created: at(30)},
+		{Type: "mutex-handed-off", Created: at(60)},
+		{Type: "mutex-unlocked", Created: at(100)},
+		{Type: "mutex-locked", Created: at(100)},
+		{Type: "mutex-unlocked", Created: at(150)},
+		{Type: "mutex-locked", Created: at(150)},
+	}
+	stats, err := deps.manager.HoldStats(bob, "conch")
+	require.NoError(err)
+	require.Equal(mutex.HoldStats{
+		Samples: 5,
+		Median:  30 * time.Minute,
+		P90:     50 * time.Minute,
+	}, stats)
+
+	// WHEN someone asks about their place in the queue
+	status, err := deps.manager.QueuePosition(bob, "conch")
+	// THEN their wait should include the rest of the current hold
+	require.NoError(err)
+	require.Equal(1, status.Position)
+	require.Equal(&mutex.WaitEstimate{
+		Median: 25 * time.Minute,
+		P90:    45 * time.Minute,
+	}, status.Estimate)
+
+	// WHEN someone else joins the queue behind them
+	carol := &rqx.RequestContext{Ctx: context.TODO(), EUser: rqx.User{SlackID: "UCarol"}}
+	result, err = deps.manager.LockMutex(carol, "conch", "testing", storage.LockExclusive, true)
+	// THEN their wait should include another hold
+	require.NoError(err)
+	require.Equal(2, result.Position)
+	require.Equal(&mutex.WaitEstimate{
+		Median: 55 * time.Minute,
+		P90:    95 * time.Minute,
+	}, result.Estimate)
+}
+
+func TestSharedHoldStats(t *testing.T) {
+	require := require.New(t)
+
+	start := time.Date(2019, 1, 1, 9, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time {
+		return start.Add(time.Duration(minutes) * time.Minute)
+	}
+	deps := newDependencies()
+	deps.manager.Now = func() time.Time { return at(130) }
+	bob := &rqx.RequestContext{Ctx: context.TODO(), EUser: rqx.User{SlackID: "UBob"}}
+
+	shared := map[string]string{"mode": "shared"}
+	exclusive := map[string]string{"mode": "exclusive"}
+
+	// GIVEN a mutex shared by three holders for 40 minutes, held
+	// exclusively for 20 minutes, shared again for 30 minutes, and shared
+	// again 10 minutes ago
+	deps.repo.History["conch"] = []*storage.Event{
+		{Type: "mutex-locked", Created: at(0), Data: shared},
+		{Type: "mutex-locked", Created: at(5), Data: shared},
+		{Type: "mutex-unlocked", Created: at(10), Data: shared},
+		{Type: "mutex-locked", Created: at(15), Data: shared},
+		{Type: "mutex-unlocked", Created: at(30), Data: shared},
+		{Type: "mutex-unlocked", Created: at(40), Data: shared},
+		{Type: "mutex-locked", Created: at(50), Data: exclusive},
+		{Type: "mutex-handed-off", Created: at(70), Data: shared},
+		{Type: "mutex-locked", Created: at(80), Data: shared},
+		{Type: "mutex-unlocked", Created: at(90), Data: shared},
+		{Type: "mutex-unlocked", Created: at(100), Data: shared},
+		{Type: "mutex-locked", Created: at(120), Data: shared},
+		{Type: "mutex-locked", Created: at(125), Data: shared},
+		{Type: "mutex-unlocked", Created: at(128), Data: shared},
+	}
+
+	// WHEN its hold stats are computed
+	stats, err := deps.manager.HoldStats(bob, "conch")
+	// THEN each hold lasts until the last shared holder unlocks
+	require.NoError(err)
+	require.Equal(mutex.HoldStats{
+		Samples: 3,
+		Median:  30 * time.Minute,
+		P90:     40 * time.Minute,
+	}, stats)
+
+	// WHEN someone waits for it
+	deps.repo.Retries = 1
+	result, err := deps.manager.LockMutex(bob, "conch", "deploying", storage.LockExclusive, true)
+	// THEN the current hold started when it was first shared
+	require.NoError(err)
+	require.Equal(1, result.Position)
+	require.Equal(&mutex.WaitEstimate{
+		Median: 20 * time.Minute,
+		P90:    30 * time.Minute,
+	}, result.Estimate)
+}
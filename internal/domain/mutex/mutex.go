@@ -1,44 +1,197 @@
 package mutex
 
 import (
+	"context"
+
+	"github.com/pkg/errors"
+
 	"github.com/sjansen/stopgap/internal/rqx"
+	"github.com/sjansen/stopgap/internal/storage"
 	"github.com/sjansen/stopgap/internal/time"
 )
 
 type Clock interface {
-	Sleep(time.Duration)
+	// Sleep pauses for the given duration, or until ctx is done.
+	Sleep(ctx context.Context, d time.Duration) error
 }
 
 type Repo interface {
 	CreateMutex(rqx *rqx.RequestContext, name, description string) error
-	LockMutex(rqx *rqx.RequestContext, name, message string) error
+	UpdateMutex(rqx *rqx.RequestContext, name string, update *storage.MutexUpdate) error
+	LockMutex(rqx *rqx.RequestContext, name, message string, mode storage.LockMode) error
+	LockMutexes(rqx *rqx.RequestContext, names []string, message string) error
 	UnlockMutex(rqx *rqx.RequestContext, name string) error
+	TransferMutex(rqx *rqx.RequestContext, name, toUser, message string) error
+	UpdateLockMessage(rqx *rqx.RequestContext, name, message string) error
+	GetMutexes(rqx *rqx.RequestContext, names []string, consistent bool) (map[string]*storage.Mutex, error)
+	ResolveNames(rqx *rqx.RequestContext, name string) ([]string, error)
+	WaitForMutex(rqx *rqx.RequestContext, name, message string, mode storage.LockMode, ttl time.Duration) (int, error)
+	LeaveQueue(rqx *rqx.RequestContext, name string) error
+	GetQueuePosition(rqx *rqx.RequestContext, name string) (int, error)
+	GetMutexHistory(rqx *rqx.RequestContext, name string, consistent bool) ([]*storage.Event, error)
 }
 
 type Manager struct {
 	Clock   Clock
 	Mutexes Repo
+	// RetryPolicy defaults to DefaultRetryPolicy.
+	RetryPolicy RetryPolicy
+	// QueueTTL defaults to DefaultQueueTTL.
+	QueueTTL time.Duration
+	// Now defaults to time.Now.
+	Now func() time.Time
 }
 
-var lockRetryDelays = []time.Duration{
-	0 * time.Second,
-	1 * time.Second,
-	3 * time.Second,
-	6 * time.Second,
-	10 * time.Second,
+// LockResult describes the outcome of an attempt to lock a mutex.
+type LockResult struct {
+	// Attempts is the number of times locking was tried.
+	Attempts int
+	// Position is the requester's place in the mutex's wait queue,
+	// starting at 1, or 0 if the mutex was locked.
+	Position int
+	// Estimate is how long a queued requester can expect to wait, if
+	// there is enough history to tell.
+	Estimate *WaitEstimate
 }
 
 func (m *Manager) CreateMutex(rqx *rqx.RequestContext, name, description string) error {
 	return m.Mutexes.CreateMutex(rqx, name, description)
 }
 
-func (m *Manager) LockMutex(rqx *rqx.RequestContext, name, message string) error {
-	var err error
-	for _, d := range lockRetryDelays {
-		m.Clock.Sleep(d)
-		if err = m.Mutexes.LockMutex(rqx, name, message); err == nil {
-			break
+// UpdateMutex changes the named mutex's metadata.
+func (m *Manager) UpdateMutex(rqx *rqx.RequestContext, name string, update *storage.MutexUpdate) error {
+	return m.Mutexes.UpdateMutex(rqx, name, update)
+}
+
+// LockMutex locks the named mutex in the given mode. When wait is true and
+// the mutex can't be locked, the requester is added to its wait queue and
+// will be given the lock when it is their turn. Otherwise, locking is
+// retried according to the manager's policy, stopping early if the
+// request is canceled.
+//
+// The name may also be an alias, or a group whose mutexes are all locked
+// exclusively at once. Groups can't be waited for.
+func (m *Manager) LockMutex(
+	rqx *rqx.RequestContext, name, message string, mode storage.LockMode, wait bool,
+) (LockResult, error) {
+	names, err := m.Mutexes.ResolveNames(rqx, name)
+	if err != nil {
+		return LockResult{}, err
+	}
+	if len(names) > 1 {
+		if wait {
+			return LockResult{}, errors.New("unable to wait for a group: " + name)
+		} else if mode != "" && mode != storage.LockExclusive {
+			return LockResult{}, errors.New("groups can only be locked exclusively: " + name)
+		}
+		return m.retry(rqx, func() error {
+			return m.Mutexes.LockMutexes(rqx, names, message)
+		})
+	}
+
+	name = names[0]
+	if wait {
+		return m.waitForMutex(rqx, name, message, mode)
+	}
+	return m.retry(rqx, func() error {
+		return m.Mutexes.LockMutex(rqx, name, message, mode)
+	})
+}
+
+// UnlockMutex unlocks the named mutex, or every mutex in the named group.
+// Unlocking continues after a failure, and the first error is returned.
+func (m *Manager) UnlockMutex(rqx *rqx.RequestContext, name string) error {
+	names, err := m.Mutexes.ResolveNames(rqx, name)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if e := m.Mutexes.UnlockMutex(rqx, name); e != nil && err == nil {
+			err = errors.Wrap(e, name)
 		}
 	}
 	return err
 }
+
+// TransferMutex hands the requester's lock on the named mutex, or the
+// mutex an alias refers to, to another user.
+func (m *Manager) TransferMutex(rqx *rqx.RequestContext, name, toUser, message string) error {
+	names, err := m.Mutexes.ResolveNames(rqx, name)
+	if err != nil {
+		return err
+	}
+	if len(names) > 1 {
+		return errors.New("groups can't be transferred: " + name)
+	}
+	return m.Mutexes.TransferMutex(rqx, names[0], toUser, message)
+}
+
+// UpdateLockMessage replaces the message the requester left when they
+// locked the named mutex, or the mutex an alias refers to.
+func (m *Manager) UpdateLockMessage(rqx *rqx.RequestContext, name, message string) error {
+	names, err := m.Mutexes.ResolveNames(rqx, name)
+	if err != nil {
+		return err
+	}
+	if len(names) > 1 {
+		return errors.New("group messages can't be updated: " + name)
+	}
+	return m.Mutexes.UpdateLockMessage(rqx, names[0], message)
+}
+
+// MutexStatus returns the named mutex, or every mutex in the named group,
+// sorted by name.
+func (m *Manager) MutexStatus(rqx *rqx.RequestContext, name string) ([]*storage.Mutex, error) {
+	names, err := m.Mutexes.ResolveNames(rqx, name)
+	if err != nil {
+		return nil, err
+	}
+	mutexes, err := m.Mutexes.GetMutexes(rqx, names, false)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*storage.Mutex, 0, len(names))
+	for _, name := range names {
+		mutex := mutexes[name]
+		if mutex == nil {
+			return nil, errors.Wrap(storage.ErrMutexNotFound, name)
+		}
+		result = append(result, mutex)
+	}
+	return result, nil
+}
+
+// retry calls lock until it succeeds, fails for a reason other than the
+// mutex being locked, or the manager's policy gives up.
+func (m *Manager) retry(rqx *rqx.RequestContext, lock func() error) (LockResult, error) {
+	policy := m.RetryPolicy
+	if policy == nil {
+		policy = DefaultRetryPolicy
+	}
+
+	attempts := 0
+	for {
+		if err := rqx.Ctx.Err(); err != nil {
+			return LockResult{Attempts: attempts}, err
+		}
+		attempts++
+		err := lock()
+		if !errors.Is(err, storage.ErrAlreadyLocked) {
+			return LockResult{Attempts: attempts}, err
+		}
+		d, ok := policy.NextDelay(attempts)
+		if !ok {
+			return LockResult{Attempts: attempts}, err
+		}
+		if err := m.Clock.Sleep(rqx.Ctx, d); err != nil {
+			return LockResult{Attempts: attempts}, err
+		}
+	}
+}
+
+func (m *Manager) now() time.Time {
+	if m.Now != nil {
+		return m.Now()
+	}
+	return time.Now()
+}
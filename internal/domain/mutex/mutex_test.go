@@ -33,12 +33,168 @@ func TestLockMutex(t *testing.T) {
 	// GIVEN a mutex that will be unlocked soon
 	deps.repo.Retries = 5
 	// WHEN there is an attempt to lock the mutex
-	err := deps.manager.LockMutex(deps.rqx, "triton", "rebooting the world")
+	result, err := deps.manager.LockMutex(deps.rqx, "conch", "rebooting the world", storage.LockExclusive, false)
 	// THEN it should succeed after retrying for 20 seconds
 	require.Equal(20*time.Second, deps.clock.Paused)
+	require.Equal(5, result.Attempts)
 	require.NoError(err)
 }
 
+func TestLockMutexGivesUp(t *testing.T) {
+	require := require.New(t)
+
+	deps := newDependencies()
+	// GIVEN a mutex that won't be unlocked soon
+	deps.repo.Retries = 100
+	// WHEN there is an attempt to lock the mutex
+	result, err := deps.manager.LockMutex(deps.rqx, "conch", "rebooting the world", storage.LockExclusive, false)
+	// THEN it should fail after the retry policy is exhausted
+	require.ErrorIs(err, storage.ErrAlreadyLocked)
+	require.Equal(5, result.Attempts)
+	require.Equal(20*time.Second, deps.clock.Paused)
+
+	deps = newDependencies()
+	// GIVEN a mutex that doesn't exist
+	require.NotContains(deps.repo.Mutexes, "triton")
+	// WHEN there is an attempt to lock the mutex
+	result, err = deps.manager.LockMutex(deps.rqx, "triton", "rebooting the world", storage.LockExclusive, false)
+	// THEN it should fail without retrying
+	require.ErrorIs(err, storage.ErrMutexNotFound)
+	require.Equal(1, result.Attempts)
+	require.Zero(deps.clock.Paused)
+
+	deps = newDependencies()
+	deps.manager.RetryPolicy = mutex.NoRetryPolicy{}
+	// GIVEN a locked mutex and a policy that doesn't retry
+	deps.repo.Retries = 5
+	// WHEN there is an attempt to lock the mutex
+	result, err = deps.manager.LockMutex(deps.rqx, "conch", "rebooting the world", storage.LockExclusive, false)
+	// THEN it should fail immediately
+	require.ErrorIs(err, storage.ErrAlreadyLocked)
+	require.Equal(1, result.Attempts)
+	require.Zero(deps.clock.Paused)
+}
+
+func TestLockMutexCanceled(t *testing.T) {
+	require := require.New(t)
+
+	deps := newDependencies()
+	ctx, cancel := context.WithCancel(context.Background())
+	deps.rqx.Ctx = ctx
+	// GIVEN a request that has been canceled
+	cancel()
+	// WHEN there is an attempt to lock a mutex
+	result, err := deps.manager.LockMutex(deps.rqx, "conch", "rebooting the world", storage.LockExclusive, false)
+	// THEN it should stop without trying
+	require.ErrorIs(err, context.Canceled)
+	require.Zero(result.Attempts)
+	require.Zero(deps.clock.Paused)
+}
+
+func TestLockMutexWait(t *testing.T) {
+	require := require.New(t)
+
+	deps := newDependencies()
+	alice := &rqx.RequestContext{Ctx: context.TODO(), EUser: rqx.User{SlackID: "UAlice"}}
+	bob := &rqx.RequestContext{Ctx: context.TODO(), EUser: rqx.User{SlackID: "UBob"}}
+	// GIVEN a locked mutex
+	deps.repo.Retries = 5
+	// WHEN two people wait for it
+	result, err := deps.manager.LockMutex(alice, "conch", "rebooting the world", storage.LockExclusive, true)
+	require.NoError(err)
+	require.Equal(1, result.Position)
+	result, err = deps.manager.LockMutex(bob, "conch", "fixing the world", storage.LockExclusive, true)
+	require.NoError(err)
+	require.Equal(2, result.Position)
+	// THEN they should be queued in order, without retrying
+	require.Equal(1, result.Attempts)
+	require.Zero(deps.clock.Paused)
+	status, err := deps.manager.QueuePosition(bob, "conch")
+	require.NoError(err)
+	require.Equal(2, status.Position)
+
+	// WHEN the first person leaves the queue
+	err = deps.manager.LeaveQueue(alice, "conch")
+	require.NoError(err)
+	// THEN everyone behind them should move up
+	status, err = deps.manager.QueuePosition(bob, "conch")
+	require.NoError(err)
+	require.Equal(1, status.Position)
+	_, err = deps.manager.QueuePosition(alice, "conch")
+	require.ErrorIs(err, storage.ErrNotQueued)
+}
+
+func TestLockGroup(t *testing.T) {
+	require := require.New(t)
+
+	deps := newDependencies()
+	deps.repo.Mutexes["triton"] = "staging and prod"
+	deps.repo.Aliases["shell"] = "conch"
+	deps.repo.Groups["everything"] = []string{"shell", "triton"}
+	// GIVEN a group that will be unlocked soon
+	deps.repo.Retries = 2
+	// WHEN there is an attempt to lock the group
+	result, err := deps.manager.LockMutex(deps.rqx, "everything", "rebooting the world", storage.LockExclusive, false)
+	// THEN it should succeed after retrying
+	require.NoError(err)
+	require.Equal(2, result.Attempts)
+
+	// WHEN there is an attempt to wait for the group
+	_, err = deps.manager.LockMutex(deps.rqx, "everything", "rebooting the world", storage.LockExclusive, true)
+	// THEN it should fail
+	require.Error(err)
+
+	// WHEN the group is checked
+	mutexes, err := deps.manager.MutexStatus(deps.rqx, "everything")
+	// THEN its members should be resolved
+	require.NoError(err)
+	require.Len(mutexes, 2)
+	require.Equal("conch", mutexes[0].Name)
+	require.Equal("triton", mutexes[1].Name)
+
+	// WHEN the group is unlocked
+	err = deps.manager.UnlockMutex(deps.rqx, "everything")
+	// THEN each of its mutexes should be unlocked
+	require.NoError(err)
+	require.Equal([]string{"conch", "triton"}, deps.repo.Unlocked)
+}
+
+func TestTransferMutex(t *testing.T) {
+	require := require.New(t)
+
+	deps := newDependencies()
+	deps.repo.Aliases["shell"] = "conch"
+	// GIVEN an alias for a locked mutex
+	_, err := deps.manager.LockMutex(deps.rqx, "shell", "rebooting the world", storage.LockExclusive, false)
+	require.NoError(err)
+	// WHEN the lock is transferred using the alias
+	err = deps.manager.TransferMutex(deps.rqx, "shell", "UBob", "your turn")
+	// THEN the mutex should be transferred
+	require.NoError(err)
+	require.Len(deps.repo.History["conch"], 1)
+	require.Equal("UBob", deps.repo.History["conch"][0].Data["to"])
+}
+
+func TestUpdateLockMessage(t *testing.T) {
+	require := require.New(t)
+
+	deps := newDependencies()
+	// GIVEN a locked mutex
+	_, err := deps.manager.LockMutex(deps.rqx, "conch", "running migration 1/5", storage.LockExclusive, false)
+	require.NoError(err)
+	// WHEN the holder updates their message
+	err = deps.manager.UpdateLockMessage(deps.rqx, "conch", "running migration 3/5")
+	// THEN the update should be recorded
+	require.NoError(err)
+	require.Len(deps.repo.History["conch"], 1)
+	require.Equal("mutex-message-updated", deps.repo.History["conch"][0].Type)
+	require.Equal("running migration 3/5", deps.repo.History["conch"][0].Data["message"])
+}
+
+// The storage layer asserts that its stores implement MutexStore.
+var _ mutex.Repo = storage.MutexStore(nil)
+var _ mutex.Repo = &storage.MutexRepoFake{}
+
 type dependencies struct {
 	manager *mutex.Manager
 	rqx     *rqx.RequestContext
@@ -0,0 +1,43 @@
+package mutex
+
+import (
+	"github.com/sjansen/stopgap/internal/rqx"
+	"github.com/sjansen/stopgap/internal/storage"
+	"github.com/sjansen/stopgap/internal/time"
+)
+
+// DefaultQueueTTL is how long a requester waits for a mutex before their
+// place in its queue expires.
+const DefaultQueueTTL = 1 * time.Hour
+
+func (m *Manager) waitForMutex(
+	rqx *rqx.RequestContext, name, message string, mode storage.LockMode,
+) (LockResult, error) {
+	if err := rqx.Ctx.Err(); err != nil {
+		return LockResult{}, err
+	}
+
+	ttl := m.QueueTTL
+	if ttl <= 0 {
+		ttl = DefaultQueueTTL
+	}
+	position, err := m.Mutexes.WaitForMutex(rqx, name, message, mode, ttl)
+	if err != nil || position < 1 {
+		return LockResult{Attempts: 1}, err
+	}
+
+	status, err := m.queueStatus(rqx, name, position)
+	if err != nil {
+		return LockResult{Attempts: 1, Position: position}, err
+	}
+	return LockResult{
+		Attempts: 1,
+		Position: position,
+		Estimate: status.Estimate,
+	}, nil
+}
+
+// LeaveQueue stops the requester from waiting for the named mutex.
+func (m *Manager) LeaveQueue(rqx *rqx.RequestContext, name string) error {
+	return m.Mutexes.LeaveQueue(rqx, name)
+}
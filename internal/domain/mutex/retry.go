@@ -0,0 +1,76 @@
+package mutex
+
+import (
+	"math/rand"
+
+	"github.com/sjansen/stopgap/internal/time"
+)
+
+// RetryPolicy decides whether, and how soon, to try locking a mutex again
+// after it was found to be already locked.
+type RetryPolicy interface {
+	// NextDelay is called after the given number of failed attempts, and
+	// returns false when there should be no more attempts.
+	NextDelay(attempts int) (time.Duration, bool)
+}
+
+// DefaultRetryPolicy is used when a Manager doesn't have a policy.
+var DefaultRetryPolicy = FixedRetryPolicy{
+	1 * time.Second,
+	3 * time.Second,
+	6 * time.Second,
+	10 * time.Second,
+}
+
+var _ RetryPolicy = FixedRetryPolicy{}
+var _ RetryPolicy = &ExponentialRetryPolicy{}
+var _ RetryPolicy = NoRetryPolicy{}
+
+// FixedRetryPolicy waits for each delay in turn, then gives up.
+type FixedRetryPolicy []time.Duration
+
+// NextDelay implements RetryPolicy.
+func (p FixedRetryPolicy) NextDelay(attempts int) (time.Duration, bool) {
+	if attempts < 1 || attempts > len(p) {
+		return 0, false
+	}
+	return p[attempts-1], true
+}
+
+// ExponentialRetryPolicy doubles the longest possible delay after every
+// attempt, up to Max, and waits for a random part of it so that waiting
+// requests don't retry in lockstep.
+type ExponentialRetryPolicy struct {
+	Base        time.Duration
+	Max         time.Duration
+	MaxAttempts int
+	// Rand returns a number in [0.0, 1.0), and defaults to rand.Float64.
+	Rand func() float64
+}
+
+// NextDelay implements RetryPolicy.
+func (p *ExponentialRetryPolicy) NextDelay(attempts int) (time.Duration, bool) {
+	if attempts < 1 || attempts >= p.MaxAttempts {
+		return 0, false
+	}
+	d := p.Base
+	for i := 1; i < attempts && d < p.Max; i++ {
+		d *= 2
+	}
+	if d > p.Max {
+		d = p.Max
+	}
+	random := rand.Float64
+	if p.Rand != nil {
+		random = p.Rand
+	}
+	return time.Duration(float64(d) * random()), true
+}
+
+// NoRetryPolicy gives up after the first attempt.
+type NoRetryPolicy struct{}
+
+// NextDelay implements RetryPolicy.
+func (NoRetryPolicy) NextDelay(attempts int) (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,66 @@
+package mutex_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sjansen/stopgap/internal/domain/mutex"
+	"github.com/sjansen/stopgap/internal/time"
+)
+
+func TestFixedRetryPolicy(t *testing.T) {
+	require := require.New(t)
+
+	// GIVEN a fixed schedule
+	policy := mutex.FixedRetryPolicy{time.Second, 5 * time.Second}
+	// WHEN delays are requested
+	// THEN the schedule should be followed until it runs out
+	d, ok := policy.NextDelay(1)
+	require.True(ok)
+	require.Equal(time.Second, d)
+	d, ok = policy.NextDelay(2)
+	require.True(ok)
+	require.Equal(5*time.Second, d)
+	_, ok = policy.NextDelay(3)
+	require.False(ok)
+}
+
+func TestExponentialRetryPolicy(t *testing.T) {
+	require := require.New(t)
+
+	// GIVEN an exponential policy with predictable jitter
+	policy := &mutex.ExponentialRetryPolicy{
+		Base:        time.Second,
+		Max:         5 * time.Second,
+		MaxAttempts: 5,
+		Rand:        func() float64 { return 0.5 },
+	}
+	// WHEN delays are requested
+	var delays []time.Duration
+	for attempts := 1; ; attempts++ {
+		d, ok := policy.NextDelay(attempts)
+		if !ok {
+			break
+		}
+		delays = append(delays, d)
+	}
+	// THEN each delay should double, up to the limit
+	require.Equal([]time.Duration{
+		500 * time.Millisecond,
+		1 * time.Second,
+		2 * time.Second,
+		2500 * time.Millisecond,
+	}, delays)
+}
+
+func TestNoRetryPolicy(t *testing.T) {
+	require := require.New(t)
+
+	// GIVEN a policy that doesn't retry
+	policy := mutex.NoRetryPolicy{}
+	// WHEN a delay is requested
+	_, ok := policy.NextDelay(1)
+	// THEN there should be no more attempts
+	require.False(ok)
+}
@@ -0,0 +1,1006 @@
+package dynamofake
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// reserved is the subset of DynamoDB's reserved words that are likely to
+// collide with attribute names. Using one directly in an expression is an
+// error in DynamoDB, so the fake rejects it too.
+var reserved = map[string]bool{
+	"ACTION": true, "ADD": true, "ALL": true, "AND": true, "AS": true,
+	"ASC": true, "BETWEEN": true, "BY": true, "CAPACITY": true,
+	"COMMENT": true, "COUNT": true, "CREATE": true, "DATA": true,
+	"DATE": true, "DELETE": true, "DESC": true, "END": true,
+	"EXISTS": true, "FROM": true, "GROUP": true, "HASH": true, "IN": true,
+	"INDEX": true, "IS": true, "ITEM": true, "KEY": true, "KEYS": true,
+	"LIMIT": true, "LOCK": true, "MAP": true, "MODE": true, "NAME": true,
+	"NOT": true, "NULL": true, "OF": true, "OR": true, "ORDER": true,
+	"OWNER": true, "POSITION": true, "RANGE": true, "REMOVE": true,
+	"SET": true, "SIZE": true, "START": true, "STATUS": true,
+	"TABLE": true, "TIME": true, "TIMESTAMP": true, "TO": true,
+	"TTL": true, "TYPE": true, "USER": true, "VALUE": true,
+	"VALUES": true, "WHERE": true, "ZONE": true,
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokName
+	tokValue
+	tokNumber
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '#' || r == ':' || unicode.IsLetter(r) || r == '_':
+			j := i + 1
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_') {
+				j++
+			}
+			kind := tokIdent
+			if r == '#' {
+				kind = tokName
+			} else if r == ':' {
+				kind = tokValue
+			}
+			tokens = append(tokens, token{kind, string(runes[i:j])})
+			i = j
+		case unicode.IsDigit(r):
+			j := i + 1
+			for j < len(runes) && unicode.IsDigit(runes[j]) {
+				j++
+			}
+			tokens = append(tokens, token{tokNumber, string(runes[i:j])})
+			i = j
+		case r == '<' || r == '>':
+			if i+1 < len(runes) && (runes[i+1] == '=' || (r == '<' && runes[i+1] == '>')) {
+				tokens = append(tokens, token{tokPunct, string(runes[i : i+2])})
+				i += 2
+			} else {
+				tokens = append(tokens, token{tokPunct, string(r)})
+				i++
+			}
+		case strings.ContainsRune("()[],.=+-", r):
+			tokens = append(tokens, token{tokPunct, string(r)})
+			i++
+		default:
+			return nil, validationErrorf("invalid expression: unexpected %q", r)
+		}
+	}
+	return append(tokens, token{kind: tokEOF}), nil
+}
+
+// attrs holds the placeholders shared by every expression in a request.
+type attrs struct {
+	names  map[string]string
+	values map[string]types.AttributeValue
+
+	usedNames  map[string]bool
+	usedValues map[string]bool
+}
+
+func newAttrs(names map[string]string, values map[string]types.AttributeValue) *attrs {
+	return &attrs{
+		names:      names,
+		values:     values,
+		usedNames:  map[string]bool{},
+		usedValues: map[string]bool{},
+	}
+}
+
+func (a *attrs) checkUnused() error {
+	for k := range a.names {
+		if !a.usedNames[k] {
+			return validationErrorf("Value provided in ExpressionAttributeNames unused in expressions: keys: {%s}", k)
+		}
+	}
+	for k := range a.values {
+		if !a.usedValues[k] {
+			return validationErrorf("Value provided in ExpressionAttributeValues unused in expressions: keys: {%s}", k)
+		}
+	}
+	return nil
+}
+
+type parser struct {
+	*attrs
+	tokens []token
+	pos    int
+}
+
+func newParser(expr string, a *attrs) (*parser, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &parser{attrs: a, tokens: tokens}, nil
+}
+
+func (a *attrs) condition(expr *string) (condition, error) {
+	if expr == nil {
+		return nil, nil
+	}
+	p, err := newParser(*expr, a)
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.parseCondition()
+	if err != nil {
+		return nil, err
+	}
+	return c, p.expectEOF()
+}
+
+func (a *attrs) update(expr *string) (*update, error) {
+	if expr == nil {
+		return nil, validationErrorf("UpdateExpression is required")
+	}
+	p, err := newParser(*expr, a)
+	if err != nil {
+		return nil, err
+	}
+	return p.parseUpdate()
+}
+
+func (a *attrs) projection(expr *string) ([]path, error) {
+	if expr == nil {
+		return nil, nil
+	}
+	p, err := newParser(*expr, a)
+	if err != nil {
+		return nil, err
+	}
+	return p.parseProjection()
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isKeyword(kw string) bool {
+	t := p.peek()
+	return t.kind == tokIdent && strings.EqualFold(t.text, kw)
+}
+
+func (p *parser) isPunct(s string) bool {
+	t := p.peek()
+	return t.kind == tokPunct && t.text == s
+}
+
+func (p *parser) expectPunct(s string) error {
+	if !p.isPunct(s) {
+		return validationErrorf("invalid expression: expected %q, found %q", s, p.peek().text)
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) expectEOF() error {
+	if t := p.peek(); t.kind != tokEOF {
+		return validationErrorf("invalid expression: unexpected %q", t.text)
+	}
+	return nil
+}
+
+func (p *parser) parsePath() (path, error) {
+	var result path
+	for {
+		t := p.next()
+		switch t.kind {
+		case tokIdent:
+			if reserved[strings.ToUpper(t.text)] {
+				return nil, validationErrorf(
+					"Attribute name is a reserved keyword; reserved keyword: %s", t.text,
+				)
+			}
+			result = append(result, pathElem{name: t.text})
+		case tokName:
+			name, ok := p.names[t.text]
+			if !ok {
+				return nil, validationErrorf(
+					"An expression attribute name used in the document path is not defined; attribute name: %s", t.text,
+				)
+			}
+			p.usedNames[t.text] = true
+			result = append(result, pathElem{name: name})
+		default:
+			return nil, validationErrorf("invalid expression: expected path, found %q", t.text)
+		}
+		for p.isPunct("[") {
+			p.next()
+			n := p.next()
+			if n.kind != tokNumber {
+				return nil, validationErrorf("invalid expression: expected list index")
+			}
+			idx, _ := strconv.Atoi(n.text)
+			if err := p.expectPunct("]"); err != nil {
+				return nil, err
+			}
+			result = append(result, pathElem{index: idx, isIndex: true})
+		}
+		if !p.isPunct(".") {
+			return result, nil
+		}
+		p.next()
+	}
+}
+
+func (p *parser) parseValueRef() (types.AttributeValue, error) {
+	t := p.next()
+	v, ok := p.values[t.text]
+	if !ok {
+		return nil, validationErrorf(
+			"An expression attribute value used in expression is not defined; attribute value: %s", t.text,
+		)
+	}
+	p.usedValues[t.text] = true
+	return v, nil
+}
+
+// operands
+
+type operand interface {
+	eval(item) (types.AttributeValue, bool, error)
+}
+
+type pathOperand struct{ p path }
+
+func (o pathOperand) eval(it item) (types.AttributeValue, bool, error) {
+	v, ok := getPath(it, o.p)
+	return v, ok, nil
+}
+
+type valueOperand struct{ v types.AttributeValue }
+
+func (o valueOperand) eval(item) (types.AttributeValue, bool, error) {
+	return o.v, true, nil
+}
+
+type sizeOperand struct{ p path }
+
+func (o sizeOperand) eval(it item) (types.AttributeValue, bool, error) {
+	v, ok := getPath(it, o.p)
+	if !ok {
+		return nil, false, nil
+	}
+	n, ok := size(v)
+	if !ok {
+		return nil, false, nil
+	}
+	return &types.AttributeValueMemberN{Value: strconv.Itoa(n)}, true, nil
+}
+
+type ifNotExistsOperand struct {
+	p        path
+	fallback operand
+}
+
+func (o ifNotExistsOperand) eval(it item) (types.AttributeValue, bool, error) {
+	if v, ok := getPath(it, o.p); ok {
+		return v, true, nil
+	}
+	return o.fallback.eval(it)
+}
+
+type listAppendOperand struct{ a, b operand }
+
+func (o listAppendOperand) eval(it item) (types.AttributeValue, bool, error) {
+	a, ok, err := o.a.eval(it)
+	if err != nil || !ok {
+		return nil, false, orMissing(err, "list_append")
+	}
+	b, ok, err := o.b.eval(it)
+	if err != nil || !ok {
+		return nil, false, orMissing(err, "list_append")
+	}
+	al, ok1 := a.(*types.AttributeValueMemberL)
+	bl, ok2 := b.(*types.AttributeValueMemberL)
+	if !ok1 || !ok2 {
+		return nil, false, validationErrorf("list_append: operands must be lists")
+	}
+	l := make([]types.AttributeValue, 0, len(al.Value)+len(bl.Value))
+	for _, v := range al.Value {
+		l = append(l, copyValue(v))
+	}
+	for _, v := range bl.Value {
+		l = append(l, copyValue(v))
+	}
+	return &types.AttributeValueMemberL{Value: l}, true, nil
+}
+
+type arithOperand struct {
+	op   string
+	a, b operand
+}
+
+func (o arithOperand) eval(it item) (types.AttributeValue, bool, error) {
+	a, ok, err := o.a.eval(it)
+	if err != nil || !ok {
+		return nil, false, orMissing(err, "arithmetic")
+	}
+	b, ok, err := o.b.eval(it)
+	if err != nil || !ok {
+		return nil, false, orMissing(err, "arithmetic")
+	}
+	an, ok1 := a.(*types.AttributeValueMemberN)
+	bn, ok2 := b.(*types.AttributeValueMemberN)
+	if !ok1 || !ok2 {
+		return nil, false, validationErrorf("An operand in the update expression has an incorrect data type")
+	}
+	x, err := parseNumber(an.Value)
+	if err != nil {
+		return nil, false, err
+	}
+	y, err := parseNumber(bn.Value)
+	if err != nil {
+		return nil, false, err
+	}
+	if o.op == "+" {
+		x.Add(x, y)
+	} else {
+		x.Sub(x, y)
+	}
+	return &types.AttributeValueMemberN{Value: formatNumber(x)}, true, nil
+}
+
+func orMissing(err error, what string) error {
+	if err != nil {
+		return err
+	}
+	return validationErrorf(
+		"The provided expression refers to an attribute that does not exist in the item (%s)", what,
+	)
+}
+
+func (p *parser) parseOperand() (operand, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokValue:
+		v, err := p.parseValueRef()
+		if err != nil {
+			return nil, err
+		}
+		return valueOperand{v}, nil
+	case t.kind == tokIdent && strings.EqualFold(t.text, "size") && p.tokens[p.pos+1].text == "(":
+		p.next()
+		p.next()
+		path, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return nil, err
+		}
+		return sizeOperand{path}, nil
+	}
+	path, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+	return pathOperand{path}, nil
+}
+
+// conditions
+
+type condition interface {
+	eval(item) (bool, error)
+}
+
+type andCond struct{ a, b condition }
+
+func (c andCond) eval(it item) (bool, error) {
+	ok, err := c.a.eval(it)
+	if err != nil || !ok {
+		return false, err
+	}
+	return c.b.eval(it)
+}
+
+type orCond struct{ a, b condition }
+
+func (c orCond) eval(it item) (bool, error) {
+	ok, err := c.a.eval(it)
+	if err != nil || ok {
+		return ok, err
+	}
+	return c.b.eval(it)
+}
+
+type notCond struct{ c condition }
+
+func (c notCond) eval(it item) (bool, error) {
+	ok, err := c.c.eval(it)
+	return !ok, err
+}
+
+type compareCond struct {
+	op   string
+	a, b operand
+}
+
+func (c compareCond) eval(it item) (bool, error) {
+	a, ok, err := c.a.eval(it)
+	if err != nil || !ok {
+		return false, err
+	}
+	b, ok, err := c.b.eval(it)
+	if err != nil || !ok {
+		return false, err
+	}
+	switch c.op {
+	case "=":
+		return equal(a, b), nil
+	case "<>":
+		return !equal(a, b), nil
+	}
+	n, ok := compare(a, b)
+	if !ok {
+		return false, nil
+	}
+	switch c.op {
+	case "<":
+		return n < 0, nil
+	case "<=":
+		return n <= 0, nil
+	case ">":
+		return n > 0, nil
+	default:
+		return n >= 0, nil
+	}
+}
+
+type betweenCond struct{ a, lo, hi operand }
+
+func (c betweenCond) eval(it item) (bool, error) {
+	ge, err := compareCond{">=", c.a, c.lo}.eval(it)
+	if err != nil || !ge {
+		return false, err
+	}
+	return compareCond{"<=", c.a, c.hi}.eval(it)
+}
+
+type inCond struct {
+	a    operand
+	list []operand
+}
+
+func (c inCond) eval(it item) (bool, error) {
+	for _, o := range c.list {
+		if ok, err := (compareCond{"=", c.a, o}).eval(it); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+type funcCond struct {
+	name string
+	p    path
+	arg  operand
+}
+
+func (c funcCond) eval(it item) (bool, error) {
+	v, exists := getPath(it, c.p)
+	switch c.name {
+	case "attribute_exists":
+		return exists, nil
+	case "attribute_not_exists":
+		return !exists, nil
+	}
+	if !exists {
+		return false, nil
+	}
+	arg, ok, err := c.arg.eval(it)
+	if err != nil || !ok {
+		return false, err
+	}
+	switch c.name {
+	case "attribute_type":
+		s, ok := arg.(*types.AttributeValueMemberS)
+		return ok && s.Value == typeOf(v), nil
+	case "begins_with":
+		switch v := v.(type) {
+		case *types.AttributeValueMemberS:
+			s, ok := arg.(*types.AttributeValueMemberS)
+			return ok && strings.HasPrefix(v.Value, s.Value), nil
+		case *types.AttributeValueMemberB:
+			b, ok := arg.(*types.AttributeValueMemberB)
+			return ok && strings.HasPrefix(string(v.Value), string(b.Value)), nil
+		}
+		return false, nil
+	default: // contains
+		switch v := v.(type) {
+		case *types.AttributeValueMemberS:
+			s, ok := arg.(*types.AttributeValueMemberS)
+			return ok && strings.Contains(v.Value, s.Value), nil
+		case *types.AttributeValueMemberSS:
+			s, ok := arg.(*types.AttributeValueMemberS)
+			return ok && containsString(v.Value, s.Value), nil
+		case *types.AttributeValueMemberNS:
+			n, ok := arg.(*types.AttributeValueMemberN)
+			return ok && containsString(v.Value, n.Value), nil
+		case *types.AttributeValueMemberL:
+			for _, e := range v.Value {
+				if equal(e, arg) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) parseCondition() (condition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orCond{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (condition, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("AND") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andCond{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (condition, error) {
+	if p.isKeyword("NOT") {
+		p.next()
+		c, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notCond{c}, nil
+	}
+	return p.parsePrimary()
+}
+
+var conditionFuncs = map[string]bool{
+	"attribute_exists":     true,
+	"attribute_not_exists": true,
+	"attribute_type":       true,
+	"begins_with":          true,
+	"contains":             true,
+}
+
+func (p *parser) parsePrimary() (condition, error) {
+	if p.isPunct("(") {
+		p.next()
+		c, err := p.parseCondition()
+		if err != nil {
+			return nil, err
+		}
+		return c, p.expectPunct(")")
+	}
+	if t := p.peek(); t.kind == tokIdent && conditionFuncs[strings.ToLower(t.text)] {
+		name := strings.ToLower(p.next().text)
+		if err := p.expectPunct("("); err != nil {
+			return nil, err
+		}
+		path, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		c := funcCond{name: name, p: path}
+		if name != "attribute_exists" && name != "attribute_not_exists" {
+			if err := p.expectPunct(","); err != nil {
+				return nil, err
+			}
+			if c.arg, err = p.parseOperand(); err != nil {
+				return nil, err
+			}
+		}
+		return c, p.expectPunct(")")
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case p.isKeyword("BETWEEN"):
+		p.next()
+		lo, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isKeyword("AND") {
+			return nil, validationErrorf("invalid expression: expected AND in BETWEEN")
+		}
+		p.next()
+		hi, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return betweenCond{left, lo, hi}, nil
+	case p.isKeyword("IN"):
+		p.next()
+		if err := p.expectPunct("("); err != nil {
+			return nil, err
+		}
+		c := inCond{a: left}
+		for {
+			o, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			c.list = append(c.list, o)
+			if !p.isPunct(",") {
+				break
+			}
+			p.next()
+		}
+		return c, p.expectPunct(")")
+	}
+	t := p.next()
+	switch t.text {
+	case "=", "<>", "<", "<=", ">", ">=":
+	default:
+		return nil, validationErrorf("invalid expression: expected comparator, found %q", t.text)
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return compareCond{t.text, left, right}, nil
+}
+
+// updates
+
+type setAction struct {
+	p     path
+	value operand
+}
+
+type addAction struct {
+	p     path
+	value types.AttributeValue
+}
+
+type update struct {
+	sets    []setAction
+	removes []path
+	adds    []addAction
+	deletes []addAction
+}
+
+func (p *parser) parseUpdate() (*update, error) {
+	u := &update{}
+	seen := map[string]bool{}
+	for p.peek().kind != tokEOF {
+		t := p.next()
+		clause := strings.ToUpper(t.text)
+		if t.kind != tokIdent || seen[clause] {
+			return nil, validationErrorf("invalid UpdateExpression: unexpected %q", t.text)
+		}
+		seen[clause] = true
+		for {
+			switch clause {
+			case "SET":
+				path, err := p.parsePath()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expectPunct("="); err != nil {
+					return nil, err
+				}
+				value, err := p.parseSetValue()
+				if err != nil {
+					return nil, err
+				}
+				u.sets = append(u.sets, setAction{path, value})
+			case "REMOVE":
+				path, err := p.parsePath()
+				if err != nil {
+					return nil, err
+				}
+				u.removes = append(u.removes, path)
+			case "ADD", "DELETE":
+				path, err := p.parsePath()
+				if err != nil {
+					return nil, err
+				}
+				value, err := p.parseValueRef()
+				if err != nil {
+					return nil, err
+				}
+				if clause == "ADD" {
+					u.adds = append(u.adds, addAction{path, value})
+				} else {
+					u.deletes = append(u.deletes, addAction{path, value})
+				}
+			default:
+				return nil, validationErrorf("invalid UpdateExpression: unexpected %q", t.text)
+			}
+			if !p.isPunct(",") {
+				break
+			}
+			p.next()
+		}
+	}
+	return u, u.checkOverlap()
+}
+
+func (u *update) checkOverlap() error {
+	var paths []path
+	for _, a := range u.sets {
+		paths = append(paths, a.p)
+	}
+	paths = append(paths, u.removes...)
+	for _, a := range u.adds {
+		paths = append(paths, a.p)
+	}
+	for _, a := range u.deletes {
+		paths = append(paths, a.p)
+	}
+	for i := range paths {
+		for j := i + 1; j < len(paths); j++ {
+			if paths[i].overlaps(paths[j]) {
+				return validationErrorf(
+					"Invalid UpdateExpression: Two document paths overlap with each other; [%s, %s]",
+					paths[i], paths[j],
+				)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *parser) parseSetValue() (operand, error) {
+	left, err := p.parseSetOperand()
+	if err != nil {
+		return nil, err
+	}
+	if p.isPunct("+") || p.isPunct("-") {
+		op := p.next().text
+		right, err := p.parseSetOperand()
+		if err != nil {
+			return nil, err
+		}
+		return arithOperand{op, left, right}, nil
+	}
+	return left, nil
+}
+
+func (p *parser) parseSetOperand() (operand, error) {
+	t := p.peek()
+	if t.kind == tokIdent && p.tokens[p.pos+1].text == "(" {
+		switch strings.ToLower(t.text) {
+		case "if_not_exists":
+			p.next()
+			p.next()
+			path, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectPunct(","); err != nil {
+				return nil, err
+			}
+			fallback, err := p.parseSetOperand()
+			if err != nil {
+				return nil, err
+			}
+			return ifNotExistsOperand{path, fallback}, p.expectPunct(")")
+		case "list_append":
+			p.next()
+			p.next()
+			a, err := p.parseSetOperand()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectPunct(","); err != nil {
+				return nil, err
+			}
+			b, err := p.parseSetOperand()
+			if err != nil {
+				return nil, err
+			}
+			return listAppendOperand{a, b}, p.expectPunct(")")
+		}
+	}
+	return p.parseOperand()
+}
+
+func (u *update) apply(it item) error {
+	type assignment struct {
+		p path
+		v types.AttributeValue
+	}
+	// every value is computed against the original item
+	var assignments []assignment
+	for _, a := range u.sets {
+		v, ok, err := a.value.eval(it)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return orMissing(nil, a.p.String())
+		}
+		assignments = append(assignments, assignment{a.p, copyValue(v)})
+	}
+	for _, a := range u.adds {
+		v, err := addValues(it, a)
+		if err != nil {
+			return err
+		}
+		assignments = append(assignments, assignment{a.p, v})
+	}
+	for _, a := range u.deletes {
+		v, remove, err := deleteValues(it, a)
+		if err != nil {
+			return err
+		}
+		if remove {
+			u.removes = append(u.removes, a.p)
+		} else if v != nil {
+			assignments = append(assignments, assignment{a.p, v})
+		}
+	}
+	for _, a := range assignments {
+		if err := setPath(it, a.p, a.v); err != nil {
+			return err
+		}
+	}
+	removePaths(it, u.removes)
+	return nil
+}
+
+func addValues(it item, a addAction) (types.AttributeValue, error) {
+	cur, exists := getPath(it, a.p)
+	if !exists {
+		return copyValue(a.value), nil
+	}
+	switch v := a.value.(type) {
+	case *types.AttributeValueMemberN:
+		c, ok := cur.(*types.AttributeValueMemberN)
+		if !ok {
+			return nil, validationErrorf("An operand in the update expression has an incorrect data type")
+		}
+		x, err := parseNumber(c.Value)
+		if err != nil {
+			return nil, err
+		}
+		y, err := parseNumber(v.Value)
+		if err != nil {
+			return nil, err
+		}
+		return &types.AttributeValueMemberN{Value: formatNumber(x.Add(x, y))}, nil
+	case *types.AttributeValueMemberSS:
+		c, ok := cur.(*types.AttributeValueMemberSS)
+		if !ok {
+			return nil, validationErrorf("An operand in the update expression has an incorrect data type")
+		}
+		return &types.AttributeValueMemberSS{Value: union(c.Value, v.Value)}, nil
+	case *types.AttributeValueMemberNS:
+		c, ok := cur.(*types.AttributeValueMemberNS)
+		if !ok {
+			return nil, validationErrorf("An operand in the update expression has an incorrect data type")
+		}
+		return &types.AttributeValueMemberNS{Value: union(c.Value, v.Value)}, nil
+	}
+	return nil, validationErrorf("ADD only supports numbers and sets")
+}
+
+func deleteValues(it item, a addAction) (types.AttributeValue, bool, error) {
+	cur, exists := getPath(it, a.p)
+	if !exists {
+		return nil, false, nil
+	}
+	var remaining []string
+	switch v := a.value.(type) {
+	case *types.AttributeValueMemberSS:
+		c, ok := cur.(*types.AttributeValueMemberSS)
+		if !ok {
+			return nil, false, validationErrorf("An operand in the update expression has an incorrect data type")
+		}
+		remaining = difference(c.Value, v.Value)
+		if len(remaining) > 0 {
+			return &types.AttributeValueMemberSS{Value: remaining}, false, nil
+		}
+	case *types.AttributeValueMemberNS:
+		c, ok := cur.(*types.AttributeValueMemberNS)
+		if !ok {
+			return nil, false, validationErrorf("An operand in the update expression has an incorrect data type")
+		}
+		remaining = difference(c.Value, v.Value)
+		if len(remaining) > 0 {
+			return &types.AttributeValueMemberNS{Value: remaining}, false, nil
+		}
+	default:
+		return nil, false, validationErrorf("DELETE only supports sets")
+	}
+	return nil, true, nil
+}
+
+func union(a, b []string) []string {
+	result := append([]string(nil), a...)
+	for _, s := range b {
+		if !containsString(result, s) {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func difference(a, b []string) []string {
+	var result []string
+	for _, s := range a {
+		if !containsString(b, s) {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// projections
+
+func (p *parser) parseProjection() ([]path, error) {
+	var paths []path
+	for {
+		path, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+		if !p.isPunct(",") {
+			break
+		}
+		p.next()
+	}
+	return paths, p.expectEOF()
+}
@@ -0,0 +1,872 @@
+// Package dynamofake implements an in-process fake of the subset of the
+// DynamoDB API used by stopgap, so storage tests can run without
+// DynamoDB Local.
+package dynamofake
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+)
+
+const arnPrefix = "arn:aws:dynamodb:us-west-2:000000000000:table/"
+
+// Client is a fake DynamoDB client. The zero value is not usable; use New.
+type Client struct {
+	// BatchGetLimit, when positive, caps the number of keys BatchGetItem
+	// processes per call. The rest are returned as UnprocessedKeys.
+	BatchGetLimit int
+
+	mu      sync.Mutex
+	now     func() time.Time
+	tables  map[string]*table
+	streams *Streams
+}
+
+type table struct {
+	desc     types.TableDescription
+	hashKey  string
+	rangeKey string
+	items    map[string]item
+	ttl      *types.TimeToLiveDescription
+	pitr     bool
+	tags     map[string]string
+	stream   *stream
+}
+
+// New creates an empty fake.
+func New() *Client {
+	c := &Client{
+		now:    time.Now,
+		tables: map[string]*table{},
+	}
+	c.streams = &Streams{client: c}
+	return c
+}
+
+// SetClock overrides the source of the current time.
+func (c *Client) SetClock(now func() time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+func validationErrorf(format string, args ...interface{}) error {
+	return &smithy.GenericAPIError{
+		Code:    "ValidationException",
+		Message: fmt.Sprintf(format, args...),
+		Fault:   smithy.FaultClient,
+	}
+}
+
+func notFound(name *string) error {
+	return &types.ResourceNotFoundException{
+		Message: aws.String("Cannot do operations on a non-existent table: " + aws.ToString(name)),
+	}
+}
+
+func (c *Client) table(name *string) (*table, error) {
+	if name == nil {
+		return nil, validationErrorf("TableName is required")
+	}
+	t, ok := c.tables[*name]
+	if !ok {
+		return nil, notFound(name)
+	}
+	return t, nil
+}
+
+func (t *table) attrType(name string) types.ScalarAttributeType {
+	for _, d := range t.desc.AttributeDefinitions {
+		if aws.ToString(d.AttributeName) == name {
+			return d.AttributeType
+		}
+	}
+	return ""
+}
+
+func keySchema(schema []types.KeySchemaElement) (hash, rng string) {
+	for _, k := range schema {
+		switch k.KeyType {
+		case types.KeyTypeHash:
+			hash = aws.ToString(k.AttributeName)
+		case types.KeyTypeRange:
+			rng = aws.ToString(k.AttributeName)
+		}
+	}
+	return hash, rng
+}
+
+func (t *table) keyAttr(it item, name string) (string, error) {
+	v, ok := it[name]
+	if !ok {
+		return "", validationErrorf("One of the required keys was not given a value: %s", name)
+	}
+	if typeOf(v) != string(t.attrType(name)) {
+		return "", validationErrorf(
+			"One or more parameter values were invalid: Type mismatch for key %s", name,
+		)
+	}
+	switch v := v.(type) {
+	case *types.AttributeValueMemberS:
+		return "S" + v.Value, nil
+	case *types.AttributeValueMemberN:
+		r, err := parseNumber(v.Value)
+		if err != nil {
+			return "", err
+		}
+		return "N" + r.RatString(), nil
+	case *types.AttributeValueMemberB:
+		return "B" + string(v.Value), nil
+	}
+	return "", validationErrorf("invalid key type for %s", name)
+}
+
+func (t *table) keyOf(it item) (string, error) {
+	h, err := t.keyAttr(it, t.hashKey)
+	if err != nil {
+		return "", err
+	}
+	if t.rangeKey == "" {
+		return h, nil
+	}
+	r, err := t.keyAttr(it, t.rangeKey)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Quote(h) + "/" + strconv.Quote(r), nil
+}
+
+// key validates a request key and returns its internal representation.
+func (t *table) key(key item) (string, error) {
+	expected := 1
+	if t.rangeKey != "" {
+		expected = 2
+	}
+	if len(key) != expected {
+		return "", validationErrorf("The provided key element does not match the schema")
+	}
+	return t.keyOf(key)
+}
+
+func (t *table) primaryKey(it item) item {
+	key := item{t.hashKey: copyValue(it[t.hashKey])}
+	if t.rangeKey != "" {
+		key[t.rangeKey] = copyValue(it[t.rangeKey])
+	}
+	return key
+}
+
+func (t *table) checkKeyUnchanged(before, after item) error {
+	for _, name := range []string{t.hashKey, t.rangeKey} {
+		if name == "" {
+			continue
+		}
+		v, ok := after[name]
+		if !ok || !equal(v, before[name]) {
+			return validationErrorf(
+				"One or more parameter values were invalid: Cannot update attribute %s. This attribute is part of the key", name,
+			)
+		}
+	}
+	return nil
+}
+
+func (t *table) write(key string, old, new item, now time.Time) {
+	if new == nil {
+		delete(t.items, key)
+	} else {
+		t.items[key] = new
+	}
+	if t.stream != nil {
+		t.stream.record(t, old, new, now)
+	}
+}
+
+func conditionFailed(returnOld bool, old item) error {
+	err := &types.ConditionalCheckFailedException{
+		Message: aws.String("The conditional request failed"),
+	}
+	if returnOld {
+		err.Item = copyItem(old)
+	}
+	return err
+}
+
+func check(cond condition, it item) (bool, error) {
+	if cond == nil {
+		return true, nil
+	}
+	if it == nil {
+		it = item{}
+	}
+	return cond.eval(it)
+}
+
+// GetItem implements the DynamoDB API.
+func (c *Client) GetItem(
+	ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.GetItemOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := t.key(params.Key)
+	if err != nil {
+		return nil, err
+	}
+	a := newAttrs(params.ExpressionAttributeNames, nil)
+	projection, err := a.projection(params.ProjectionExpression)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	out := &dynamodb.GetItemOutput{}
+	if it, ok := t.items[key]; ok {
+		out.Item = project(it, projection)
+	}
+	return out, nil
+}
+
+// BatchGetItem implements the DynamoDB API.
+func (c *Client) BatchGetItem(
+	ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.BatchGetItemOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := &dynamodb.BatchGetItemOutput{
+		Responses:       map[string][]map[string]types.AttributeValue{},
+		UnprocessedKeys: map[string]types.KeysAndAttributes{},
+	}
+	total := 0
+	processed := 0
+	names := make([]string, 0, len(params.RequestItems))
+	for name := range params.RequestItems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		req := params.RequestItems[name]
+		t, err := c.table(aws.String(name))
+		if err != nil {
+			return nil, err
+		}
+		a := newAttrs(req.ExpressionAttributeNames, nil)
+		projection, err := a.projection(req.ProjectionExpression)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.checkUnused(); err != nil {
+			return nil, err
+		}
+		seen := map[string]bool{}
+		for _, k := range req.Keys {
+			total++
+			key, err := t.key(k)
+			if err != nil {
+				return nil, err
+			}
+			if seen[key] {
+				return nil, validationErrorf("Provided list of item keys contains duplicates")
+			}
+			seen[key] = true
+			if c.BatchGetLimit > 0 && processed >= c.BatchGetLimit {
+				u := out.UnprocessedKeys[name]
+				u.Keys = append(u.Keys, copyItem(k))
+				u.ProjectionExpression = req.ProjectionExpression
+				u.ExpressionAttributeNames = req.ExpressionAttributeNames
+				u.ConsistentRead = req.ConsistentRead
+				out.UnprocessedKeys[name] = u
+				continue
+			}
+			processed++
+			if it, ok := t.items[key]; ok {
+				out.Responses[name] = append(out.Responses[name], project(it, projection))
+			}
+		}
+	}
+	if total > 100 {
+		return nil, validationErrorf("Too many items requested for the BatchGetItem call")
+	}
+	return out, nil
+}
+
+// PutItem implements the DynamoDB API.
+func (c *Client) PutItem(
+	ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.PutItemOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := t.keyOf(params.Item)
+	if err != nil {
+		return nil, err
+	}
+	a := newAttrs(params.ExpressionAttributeNames, params.ExpressionAttributeValues)
+	cond, err := a.condition(params.ConditionExpression)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	old := t.items[key]
+	if ok, err := check(cond, old); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, conditionFailed(
+			params.ReturnValuesOnConditionCheckFailure == types.ReturnValuesOnConditionCheckFailureAllOld, old,
+		)
+	}
+	t.write(key, old, copyItem(params.Item), c.now())
+
+	out := &dynamodb.PutItemOutput{}
+	if params.ReturnValues == types.ReturnValueAllOld {
+		out.Attributes = copyItem(old)
+	}
+	return out, nil
+}
+
+// UpdateItem implements the DynamoDB API.
+func (c *Client) UpdateItem(
+	ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.UpdateItemOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := t.key(params.Key)
+	if err != nil {
+		return nil, err
+	}
+	a := newAttrs(params.ExpressionAttributeNames, params.ExpressionAttributeValues)
+	cond, err := a.condition(params.ConditionExpression)
+	if err != nil {
+		return nil, err
+	}
+	u, err := a.update(params.UpdateExpression)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	old := t.items[key]
+	if ok, err := check(cond, old); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, conditionFailed(
+			params.ReturnValuesOnConditionCheckFailure == types.ReturnValuesOnConditionCheckFailureAllOld, old,
+		)
+	}
+	updated, err := t.applyUpdate(params.Key, old, u)
+	if err != nil {
+		return nil, err
+	}
+	t.write(key, old, updated, c.now())
+
+	out := &dynamodb.UpdateItemOutput{}
+	switch params.ReturnValues {
+	case types.ReturnValueAllOld:
+		out.Attributes = copyItem(old)
+	case types.ReturnValueAllNew:
+		out.Attributes = copyItem(updated)
+	}
+	return out, nil
+}
+
+func (t *table) applyUpdate(key, old item, u *update) (item, error) {
+	updated := copyItem(old)
+	if updated == nil {
+		updated = copyItem(key)
+	}
+	if err := u.apply(updated); err != nil {
+		return nil, err
+	}
+	if err := t.checkKeyUnchanged(key, updated); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// DeleteItem implements the DynamoDB API.
+func (c *Client) DeleteItem(
+	ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.DeleteItemOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := t.key(params.Key)
+	if err != nil {
+		return nil, err
+	}
+	a := newAttrs(params.ExpressionAttributeNames, params.ExpressionAttributeValues)
+	cond, err := a.condition(params.ConditionExpression)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	old, exists := t.items[key]
+	if ok, err := check(cond, old); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, conditionFailed(
+			params.ReturnValuesOnConditionCheckFailure == types.ReturnValuesOnConditionCheckFailureAllOld, old,
+		)
+	}
+	if exists {
+		t.write(key, old, nil, c.now())
+	}
+
+	out := &dynamodb.DeleteItemOutput{}
+	if params.ReturnValues == types.ReturnValueAllOld {
+		out.Attributes = copyItem(old)
+	}
+	return out, nil
+}
+
+type pendingWrite struct {
+	table *table
+	key   string
+	old   item
+	new   item
+	write bool
+}
+
+// TransactWriteItems implements the DynamoDB API.
+func (c *Client) TransactWriteItems(
+	ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.TransactWriteItemsOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if n := len(params.TransactItems); n == 0 || n > 100 {
+		return nil, validationErrorf(
+			"Member must have length less than or equal to 100 and greater than or equal to 1",
+		)
+	}
+
+	seen := map[string]bool{}
+	writes := make([]pendingWrite, len(params.TransactItems))
+	reasons := make([]types.CancellationReason, len(params.TransactItems))
+	failed := false
+	for i, op := range params.TransactItems {
+		w, ok, returnOld, err := c.prepare(op)
+		if err != nil {
+			return nil, err
+		}
+		id := aws.ToString(w.table.desc.TableName) + "\x00" + w.key
+		if seen[id] {
+			return nil, validationErrorf(
+				"Transaction request cannot include multiple operations on one item",
+			)
+		}
+		seen[id] = true
+		writes[i] = w
+		if ok {
+			reasons[i].Code = aws.String("None")
+			continue
+		}
+		failed = true
+		reasons[i].Code = aws.String("ConditionalCheckFailed")
+		reasons[i].Message = aws.String("The conditional request failed")
+		if returnOld {
+			reasons[i].Item = copyItem(w.old)
+		}
+	}
+	if failed {
+		codes := ""
+		for i, r := range reasons {
+			if i > 0 {
+				codes += ", "
+			}
+			codes += aws.ToString(r.Code)
+		}
+		return nil, &types.TransactionCanceledException{
+			Message: aws.String(
+				"Transaction cancelled, please refer cancellation reasons for specific reasons [" + codes + "]",
+			),
+			CancellationReasons: reasons,
+		}
+	}
+
+	now := c.now()
+	for _, w := range writes {
+		if w.write {
+			w.table.write(w.key, w.old, w.new, now)
+		}
+	}
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+func (c *Client) prepare(op types.TransactWriteItem) (w pendingWrite, ok, returnOld bool, err error) {
+	var (
+		tableName *string
+		key       item
+		condExpr  *string
+		names     map[string]string
+		values    map[string]types.AttributeValue
+		rv        types.ReturnValuesOnConditionCheckFailure
+		n         int
+	)
+	if op.ConditionCheck != nil {
+		n++
+		tableName, key, condExpr = op.ConditionCheck.TableName, op.ConditionCheck.Key, op.ConditionCheck.ConditionExpression
+		names, values = op.ConditionCheck.ExpressionAttributeNames, op.ConditionCheck.ExpressionAttributeValues
+		rv = op.ConditionCheck.ReturnValuesOnConditionCheckFailure
+		if condExpr == nil {
+			return w, false, false, validationErrorf("ConditionExpression is required")
+		}
+	}
+	if op.Delete != nil {
+		n++
+		tableName, key, condExpr = op.Delete.TableName, op.Delete.Key, op.Delete.ConditionExpression
+		names, values = op.Delete.ExpressionAttributeNames, op.Delete.ExpressionAttributeValues
+		rv = op.Delete.ReturnValuesOnConditionCheckFailure
+	}
+	if op.Put != nil {
+		n++
+		tableName, key, condExpr = op.Put.TableName, op.Put.Item, op.Put.ConditionExpression
+		names, values = op.Put.ExpressionAttributeNames, op.Put.ExpressionAttributeValues
+		rv = op.Put.ReturnValuesOnConditionCheckFailure
+	}
+	if op.Update != nil {
+		n++
+		tableName, key, condExpr = op.Update.TableName, op.Update.Key, op.Update.ConditionExpression
+		names, values = op.Update.ExpressionAttributeNames, op.Update.ExpressionAttributeValues
+		rv = op.Update.ReturnValuesOnConditionCheckFailure
+	}
+	if n != 1 {
+		return w, false, false, validationErrorf("TransactItems can only contain one of Check, Put, Update or Delete")
+	}
+	returnOld = rv == types.ReturnValuesOnConditionCheckFailureAllOld
+
+	t, err := c.table(tableName)
+	if err != nil {
+		return w, false, false, err
+	}
+	w.table = t
+	if op.Put != nil {
+		w.key, err = t.keyOf(key)
+	} else {
+		w.key, err = t.key(key)
+	}
+	if err != nil {
+		return w, false, false, err
+	}
+
+	a := newAttrs(names, values)
+	cond, err := a.condition(condExpr)
+	if err != nil {
+		return w, false, false, err
+	}
+	var u *update
+	if op.Update != nil {
+		if u, err = a.update(op.Update.UpdateExpression); err != nil {
+			return w, false, false, err
+		}
+	}
+	if err := a.checkUnused(); err != nil {
+		return w, false, false, err
+	}
+
+	w.old = t.items[w.key]
+	if ok, err = check(cond, w.old); err != nil || !ok {
+		return w, ok, returnOld, err
+	}
+	switch {
+	case op.Put != nil:
+		w.new, w.write = copyItem(op.Put.Item), true
+	case op.Update != nil:
+		if w.new, err = t.applyUpdate(key, w.old, u); err != nil {
+			return w, false, false, err
+		}
+		w.write = true
+	case op.Delete != nil:
+		w.write = w.old != nil
+	}
+	return w, true, returnOld, nil
+}
+
+type keyRange struct {
+	hash, rng string
+	index     string
+}
+
+func (t *table) schemaFor(index *string) (keyRange, error) {
+	if index == nil {
+		return keyRange{hash: t.hashKey, rng: t.rangeKey}, nil
+	}
+	for _, gsi := range t.desc.GlobalSecondaryIndexes {
+		if aws.ToString(gsi.IndexName) == *index {
+			h, r := keySchema(gsi.KeySchema)
+			return keyRange{hash: h, rng: r, index: *index}, nil
+		}
+	}
+	return keyRange{}, validationErrorf("The table does not have the specified index: %s", *index)
+}
+
+// sorted returns the items that contain every key attribute of the
+// schema, ordered by hash key then range key.
+func (t *table) sorted(kr keyRange) []item {
+	var result []item
+	for _, it := range t.items {
+		if _, ok := it[kr.hash]; !ok {
+			continue
+		}
+		if _, ok := it[kr.rng]; kr.rng != "" && !ok {
+			continue
+		}
+		result = append(result, it)
+	}
+	less := func(a, b item, attr string) (bool, bool) {
+		n, ok := compare(a[attr], b[attr])
+		if !ok || n == 0 {
+			return false, false
+		}
+		return n < 0, true
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		for _, attr := range []string{kr.hash, kr.rng, t.hashKey, t.rangeKey} {
+			if attr == "" {
+				continue
+			}
+			if lt, ok := less(a, b, attr); ok {
+				return lt
+			}
+		}
+		return false
+	})
+	return result
+}
+
+func (t *table) lastKey(kr keyRange, it item) item {
+	key := t.primaryKey(it)
+	for _, attr := range []string{kr.hash, kr.rng} {
+		if attr != "" {
+			key[attr] = copyValue(it[attr])
+		}
+	}
+	return key
+}
+
+func (t *table) startAfter(items []item, start item) ([]item, error) {
+	if start == nil {
+		return items, nil
+	}
+	key, err := t.keyOf(start)
+	if err != nil {
+		return nil, err
+	}
+	for i, it := range items {
+		if k, _ := t.keyOf(it); k == key {
+			return items[i+1:], nil
+		}
+	}
+	return nil, validationErrorf("The provided starting key is invalid")
+}
+
+type page struct {
+	items []item
+	count int32
+	last  item
+}
+
+func (t *table) paginate(
+	kr keyRange, items []item, limit *int32, filter condition, projection []path,
+) (page, error) {
+	var p page
+	for i, it := range items {
+		if limit != nil && int32(i) >= *limit {
+			p.last = t.lastKey(kr, items[i-1])
+			break
+		}
+		ok, err := check(filter, it)
+		if err != nil {
+			return p, err
+		}
+		if ok {
+			p.items = append(p.items, project(it, projection))
+			p.count++
+		}
+	}
+	return p, nil
+}
+
+// Query implements the DynamoDB API.
+func (c *Client) Query(
+	ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.QueryOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	kr, err := t.schemaFor(params.IndexName)
+	if err != nil {
+		return nil, err
+	}
+	if kr.index != "" && aws.ToBool(params.ConsistentRead) {
+		return nil, validationErrorf("Consistent reads are not supported on global secondary indexes")
+	}
+	if params.KeyConditionExpression == nil {
+		return nil, validationErrorf("KeyConditionExpression is required")
+	}
+	a := newAttrs(params.ExpressionAttributeNames, params.ExpressionAttributeValues)
+	keyCond, err := a.condition(params.KeyConditionExpression)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := a.condition(params.FilterExpression)
+	if err != nil {
+		return nil, err
+	}
+	projection, err := a.projection(params.ProjectionExpression)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	var matched []item
+	for _, it := range t.sorted(kr) {
+		ok, err := keyCond.eval(it)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, it)
+		}
+	}
+	if params.ScanIndexForward != nil && !*params.ScanIndexForward {
+		for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+			matched[i], matched[j] = matched[j], matched[i]
+		}
+	}
+	if matched, err = t.startAfter(matched, params.ExclusiveStartKey); err != nil {
+		return nil, err
+	}
+	p, err := t.paginate(kr, matched, params.Limit, filter, projection)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &dynamodb.QueryOutput{
+		Count:            p.count,
+		LastEvaluatedKey: p.last,
+	}
+	if params.Select != types.SelectCount {
+		out.Items = p.items
+	}
+	return out, nil
+}
+
+// Scan implements the DynamoDB API.
+func (c *Client) Scan(
+	ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.ScanOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	kr, err := t.schemaFor(params.IndexName)
+	if err != nil {
+		return nil, err
+	}
+	a := newAttrs(params.ExpressionAttributeNames, params.ExpressionAttributeValues)
+	filter, err := a.condition(params.FilterExpression)
+	if err != nil {
+		return nil, err
+	}
+	projection, err := a.projection(params.ProjectionExpression)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	items, err := t.startAfter(t.sorted(kr), params.ExclusiveStartKey)
+	if err != nil {
+		return nil, err
+	}
+	p, err := t.paginate(kr, items, params.Limit, filter, projection)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &dynamodb.ScanOutput{
+		Count:            p.count,
+		LastEvaluatedKey: p.last,
+	}
+	if params.Select != types.SelectCount {
+		out.Items = p.items
+	}
+	return out, nil
+}
+
+// ExpireItems deletes every item whose TTL attribute is before now, the
+// way DynamoDB's background TTL process eventually would.
+func (c *Client) ExpireItems(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := 0
+	for _, t := range c.tables {
+		if t.ttl == nil || t.ttl.TimeToLiveStatus != types.TimeToLiveStatusEnabled {
+			continue
+		}
+		attr := aws.ToString(t.ttl.AttributeName)
+		for key, it := range t.items {
+			n, ok := it[attr].(*types.AttributeValueMemberN)
+			if !ok {
+				continue
+			}
+			secs, err := strconv.ParseInt(n.Value, 10, 64)
+			if err != nil || !time.Unix(secs, 0).Before(now) {
+				continue
+			}
+			t.write(key, it, nil, now)
+			count++
+		}
+	}
+	return count
+}
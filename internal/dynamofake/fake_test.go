@@ -0,0 +1,126 @@
+package dynamofake_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sjansen/stopgap/internal/dynamofake"
+)
+
+func key(entity, revision string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"entity":   &types.AttributeValueMemberS{Value: entity},
+		"revision": &types.AttributeValueMemberN{Value: revision},
+	}
+}
+
+func TestClient(t *testing.T) {
+	require := require.New(t)
+	ctx := context.TODO()
+
+	c := dynamofake.New()
+	_, err := c.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName:   aws.String("test"),
+		BillingMode: types.BillingModePayPerRequest,
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("entity"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("revision"), KeyType: types.KeyTypeRange},
+		},
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("entity"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("revision"), AttributeType: types.ScalarAttributeTypeN},
+		},
+	})
+	require.NoError(err)
+
+	// GIVEN an item
+	item := key("mutex:conch", "0")
+	item["summary"] = &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+		"locked": &types.AttributeValueMemberBOOL{Value: false},
+	}}
+	_, err = c.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String("test"),
+		Item:      item,
+	})
+	require.NoError(err)
+
+	// WHEN a transaction includes a failed condition
+	_, err = c.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{{
+			Put: &types.Put{
+				TableName: aws.String("test"),
+				Item:      key("mutex:conch", "1"),
+			},
+		}, {
+			Update: &types.Update{
+				TableName:           aws.String("test"),
+				Key:                 key("mutex:conch", "0"),
+				ConditionExpression: aws.String("summary.locked = :locked"),
+				UpdateExpression:    aws.String("SET summary.locked = :locked"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":locked": &types.AttributeValueMemberBOOL{Value: true},
+				},
+			},
+		}},
+	})
+	// THEN the transaction should be canceled with reasons
+	var canceled *types.TransactionCanceledException
+	require.True(errors.As(err, &canceled))
+	require.Len(canceled.CancellationReasons, 2)
+	require.Equal("None", aws.ToString(canceled.CancellationReasons[0].Code))
+	require.Equal("ConditionalCheckFailed", aws.ToString(canceled.CancellationReasons[1].Code))
+	// AND nothing should be written
+	result, err := c.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String("test"),
+		KeyConditionExpression: aws.String("entity = :entity"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":entity": &types.AttributeValueMemberS{Value: "mutex:conch"},
+		},
+	})
+	require.NoError(err)
+	require.Len(result.Items, 1)
+
+	// WHEN an update sets and removes attributes
+	_, err = c.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String("test"),
+		Key:                 key("mutex:conch", "0"),
+		ConditionExpression: aws.String("attribute_exists(summary)"),
+		UpdateExpression: aws.String(
+			"SET version = if_not_exists(version, :zero) + :one REMOVE summary.locked",
+		),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":zero": &types.AttributeValueMemberN{Value: "0"},
+			":one":  &types.AttributeValueMemberN{Value: "1"},
+		},
+	})
+	require.NoError(err)
+	// THEN a projected read should see the changes
+	got, err := c.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:            aws.String("test"),
+		Key:                  key("mutex:conch", "0"),
+		ProjectionExpression: aws.String("version, summary"),
+	})
+	require.NoError(err)
+	require.Equal(map[string]types.AttributeValue{
+		"version": &types.AttributeValueMemberN{Value: "1"},
+		"summary": &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{}},
+	}, got.Item)
+
+	// WHEN an expression uses a reserved word
+	_, err = c.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String("test"),
+		Key:              key("mutex:conch", "0"),
+		UpdateExpression: aws.String("SET status = :status"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status": &types.AttributeValueMemberS{Value: "pending"},
+		},
+	})
+	// THEN it should be rejected, like it would be by DynamoDB
+	require.Error(err)
+}
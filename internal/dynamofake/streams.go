@@ -0,0 +1,254 @@
+package dynamofake
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	stypes "github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+)
+
+const shardID = "shardId-00000000000000000001"
+
+type stream struct {
+	arn      string
+	viewType types.StreamViewType
+	records  []stypes.Record
+	sequence int64
+}
+
+func (t *table) enableStream(spec *types.StreamSpecification, now time.Time) {
+	label := now.UTC().Format("2006-01-02T15:04:05.000")
+	t.stream = &stream{
+		arn:      aws.ToString(t.desc.TableArn) + "/stream/" + label,
+		viewType: spec.StreamViewType,
+	}
+	t.desc.StreamSpecification = &types.StreamSpecification{
+		StreamEnabled:  aws.Bool(true),
+		StreamViewType: spec.StreamViewType,
+	}
+	t.desc.LatestStreamArn = aws.String(t.stream.arn)
+	t.desc.LatestStreamLabel = aws.String(label)
+}
+
+func (s *stream) record(t *table, old, new item, now time.Time) {
+	var name stypes.OperationType
+	var keys item
+	switch {
+	case old == nil && new == nil:
+		return
+	case old == nil:
+		name, keys = stypes.OperationTypeInsert, t.primaryKey(new)
+	case new == nil:
+		name, keys = stypes.OperationTypeRemove, t.primaryKey(old)
+	default:
+		name, keys = stypes.OperationTypeModify, t.primaryKey(new)
+	}
+	s.sequence++
+	r := &stypes.StreamRecord{
+		ApproximateCreationDateTime: aws.Time(now),
+		Keys:                        toStreamMap(keys),
+		SequenceNumber:              aws.String(fmt.Sprintf("%021d", s.sequence)),
+		StreamViewType:              stypes.StreamViewType(s.viewType),
+	}
+	switch s.viewType {
+	case types.StreamViewTypeNewImage:
+		r.NewImage = toStreamMap(new)
+	case types.StreamViewTypeOldImage:
+		r.OldImage = toStreamMap(old)
+	case types.StreamViewTypeNewAndOldImages:
+		r.NewImage = toStreamMap(new)
+		r.OldImage = toStreamMap(old)
+	}
+	s.records = append(s.records, stypes.Record{
+		AwsRegion:   aws.String("us-west-2"),
+		Dynamodb:    r,
+		EventID:     aws.String(strconv.FormatInt(s.sequence, 10)),
+		EventName:   name,
+		EventSource: aws.String("aws:dynamodb"),
+	})
+}
+
+func toStreamMap(it item) map[string]stypes.AttributeValue {
+	if it == nil {
+		return nil
+	}
+	m := make(map[string]stypes.AttributeValue, len(it))
+	for k, v := range it {
+		m[k] = toStreamValue(v)
+	}
+	return m
+}
+
+func toStreamValue(v types.AttributeValue) stypes.AttributeValue {
+	switch v := v.(type) {
+	case *types.AttributeValueMemberS:
+		return &stypes.AttributeValueMemberS{Value: v.Value}
+	case *types.AttributeValueMemberN:
+		return &stypes.AttributeValueMemberN{Value: v.Value}
+	case *types.AttributeValueMemberB:
+		return &stypes.AttributeValueMemberB{Value: append([]byte(nil), v.Value...)}
+	case *types.AttributeValueMemberBOOL:
+		return &stypes.AttributeValueMemberBOOL{Value: v.Value}
+	case *types.AttributeValueMemberNULL:
+		return &stypes.AttributeValueMemberNULL{Value: v.Value}
+	case *types.AttributeValueMemberM:
+		return &stypes.AttributeValueMemberM{Value: toStreamMap(v.Value)}
+	case *types.AttributeValueMemberL:
+		l := make([]stypes.AttributeValue, len(v.Value))
+		for i, e := range v.Value {
+			l[i] = toStreamValue(e)
+		}
+		return &stypes.AttributeValueMemberL{Value: l}
+	case *types.AttributeValueMemberSS:
+		return &stypes.AttributeValueMemberSS{Value: append([]string(nil), v.Value...)}
+	case *types.AttributeValueMemberNS:
+		return &stypes.AttributeValueMemberNS{Value: append([]string(nil), v.Value...)}
+	case *types.AttributeValueMemberBS:
+		bs := make([][]byte, len(v.Value))
+		for i, b := range v.Value {
+			bs[i] = append([]byte(nil), b...)
+		}
+		return &stypes.AttributeValueMemberBS{Value: bs}
+	}
+	return nil
+}
+
+// Streams is a fake DynamoDB Streams client backed by a fake DynamoDB
+// client. Each stream has a single shard that never closes.
+type Streams struct {
+	client *Client
+}
+
+// Streams returns a fake DynamoDB Streams client for the fake's tables.
+func (c *Client) Streams() *Streams {
+	return c.streams
+}
+
+func (s *Streams) find(arn *string) (*table, *stream, error) {
+	for _, t := range s.client.tables {
+		if t.stream != nil && t.stream.arn == aws.ToString(arn) {
+			return t, t.stream, nil
+		}
+	}
+	return nil, nil, &stypes.ResourceNotFoundException{
+		Message: aws.String("Requested resource not found: Stream: " + aws.ToString(arn) + " not found"),
+	}
+}
+
+// DescribeStream implements the DynamoDB Streams API.
+func (s *Streams) DescribeStream(
+	ctx context.Context, params *dynamodbstreams.DescribeStreamInput, optFns ...func(*dynamodbstreams.Options),
+) (*dynamodbstreams.DescribeStreamOutput, error) {
+	s.client.mu.Lock()
+	defer s.client.mu.Unlock()
+
+	t, st, err := s.find(params.StreamArn)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodbstreams.DescribeStreamOutput{
+		StreamDescription: &stypes.StreamDescription{
+			StreamArn:      aws.String(st.arn),
+			StreamLabel:    t.desc.LatestStreamLabel,
+			StreamStatus:   stypes.StreamStatusEnabled,
+			StreamViewType: stypes.StreamViewType(st.viewType),
+			TableName:      t.desc.TableName,
+			Shards: []stypes.Shard{{
+				ShardId: aws.String(shardID),
+				SequenceNumberRange: &stypes.SequenceNumberRange{
+					StartingSequenceNumber: aws.String(fmt.Sprintf("%021d", 1)),
+				},
+			}},
+		},
+	}, nil
+}
+
+// GetShardIterator implements the DynamoDB Streams API.
+func (s *Streams) GetShardIterator(
+	ctx context.Context, params *dynamodbstreams.GetShardIteratorInput, optFns ...func(*dynamodbstreams.Options),
+) (*dynamodbstreams.GetShardIteratorOutput, error) {
+	s.client.mu.Lock()
+	defer s.client.mu.Unlock()
+
+	_, st, err := s.find(params.StreamArn)
+	if err != nil {
+		return nil, err
+	}
+	if aws.ToString(params.ShardId) != shardID {
+		return nil, &stypes.ResourceNotFoundException{
+			Message: aws.String("Requested resource not found: Shard does not exist"),
+		}
+	}
+
+	var pos int64
+	switch params.ShardIteratorType {
+	case stypes.ShardIteratorTypeTrimHorizon:
+		pos = 0
+	case stypes.ShardIteratorTypeLatest:
+		pos = st.sequence
+	case stypes.ShardIteratorTypeAtSequenceNumber, stypes.ShardIteratorTypeAfterSequenceNumber:
+		n, err := strconv.ParseInt(aws.ToString(params.SequenceNumber), 10, 64)
+		if err != nil || n < 1 || n > st.sequence {
+			return nil, validationErrorf("Invalid SequenceNumber")
+		}
+		pos = n - 1
+		if params.ShardIteratorType == stypes.ShardIteratorTypeAfterSequenceNumber {
+			pos = n
+		}
+	default:
+		return nil, validationErrorf("Invalid ShardIteratorType")
+	}
+	return &dynamodbstreams.GetShardIteratorOutput{
+		ShardIterator: aws.String(iterator(st, pos)),
+	}, nil
+}
+
+func iterator(st *stream, pos int64) string {
+	return st.arn + "|" + strconv.FormatInt(pos, 10)
+}
+
+// GetRecords implements the DynamoDB Streams API.
+func (s *Streams) GetRecords(
+	ctx context.Context, params *dynamodbstreams.GetRecordsInput, optFns ...func(*dynamodbstreams.Options),
+) (*dynamodbstreams.GetRecordsOutput, error) {
+	s.client.mu.Lock()
+	defer s.client.mu.Unlock()
+
+	it := aws.ToString(params.ShardIterator)
+	var arn string
+	var pos int64
+	for i := len(it) - 1; i >= 0; i-- {
+		if it[i] == '|' {
+			arn = it[:i]
+			n, err := strconv.ParseInt(it[i+1:], 10, 64)
+			if err != nil {
+				return nil, validationErrorf("Invalid ShardIterator")
+			}
+			pos = n
+			break
+		}
+	}
+	_, st, err := s.find(aws.String(arn))
+	if err != nil {
+		return nil, err
+	}
+
+	limit := int64(1000)
+	if params.Limit != nil {
+		limit = int64(*params.Limit)
+	}
+	end := pos + limit
+	if end > int64(len(st.records)) {
+		end = int64(len(st.records))
+	}
+	records := append([]stypes.Record(nil), st.records[pos:end]...)
+	return &dynamodbstreams.GetRecordsOutput{
+		Records:           records,
+		NextShardIterator: aws.String(iterator(st, end)),
+	}, nil
+}
@@ -0,0 +1,419 @@
+package dynamofake
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// CreateTable implements the DynamoDB API. Tables become active
+// immediately.
+func (c *Client) CreateTable(
+	ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.CreateTableOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := aws.ToString(params.TableName)
+	if name == "" {
+		return nil, validationErrorf("TableName is required")
+	}
+	if _, ok := c.tables[name]; ok {
+		return nil, &types.ResourceInUseException{
+			Message: aws.String("Table already exists: " + name),
+		}
+	}
+
+	now := c.now()
+	t := &table{
+		desc: types.TableDescription{
+			TableName:                 aws.String(name),
+			TableArn:                  aws.String(arnPrefix + name),
+			TableStatus:               types.TableStatusActive,
+			CreationDateTime:          aws.Time(now),
+			KeySchema:                 params.KeySchema,
+			AttributeDefinitions:      params.AttributeDefinitions,
+			DeletionProtectionEnabled: aws.Bool(aws.ToBool(params.DeletionProtectionEnabled)),
+		},
+		items: map[string]item{},
+		tags:  map[string]string{},
+	}
+	t.hashKey, t.rangeKey = keySchema(params.KeySchema)
+	if t.hashKey == "" {
+		return nil, validationErrorf("No Hash Key specified in schema")
+	}
+	for _, k := range []string{t.hashKey, t.rangeKey} {
+		if k != "" && t.attrType(k) == "" {
+			return nil, validationErrorf("Key attribute %s is missing from AttributeDefinitions", k)
+		}
+	}
+	setBilling(&t.desc, params.BillingMode, params.ProvisionedThroughput)
+	for _, gsi := range params.GlobalSecondaryIndexes {
+		t.desc.GlobalSecondaryIndexes = append(t.desc.GlobalSecondaryIndexes, describeIndex(gsi, params.BillingMode))
+	}
+	if params.SSESpecification != nil && aws.ToBool(params.SSESpecification.Enabled) {
+		t.desc.SSEDescription = describeSSE(params.SSESpecification)
+	}
+	if params.StreamSpecification != nil && aws.ToBool(params.StreamSpecification.StreamEnabled) {
+		t.enableStream(params.StreamSpecification, now)
+	}
+	for _, tag := range params.Tags {
+		t.tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	c.tables[name] = t
+
+	desc := t.describe()
+	return &dynamodb.CreateTableOutput{TableDescription: &desc}, nil
+}
+
+func setBilling(desc *types.TableDescription, mode types.BillingMode, pt *types.ProvisionedThroughput) {
+	if mode == "" {
+		mode = types.BillingModeProvisioned
+	}
+	desc.BillingModeSummary = &types.BillingModeSummary{BillingMode: mode}
+	desc.ProvisionedThroughput = &types.ProvisionedThroughputDescription{
+		ReadCapacityUnits:  aws.Int64(0),
+		WriteCapacityUnits: aws.Int64(0),
+	}
+	if mode == types.BillingModeProvisioned && pt != nil {
+		desc.ProvisionedThroughput.ReadCapacityUnits = aws.Int64(aws.ToInt64(pt.ReadCapacityUnits))
+		desc.ProvisionedThroughput.WriteCapacityUnits = aws.Int64(aws.ToInt64(pt.WriteCapacityUnits))
+	}
+}
+
+func describeIndex(gsi types.GlobalSecondaryIndex, mode types.BillingMode) types.GlobalSecondaryIndexDescription {
+	desc := types.GlobalSecondaryIndexDescription{
+		IndexName:   gsi.IndexName,
+		IndexArn:    aws.String("index/" + aws.ToString(gsi.IndexName)),
+		IndexStatus: types.IndexStatusActive,
+		KeySchema:   gsi.KeySchema,
+		Projection:  gsi.Projection,
+		ProvisionedThroughput: &types.ProvisionedThroughputDescription{
+			ReadCapacityUnits:  aws.Int64(0),
+			WriteCapacityUnits: aws.Int64(0),
+		},
+	}
+	if mode != types.BillingModePayPerRequest && gsi.ProvisionedThroughput != nil {
+		desc.ProvisionedThroughput.ReadCapacityUnits = aws.Int64(aws.ToInt64(gsi.ProvisionedThroughput.ReadCapacityUnits))
+		desc.ProvisionedThroughput.WriteCapacityUnits = aws.Int64(aws.ToInt64(gsi.ProvisionedThroughput.WriteCapacityUnits))
+	}
+	return desc
+}
+
+func describeSSE(spec *types.SSESpecification) *types.SSEDescription {
+	sse := &types.SSEDescription{
+		Status:  types.SSEStatusEnabled,
+		SSEType: spec.SSEType,
+	}
+	if sse.SSEType == "" {
+		sse.SSEType = types.SSETypeKms
+	}
+	if spec.KMSMasterKeyId != nil {
+		sse.KMSMasterKeyArn = spec.KMSMasterKeyId
+	}
+	return sse
+}
+
+func (t *table) describe() types.TableDescription {
+	desc := t.desc
+	desc.ItemCount = aws.Int64(int64(len(t.items)))
+	desc.GlobalSecondaryIndexes = append([]types.GlobalSecondaryIndexDescription(nil), desc.GlobalSecondaryIndexes...)
+	return desc
+}
+
+// DescribeTable implements the DynamoDB API.
+func (c *Client) DescribeTable(
+	ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.DescribeTableOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	desc := t.describe()
+	return &dynamodb.DescribeTableOutput{Table: &desc}, nil
+}
+
+// DeleteTable implements the DynamoDB API. Tables are removed
+// immediately.
+func (c *Client) DeleteTable(
+	ctx context.Context, params *dynamodb.DeleteTableInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.DeleteTableOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if aws.ToBool(t.desc.DeletionProtectionEnabled) {
+		return nil, validationErrorf(
+			"Resource cannot be deleted as it is currently protected against deletion",
+		)
+	}
+	delete(c.tables, aws.ToString(params.TableName))
+
+	desc := t.describe()
+	desc.TableStatus = types.TableStatusDeleting
+	return &dynamodb.DeleteTableOutput{TableDescription: &desc}, nil
+}
+
+// ListTables implements the DynamoDB API.
+func (c *Client) ListTables(
+	ctx context.Context, params *dynamodb.ListTablesInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.ListTablesOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := make([]string, 0, len(c.tables))
+	for name := range c.tables {
+		if params.ExclusiveStartTableName == nil || name > *params.ExclusiveStartTableName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return &dynamodb.ListTablesOutput{TableNames: names}, nil
+}
+
+// UpdateTable implements the DynamoDB API.
+func (c *Client) UpdateTable(
+	ctx context.Context, params *dynamodb.UpdateTableInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.UpdateTableOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range params.AttributeDefinitions {
+		if t.attrType(aws.ToString(d.AttributeName)) == "" {
+			t.desc.AttributeDefinitions = append(t.desc.AttributeDefinitions, d)
+		}
+	}
+	if params.BillingMode != "" || params.ProvisionedThroughput != nil {
+		mode := params.BillingMode
+		if mode == "" {
+			mode = t.desc.BillingModeSummary.BillingMode
+		}
+		setBilling(&t.desc, mode, params.ProvisionedThroughput)
+	}
+	if params.DeletionProtectionEnabled != nil {
+		t.desc.DeletionProtectionEnabled = aws.Bool(*params.DeletionProtectionEnabled)
+	}
+	if params.SSESpecification != nil {
+		if aws.ToBool(params.SSESpecification.Enabled) {
+			t.desc.SSEDescription = describeSSE(params.SSESpecification)
+		} else {
+			t.desc.SSEDescription = nil
+		}
+	}
+	if spec := params.StreamSpecification; spec != nil {
+		if aws.ToBool(spec.StreamEnabled) {
+			if t.stream != nil {
+				return nil, validationErrorf("Table already has an enabled stream")
+			}
+			t.enableStream(spec, c.now())
+		} else {
+			t.stream = nil
+			t.desc.StreamSpecification = nil
+		}
+	}
+	for _, u := range params.GlobalSecondaryIndexUpdates {
+		switch {
+		case u.Create != nil:
+			gsi := types.GlobalSecondaryIndex{
+				IndexName:             u.Create.IndexName,
+				KeySchema:             u.Create.KeySchema,
+				Projection:            u.Create.Projection,
+				ProvisionedThroughput: u.Create.ProvisionedThroughput,
+			}
+			t.desc.GlobalSecondaryIndexes = append(
+				t.desc.GlobalSecondaryIndexes,
+				describeIndex(gsi, t.desc.BillingModeSummary.BillingMode),
+			)
+		case u.Delete != nil:
+			var kept []types.GlobalSecondaryIndexDescription
+			for _, gsi := range t.desc.GlobalSecondaryIndexes {
+				if aws.ToString(gsi.IndexName) != aws.ToString(u.Delete.IndexName) {
+					kept = append(kept, gsi)
+				}
+			}
+			t.desc.GlobalSecondaryIndexes = kept
+		}
+	}
+
+	desc := t.describe()
+	return &dynamodb.UpdateTableOutput{TableDescription: &desc}, nil
+}
+
+// DescribeTimeToLive implements the DynamoDB API.
+func (c *Client) DescribeTimeToLive(
+	ctx context.Context, params *dynamodb.DescribeTimeToLiveInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.DescribeTimeToLiveOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	desc := &types.TimeToLiveDescription{TimeToLiveStatus: types.TimeToLiveStatusDisabled}
+	if t.ttl != nil {
+		copied := *t.ttl
+		desc = &copied
+	}
+	return &dynamodb.DescribeTimeToLiveOutput{TimeToLiveDescription: desc}, nil
+}
+
+// UpdateTimeToLive implements the DynamoDB API.
+func (c *Client) UpdateTimeToLive(
+	ctx context.Context, params *dynamodb.UpdateTimeToLiveInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.UpdateTimeToLiveOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	spec := params.TimeToLiveSpecification
+	if spec == nil {
+		return nil, validationErrorf("TimeToLiveSpecification is required")
+	}
+	enabled := aws.ToBool(spec.Enabled)
+	if current := t.ttl != nil && t.ttl.TimeToLiveStatus == types.TimeToLiveStatusEnabled; current == enabled {
+		return nil, validationErrorf("TimeToLive is already %s", map[bool]string{true: "enabled", false: "disabled"}[enabled])
+	}
+	status := types.TimeToLiveStatusDisabled
+	if enabled {
+		status = types.TimeToLiveStatusEnabled
+	}
+	t.ttl = &types.TimeToLiveDescription{
+		AttributeName:    aws.String(aws.ToString(spec.AttributeName)),
+		TimeToLiveStatus: status,
+	}
+	return &dynamodb.UpdateTimeToLiveOutput{TimeToLiveSpecification: spec}, nil
+}
+
+// DescribeContinuousBackups implements the DynamoDB API.
+func (c *Client) DescribeContinuousBackups(
+	ctx context.Context, params *dynamodb.DescribeContinuousBackupsInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.DescribeContinuousBackupsOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.DescribeContinuousBackupsOutput{
+		ContinuousBackupsDescription: t.backups(),
+	}, nil
+}
+
+// UpdateContinuousBackups implements the DynamoDB API.
+func (c *Client) UpdateContinuousBackups(
+	ctx context.Context, params *dynamodb.UpdateContinuousBackupsInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.UpdateContinuousBackupsOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if spec := params.PointInTimeRecoverySpecification; spec != nil {
+		t.pitr = aws.ToBool(spec.PointInTimeRecoveryEnabled)
+	}
+	return &dynamodb.UpdateContinuousBackupsOutput{
+		ContinuousBackupsDescription: t.backups(),
+	}, nil
+}
+
+func (t *table) backups() *types.ContinuousBackupsDescription {
+	status := types.PointInTimeRecoveryStatusDisabled
+	if t.pitr {
+		status = types.PointInTimeRecoveryStatusEnabled
+	}
+	return &types.ContinuousBackupsDescription{
+		ContinuousBackupsStatus: types.ContinuousBackupsStatusEnabled,
+		PointInTimeRecoveryDescription: &types.PointInTimeRecoveryDescription{
+			PointInTimeRecoveryStatus: status,
+		},
+	}
+}
+
+func (c *Client) tableByARN(arn *string) (*table, error) {
+	name := strings.TrimPrefix(aws.ToString(arn), arnPrefix)
+	t, ok := c.tables[name]
+	if !ok {
+		return nil, &types.ResourceNotFoundException{
+			Message: aws.String("Requested resource not found: ResourcArn: " + aws.ToString(arn)),
+		}
+	}
+	return t, nil
+}
+
+// TagResource implements the DynamoDB API.
+func (c *Client) TagResource(
+	ctx context.Context, params *dynamodb.TagResourceInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.TagResourceOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.tableByARN(params.ResourceArn)
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range params.Tags {
+		t.tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return &dynamodb.TagResourceOutput{}, nil
+}
+
+// UntagResource implements the DynamoDB API.
+func (c *Client) UntagResource(
+	ctx context.Context, params *dynamodb.UntagResourceInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.UntagResourceOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.tableByARN(params.ResourceArn)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range params.TagKeys {
+		delete(t.tags, key)
+	}
+	return &dynamodb.UntagResourceOutput{}, nil
+}
+
+// ListTagsOfResource implements the DynamoDB API.
+func (c *Client) ListTagsOfResource(
+	ctx context.Context, params *dynamodb.ListTagsOfResourceInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.ListTagsOfResourceOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, err := c.tableByARN(params.ResourceArn)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(t.tags))
+	for k := range t.tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := &dynamodb.ListTagsOfResourceOutput{}
+	for _, k := range keys {
+		out.Tags = append(out.Tags, types.Tag{Key: aws.String(k), Value: aws.String(t.tags[k])})
+	}
+	return out, nil
+}
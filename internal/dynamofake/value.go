@@ -0,0 +1,366 @@
+package dynamofake
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type item = map[string]types.AttributeValue
+
+type pathElem struct {
+	name    string
+	index   int
+	isIndex bool
+}
+
+type path []pathElem
+
+func (p path) String() string {
+	var buf bytes.Buffer
+	for i, e := range p {
+		switch {
+		case e.isIndex:
+			fmt.Fprintf(&buf, "[%d]", e.index)
+		case i > 0:
+			buf.WriteString("." + e.name)
+		default:
+			buf.WriteString(e.name)
+		}
+	}
+	return buf.String()
+}
+
+// overlaps reports whether one path is a prefix of the other.
+func (p path) overlaps(o path) bool {
+	n := len(p)
+	if len(o) < n {
+		n = len(o)
+	}
+	for i := 0; i < n; i++ {
+		if p[i] != o[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func copyItem(src item) item {
+	if src == nil {
+		return nil
+	}
+	dst := make(item, len(src))
+	for k, v := range src {
+		dst[k] = copyValue(v)
+	}
+	return dst
+}
+
+func copyValue(v types.AttributeValue) types.AttributeValue {
+	switch v := v.(type) {
+	case *types.AttributeValueMemberM:
+		return &types.AttributeValueMemberM{Value: copyItem(v.Value)}
+	case *types.AttributeValueMemberL:
+		l := make([]types.AttributeValue, len(v.Value))
+		for i, e := range v.Value {
+			l[i] = copyValue(e)
+		}
+		return &types.AttributeValueMemberL{Value: l}
+	case *types.AttributeValueMemberS:
+		return &types.AttributeValueMemberS{Value: v.Value}
+	case *types.AttributeValueMemberN:
+		return &types.AttributeValueMemberN{Value: v.Value}
+	case *types.AttributeValueMemberB:
+		return &types.AttributeValueMemberB{Value: append([]byte(nil), v.Value...)}
+	case *types.AttributeValueMemberBOOL:
+		return &types.AttributeValueMemberBOOL{Value: v.Value}
+	case *types.AttributeValueMemberNULL:
+		return &types.AttributeValueMemberNULL{Value: v.Value}
+	case *types.AttributeValueMemberSS:
+		return &types.AttributeValueMemberSS{Value: append([]string(nil), v.Value...)}
+	case *types.AttributeValueMemberNS:
+		return &types.AttributeValueMemberNS{Value: append([]string(nil), v.Value...)}
+	case *types.AttributeValueMemberBS:
+		bs := make([][]byte, len(v.Value))
+		for i, b := range v.Value {
+			bs[i] = append([]byte(nil), b...)
+		}
+		return &types.AttributeValueMemberBS{Value: bs}
+	}
+	return v
+}
+
+func typeOf(v types.AttributeValue) string {
+	switch v.(type) {
+	case *types.AttributeValueMemberS:
+		return "S"
+	case *types.AttributeValueMemberN:
+		return "N"
+	case *types.AttributeValueMemberB:
+		return "B"
+	case *types.AttributeValueMemberBOOL:
+		return "BOOL"
+	case *types.AttributeValueMemberNULL:
+		return "NULL"
+	case *types.AttributeValueMemberM:
+		return "M"
+	case *types.AttributeValueMemberL:
+		return "L"
+	case *types.AttributeValueMemberSS:
+		return "SS"
+	case *types.AttributeValueMemberNS:
+		return "NS"
+	case *types.AttributeValueMemberBS:
+		return "BS"
+	}
+	return ""
+}
+
+func parseNumber(s string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, validationErrorf("invalid number: %q", s)
+	}
+	return r, nil
+}
+
+func formatNumber(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	return r.FloatString(20)
+}
+
+// compare orders two scalar values of the same type.
+func compare(a, b types.AttributeValue) (int, bool) {
+	switch a := a.(type) {
+	case *types.AttributeValueMemberS:
+		if b, ok := b.(*types.AttributeValueMemberS); ok {
+			switch {
+			case a.Value < b.Value:
+				return -1, true
+			case a.Value > b.Value:
+				return 1, true
+			}
+			return 0, true
+		}
+	case *types.AttributeValueMemberN:
+		if b, ok := b.(*types.AttributeValueMemberN); ok {
+			x, err := parseNumber(a.Value)
+			if err != nil {
+				return 0, false
+			}
+			y, err := parseNumber(b.Value)
+			if err != nil {
+				return 0, false
+			}
+			return x.Cmp(y), true
+		}
+	case *types.AttributeValueMemberB:
+		if b, ok := b.(*types.AttributeValueMemberB); ok {
+			return bytes.Compare(a.Value, b.Value), true
+		}
+	}
+	return 0, false
+}
+
+func equal(a, b types.AttributeValue) bool {
+	if typeOf(a) != typeOf(b) {
+		return false
+	}
+	switch a := a.(type) {
+	case *types.AttributeValueMemberS, *types.AttributeValueMemberN, *types.AttributeValueMemberB:
+		c, ok := compare(a, b)
+		return ok && c == 0
+	case *types.AttributeValueMemberBOOL:
+		return a.Value == b.(*types.AttributeValueMemberBOOL).Value
+	case *types.AttributeValueMemberNULL:
+		return true
+	case *types.AttributeValueMemberM:
+		bm := b.(*types.AttributeValueMemberM).Value
+		if len(a.Value) != len(bm) {
+			return false
+		}
+		for k, v := range a.Value {
+			if w, ok := bm[k]; !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	case *types.AttributeValueMemberL:
+		bl := b.(*types.AttributeValueMemberL).Value
+		if len(a.Value) != len(bl) {
+			return false
+		}
+		for i := range a.Value {
+			if !equal(a.Value[i], bl[i]) {
+				return false
+			}
+		}
+		return true
+	case *types.AttributeValueMemberSS:
+		return equalStrings(a.Value, b.(*types.AttributeValueMemberSS).Value)
+	case *types.AttributeValueMemberNS:
+		return equalStrings(a.Value, b.(*types.AttributeValueMemberNS).Value)
+	}
+	return false
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	x := append([]string(nil), a...)
+	y := append([]string(nil), b...)
+	sort.Strings(x)
+	sort.Strings(y)
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func getPath(it item, p path) (types.AttributeValue, bool) {
+	var cur types.AttributeValue = &types.AttributeValueMemberM{Value: it}
+	for _, e := range p {
+		switch v := cur.(type) {
+		case *types.AttributeValueMemberM:
+			if e.isIndex {
+				return nil, false
+			}
+			next, ok := v.Value[e.name]
+			if !ok {
+				return nil, false
+			}
+			cur = next
+		case *types.AttributeValueMemberL:
+			if !e.isIndex || e.index >= len(v.Value) {
+				return nil, false
+			}
+			cur = v.Value[e.index]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func setPath(it item, p path, value types.AttributeValue) error {
+	parent, ok := getPath(it, p[:len(p)-1])
+	if !ok {
+		return validationErrorf(
+			"The document path provided in the update expression is invalid for update: %s", p,
+		)
+	}
+	last := p[len(p)-1]
+	switch v := parent.(type) {
+	case *types.AttributeValueMemberM:
+		if last.isIndex {
+			return validationErrorf("invalid list index on map: %s", p)
+		}
+		v.Value[last.name] = value
+	case *types.AttributeValueMemberL:
+		if !last.isIndex {
+			return validationErrorf("invalid map key on list: %s", p)
+		}
+		if last.index >= len(v.Value) {
+			v.Value = append(v.Value, value)
+		} else {
+			v.Value[last.index] = value
+		}
+	default:
+		return validationErrorf(
+			"The document path provided in the update expression is invalid for update: %s", p,
+		)
+	}
+	return nil
+}
+
+func removePath(it item, p path) {
+	parent, ok := getPath(it, p[:len(p)-1])
+	if !ok {
+		return
+	}
+	last := p[len(p)-1]
+	switch v := parent.(type) {
+	case *types.AttributeValueMemberM:
+		delete(v.Value, last.name)
+	case *types.AttributeValueMemberL:
+		if last.isIndex && last.index < len(v.Value) {
+			v.Value = append(v.Value[:last.index], v.Value[last.index+1:]...)
+		}
+	}
+}
+
+// removePaths removes paths in descending index order so that removing an
+// earlier list element doesn't shift the position of a later one.
+func removePaths(it item, paths []path) {
+	sorted := append([]path(nil), paths...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if len(a) == len(b) && a[:len(a)-1].overlaps(b[:len(b)-1]) {
+			x, y := a[len(a)-1], b[len(b)-1]
+			if x.isIndex && y.isIndex {
+				return x.index > y.index
+			}
+		}
+		return false
+	})
+	for _, p := range sorted {
+		removePath(it, p)
+	}
+}
+
+func project(it item, paths []path) item {
+	if paths == nil {
+		return copyItem(it)
+	}
+	result := item{}
+	for _, p := range paths {
+		v, ok := getPath(it, p)
+		if !ok {
+			continue
+		}
+		dst := result
+		for i, e := range p[:len(p)-1] {
+			if e.isIndex || p[i+1].isIndex {
+				break
+			}
+			next, ok := dst[e.name].(*types.AttributeValueMemberM)
+			if !ok {
+				next = &types.AttributeValueMemberM{Value: item{}}
+				dst[e.name] = next
+			}
+			dst = next.Value
+		}
+		if last := p[len(p)-1]; !last.isIndex {
+			dst[last.name] = copyValue(v)
+		}
+	}
+	return result
+}
+
+func size(v types.AttributeValue) (int, bool) {
+	switch v := v.(type) {
+	case *types.AttributeValueMemberS:
+		return len(v.Value), true
+	case *types.AttributeValueMemberB:
+		return len(v.Value), true
+	case *types.AttributeValueMemberM:
+		return len(v.Value), true
+	case *types.AttributeValueMemberL:
+		return len(v.Value), true
+	case *types.AttributeValueMemberSS:
+		return len(v.Value), true
+	case *types.AttributeValueMemberNS:
+		return len(v.Value), true
+	case *types.AttributeValueMemberBS:
+		return len(v.Value), true
+	}
+	return 0, false
+}
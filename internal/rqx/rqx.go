@@ -11,6 +11,9 @@ type RequestContext struct {
 	Client Client
 	EUser  User
 	RUser  User
+	// Tenant namespaces the data a request can see or change. Requests
+	// without a tenant use the default namespace.
+	Tenant string
 }
 
 type User struct {
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/pkg/errors"
+
+	"github.com/sjansen/stopgap/internal/rqx"
+)
+
+// batchGetLimit is the most keys DynamoDB accepts in one BatchGetItem call.
+const batchGetLimit = 100
+
+// Unprocessed keys are retried with exponential backoff, as recommended
+// by the DynamoDB documentation.
+const (
+	batchGetAttempts = 8
+	batchGetBackoff  = 50 * time.Millisecond
+)
+
+// GetMutexes returns the data for several mutexes at once, indexed by
+// name. Names that don't match a mutex are mapped to nil.
+func (s *DynamoStore) GetMutexes(rqx *rqx.RequestContext, names []string, consistent bool) (map[string]*Mutex, error) {
+	tenant, err := tenantOf(rqx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]*Mutex, len(names))
+	ids := make(map[string]string, len(names))
+	keys := make([]map[string]types.AttributeValue, 0, len(names))
+	for _, name := range names {
+		if _, ok := result[name]; ok {
+			continue
+		}
+		id := mutexEntityID(tenant, name)
+		result[name] = nil
+		ids[id] = name
+		keys = append(keys, map[string]types.AttributeValue{
+			"entity":   &types.AttributeValueMemberS{Value: id},
+			"revision": &types.AttributeValueMemberN{Value: "0"},
+		})
+	}
+
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > batchGetLimit {
+			n = batchGetLimit
+		}
+		items, err := s.batchGet(rqx.Ctx, keys[:n],
+			"entity, version, description, summary, locked_descendants, "+mutexMetadata, consistent,
+		)
+		if err != nil {
+			return nil, err
+		}
+		keys = keys[n:]
+
+		for _, item := range items {
+			m := &mutex{}
+			if err := attributevalue.UnmarshalMap(item, m); err != nil {
+				return nil, err
+			}
+			name, ok := ids[m.ID]
+			if !ok {
+				continue
+			}
+			result[name], err = s.exportMutex(m.ID, m)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+func (s *DynamoStore) batchGet(
+	ctx context.Context,
+	keys []map[string]types.AttributeValue,
+	projection string,
+	consistent bool,
+) ([]map[string]types.AttributeValue, error) {
+	input := &dynamodb.BatchGetItemInput{
+		RequestItems: map[string]types.KeysAndAttributes{
+			*s.table: {
+				ConsistentRead:       aws.Bool(consistent),
+				Keys:                 keys,
+				ProjectionExpression: aws.String(projection),
+			},
+		},
+	}
+
+	var items []map[string]types.AttributeValue
+	delay := batchGetBackoff
+	for i := 0; ; i++ {
+		result, err := s.svc.BatchGetItem(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, result.Responses[*s.table]...)
+
+		unprocessed, ok := result.UnprocessedKeys[*s.table]
+		if !ok || len(unprocessed.Keys) < 1 {
+			return items, nil
+		}
+		if i+1 >= batchGetAttempts {
+			return nil, errors.Errorf(
+				"unable to read %d items after %d attempts",
+				len(unprocessed.Keys), batchGetAttempts,
+			)
+		}
+		input.RequestItems = result.UnprocessedKeys
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
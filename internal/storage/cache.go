@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sjansen/stopgap/internal/rqx"
+)
+
+// MutexStore is implemented by DynamoStore, and by decorators that wrap it.
+type MutexStore interface {
+	CreateMutex(rqx *rqx.RequestContext, name, description string) error
+	UpdateMutex(rqx *rqx.RequestContext, name string, update *MutexUpdate) error
+	GetMutex(rqx *rqx.RequestContext, name string, consistent bool) (*Mutex, error)
+	GetMutexes(rqx *rqx.RequestContext, names []string, consistent bool) (map[string]*Mutex, error)
+	ResolveNames(rqx *rqx.RequestContext, name string) ([]string, error)
+	LockMutex(rqx *rqx.RequestContext, name, message string, mode LockMode) error
+	LockMutexes(rqx *rqx.RequestContext, names []string, message string) error
+	UnlockMutex(rqx *rqx.RequestContext, name string) error
+	TransferMutex(rqx *rqx.RequestContext, name, toUser, message string) error
+	UpdateLockMessage(rqx *rqx.RequestContext, name, message string) error
+	WaitForMutex(rqx *rqx.RequestContext, name, message string, mode LockMode, ttl time.Duration) (int, error)
+	LeaveQueue(rqx *rqx.RequestContext, name string) error
+	GetQueuePosition(rqx *rqx.RequestContext, name string) (int, error)
+	GetMutexHistory(rqx *rqx.RequestContext, name string, consistent bool) ([]*Event, error)
+}
+
+var _ MutexStore = &DynamoStore{}
+var _ MutexStore = &Cache{}
+
+// Cache serves eventually consistent reads of mutexes from memory for a
+// short time. Changes made through the cache invalidate it immediately,
+// along with the changed mutexes' ancestors, whose locked descendants may
+// have changed too. Changes made by other processes may not be seen until
+// the TTL expires. Consistent reads always bypass the cache, as do reads
+// of queues and history. Entries are kept separate for each tenant.
+type Cache struct {
+	Store MutexStore
+	TTL   time.Duration
+	// Now defaults to time.Now.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	gen     uint64
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	mutex   Mutex
+	expires time.Time
+}
+
+// NewCache wraps a store with a read-through cache.
+func NewCache(store MutexStore, ttl time.Duration) *Cache {
+	return &Cache{
+		Store: store,
+		TTL:   ttl,
+	}
+}
+
+// CreateMutex adds the named mutex.
+func (c *Cache) CreateMutex(rqx *rqx.RequestContext, name, description string) error {
+	defer c.invalidate(rqx, name)
+	return c.Store.CreateMutex(rqx, name, description)
+}
+
+// UpdateMutex changes the named mutex's metadata.
+func (c *Cache) UpdateMutex(rqx *rqx.RequestContext, name string, update *MutexUpdate) error {
+	defer c.invalidate(rqx, name)
+	return c.Store.UpdateMutex(rqx, name, update)
+}
+
+// GetMutex returns the data for a given mutex, from memory if possible.
+func (c *Cache) GetMutex(rqx *rqx.RequestContext, name string, consistent bool) (*Mutex, error) {
+	if consistent {
+		return c.Store.GetMutex(rqx, name, true)
+	}
+
+	cached, gen, now := c.lookup(rqx, []string{name})
+	if m, ok := cached[name]; ok {
+		return m, nil
+	}
+
+	m, err := c.Store.GetMutex(rqx, name, false)
+	if err != nil {
+		return nil, err
+	}
+	c.fill(rqx, map[string]*Mutex{name: m}, gen, now)
+	result := *m
+	return &result, nil
+}
+
+// GetMutexes returns the data for several mutexes at once, reading only
+// the ones that aren't in memory.
+func (c *Cache) GetMutexes(rqx *rqx.RequestContext, names []string, consistent bool) (map[string]*Mutex, error) {
+	if consistent {
+		return c.Store.GetMutexes(rqx, names, true)
+	}
+
+	result, gen, now := c.lookup(rqx, names)
+	var missing []string
+	for _, name := range names {
+		if _, ok := result[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) < 1 {
+		return result, nil
+	}
+
+	read, err := c.Store.GetMutexes(rqx, missing, false)
+	if err != nil {
+		return nil, err
+	}
+	c.fill(rqx, read, gen, now)
+	for name, m := range read {
+		if m != nil {
+			copied := *m
+			m = &copied
+		}
+		result[name] = m
+	}
+	return result, nil
+}
+
+// ResolveNames expands aliases and groups. Aliases and groups aren't
+// cached.
+func (c *Cache) ResolveNames(rqx *rqx.RequestContext, name string) ([]string, error) {
+	return c.Store.ResolveNames(rqx, name)
+}
+
+// LockMutex locks the named mutex.
+func (c *Cache) LockMutex(rqx *rqx.RequestContext, name, message string, mode LockMode) error {
+	defer c.invalidate(rqx, name)
+	return c.Store.LockMutex(rqx, name, message, mode)
+}
+
+// LockMutexes locks several mutexes at once.
+func (c *Cache) LockMutexes(rqx *rqx.RequestContext, names []string, message string) error {
+	defer c.invalidate(rqx, names...)
+	return c.Store.LockMutexes(rqx, names, message)
+}
+
+// UnlockMutex unlocks the named mutex.
+func (c *Cache) UnlockMutex(rqx *rqx.RequestContext, name string) error {
+	defer c.invalidate(rqx, name)
+	return c.Store.UnlockMutex(rqx, name)
+}
+
+// TransferMutex hands the requester's lock to another user.
+func (c *Cache) TransferMutex(rqx *rqx.RequestContext, name, toUser, message string) error {
+	defer c.invalidate(rqx, name)
+	return c.Store.TransferMutex(rqx, name, toUser, message)
+}
+
+// UpdateLockMessage replaces the requester's lock message.
+func (c *Cache) UpdateLockMessage(rqx *rqx.RequestContext, name, message string) error {
+	defer c.invalidate(rqx, name)
+	return c.Store.UpdateLockMessage(rqx, name, message)
+}
+
+// WaitForMutex joins the named mutex's wait queue, which may lock it.
+func (c *Cache) WaitForMutex(
+	rqx *rqx.RequestContext, name, message string, mode LockMode, ttl time.Duration,
+) (int, error) {
+	defer c.invalidate(rqx, name)
+	return c.Store.WaitForMutex(rqx, name, message, mode, ttl)
+}
+
+// LeaveQueue removes the requester from the named mutex's wait queue.
+func (c *Cache) LeaveQueue(rqx *rqx.RequestContext, name string) error {
+	defer c.invalidate(rqx, name)
+	return c.Store.LeaveQueue(rqx, name)
+}
+
+// GetQueuePosition returns the requester's place in the named mutex's
+// wait queue.
+func (c *Cache) GetQueuePosition(rqx *rqx.RequestContext, name string) (int, error) {
+	return c.Store.GetQueuePosition(rqx, name)
+}
+
+// GetMutexHistory returns the events recorded for the named mutex.
+func (c *Cache) GetMutexHistory(rqx *rqx.RequestContext, name string, consistent bool) ([]*Event, error) {
+	return c.Store.GetMutexHistory(rqx, name, consistent)
+}
+
+// lookup returns copies of the cached mutexes that haven't expired, along
+// with the generation and time needed to store the rest once read. Expired
+// entries are removed.
+func (c *Cache) lookup(rqx *rqx.RequestContext, names []string) (map[string]*Mutex, uint64, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	result := make(map[string]*Mutex, len(names))
+	for _, name := range names {
+		key := cacheKey(rqx, name)
+		e, ok := c.entries[key]
+		if !ok {
+			continue
+		} else if !now.Before(e.expires) {
+			delete(c.entries, key)
+			continue
+		}
+		result[name] = copyMutex(&e.mutex)
+	}
+	return result, c.gen, now
+}
+
+// fill caches mutexes that were read, unless the read raced with a local
+// change. Missing mutexes aren't cached.
+func (c *Cache) fill(rqx *rqx.RequestContext, mutexes map[string]*Mutex, gen uint64, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]cacheEntry)
+	}
+	for name, m := range mutexes {
+		if m != nil {
+			c.entries[cacheKey(rqx, name)] = cacheEntry{
+				mutex:   *copyMutex(m),
+				expires: now.Add(c.TTL),
+			}
+		}
+	}
+}
+
+// invalidate is called even when a change fails, since the failure may
+// mean the cached data is stale. Ancestors are invalidated too, since
+// they track which of their descendants are locked.
+func (c *Cache) invalidate(rqx *rqx.RequestContext, names ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, name := range names {
+		delete(c.entries, cacheKey(rqx, name))
+		for _, ancestor := range ancestorNames(name) {
+			delete(c.entries, cacheKey(rqx, ancestor))
+		}
+	}
+}
+
+// copyMutex copies a mutex deeply enough that callers can't change the
+// cached copy through its slices and maps.
+func copyMutex(m *Mutex) *Mutex {
+	result := *m
+	result.Labels = slices.Clone(m.Labels)
+	result.Links = maps.Clone(m.Links)
+	result.Holders = slices.Clone(m.Holders)
+	result.Queue = slices.Clone(m.Queue)
+	result.LockedDescendants = slices.Clone(m.LockedDescendants)
+	return &result
+}
+
+func cacheKey(rqx *rqx.RequestContext, name string) string {
+	return mutexEntityID(rqx.Tenant, name)
+}
+
+func (c *Cache) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
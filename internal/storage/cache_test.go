@@ -0,0 +1,230 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sjansen/stopgap/internal/rqx"
+	"github.com/sjansen/stopgap/internal/storage"
+)
+
+// countingStore counts reads. Methods it doesn't implement panic.
+type countingStore struct {
+	storage.MutexStore
+
+	reads   int
+	mutexes map[string]*storage.Mutex
+}
+
+func (s *countingStore) CreateMutex(rqx *rqx.RequestContext, name, description string) error {
+	s.mutexes[name] = &storage.Mutex{Version: 1, Description: description}
+	return nil
+}
+
+func (s *countingStore) GetMutex(rqx *rqx.RequestContext, name string, consistent bool) (*storage.Mutex, error) {
+	s.reads++
+	m, ok := s.mutexes[name]
+	if !ok {
+		return nil, storage.ErrMutexNotFound
+	}
+	result := *m
+	return &result, nil
+}
+
+func (s *countingStore) GetMutexes(rqx *rqx.RequestContext, names []string, consistent bool) (map[string]*storage.Mutex, error) {
+	result := make(map[string]*storage.Mutex, len(names))
+	for _, name := range names {
+		s.reads++
+		result[name] = nil
+		if m, ok := s.mutexes[name]; ok {
+			copied := *m
+			result[name] = &copied
+		}
+	}
+	return result, nil
+}
+
+func (s *countingStore) LockMutex(rqx *rqx.RequestContext, name, message string, mode storage.LockMode) error {
+	m := s.mutexes[name]
+	m.Version++
+	m.Locked = true
+	m.LockedBy = rqx.EUser.SlackID
+	m.Message = message
+	return nil
+}
+
+func (s *countingStore) LockMutexes(rqx *rqx.RequestContext, names []string, message string) error {
+	for _, name := range names {
+		if err := s.LockMutex(rqx, name, message, storage.LockExclusive); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *countingStore) UnlockMutex(rqx *rqx.RequestContext, name string) error {
+	m := s.mutexes[name]
+	m.Version++
+	m.Locked = false
+	m.LockedBy = ""
+	m.Message = ""
+	return nil
+}
+
+func (s *countingStore) TransferMutex(rqx *rqx.RequestContext, name, toUser, message string) error {
+	m := s.mutexes[name]
+	m.Version++
+	m.LockedBy = toUser
+	m.Message = message
+	return nil
+}
+
+func (s *countingStore) UpdateLockMessage(rqx *rqx.RequestContext, name, message string) error {
+	m := s.mutexes[name]
+	m.Version++
+	m.Message = message
+	return nil
+}
+
+func TestCache(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := &countingStore{mutexes: map[string]*storage.Mutex{}}
+	cache := storage.NewCache(store, 5*time.Second)
+	cache.Now = func() time.Time { return now }
+	rqx := &rqx.RequestContext{
+		Ctx:   context.TODO(),
+		EUser: rqx.User{SlackID: "UFoo42"},
+	}
+
+	// GIVEN a cached mutex
+	require.NoError(cache.CreateMutex(rqx, "triton", "staging and prod"))
+	m, err := cache.GetMutex(rqx, "triton", false)
+	require.NoError(err)
+	require.False(m.Locked)
+	require.Equal(1, store.reads)
+	// WHEN eventually consistent reads are repeated within the TTL
+	m.Locked = true
+	m, err = cache.GetMutex(rqx, "triton", false)
+	// THEN the store should only be read once
+	require.NoError(err)
+	require.False(m.Locked)
+	require.Equal(1, store.reads)
+
+	// WHEN a consistent read is made
+	_, err = cache.GetMutex(rqx, "triton", true)
+	// THEN the cache should be bypassed
+	require.NoError(err)
+	require.Equal(2, store.reads)
+
+	// WHEN the mutex is locked through the cache
+	require.NoError(cache.LockMutex(rqx, "triton", "deploying", storage.LockExclusive))
+	m, err = cache.GetMutex(rqx, "triton", false)
+	// THEN the change should be seen immediately
+	require.NoError(err)
+	require.True(m.Locked)
+	require.Equal("deploying", m.Message)
+	require.Equal(3, store.reads)
+
+	// WHEN the mutex is changed by someone else
+	store.mutexes["triton"].Locked = false
+	m, err = cache.GetMutex(rqx, "triton", false)
+	// THEN the change should be seen after the TTL expires
+	require.NoError(err)
+	require.True(m.Locked)
+	now = now.Add(5 * time.Second)
+	m, err = cache.GetMutex(rqx, "triton", false)
+	require.NoError(err)
+	require.False(m.Locked)
+	require.Equal(4, store.reads)
+
+	// WHEN a mutex doesn't exist
+	_, err = cache.GetMutex(rqx, "conch", false)
+	// THEN the error should be passed through
+	require.ErrorIs(err, storage.ErrMutexNotFound)
+}
+
+func TestCacheGetMutexes(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := &countingStore{mutexes: map[string]*storage.Mutex{}}
+	cache := storage.NewCache(store, 5*time.Second)
+	cache.Now = func() time.Time { return now }
+	rqx := &rqx.RequestContext{
+		Ctx:   context.TODO(),
+		EUser: rqx.User{SlackID: "UFoo42"},
+	}
+
+	// GIVEN a parent and child mutex, where only the parent is cached
+	for _, name := range []string{"prod", "prod/api"} {
+		require.NoError(cache.CreateMutex(rqx, name, ""))
+	}
+	_, err := cache.GetMutex(rqx, "prod", false)
+	require.NoError(err)
+	require.Equal(1, store.reads)
+
+	// WHEN both are read at once
+	mutexes, err := cache.GetMutexes(rqx, []string{"prod", "prod/api", "staging"}, false)
+	// THEN only the missing ones should be read from the store
+	require.NoError(err)
+	require.Equal(3, store.reads)
+	require.Len(mutexes, 3)
+	require.NotNil(mutexes["prod"])
+	require.NotNil(mutexes["prod/api"])
+	require.Nil(mutexes["staging"])
+	_, err = cache.GetMutexes(rqx, []string{"prod", "prod/api"}, false)
+	require.NoError(err)
+	require.Equal(3, store.reads)
+
+	// WHEN the child is locked through the cache
+	store.mutexes["prod"].LockedDescendants = []string{"prod/api"}
+	require.NoError(cache.LockMutexes(rqx, []string{"prod/api"}, "deploying"))
+	mutexes, err = cache.GetMutexes(rqx, []string{"prod", "prod/api"}, false)
+	// THEN the parent should be read again too
+	require.NoError(err)
+	require.Equal(5, store.reads)
+	require.True(mutexes["prod/api"].Locked)
+	require.Equal([]string{"prod/api"}, mutexes["prod"].LockedDescendants)
+}
+
+func TestCacheReturnsCopies(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := &countingStore{mutexes: map[string]*storage.Mutex{}}
+	cache := storage.NewCache(store, 5*time.Second)
+	cache.Now = func() time.Time { return now }
+	rqx := &rqx.RequestContext{
+		Ctx:   context.TODO(),
+		EUser: rqx.User{SlackID: "UFoo42"},
+	}
+
+	// GIVEN a cached mutex with labels, links and descendants
+	require.NoError(cache.CreateMutex(rqx, "prod", ""))
+	store.mutexes["prod"].Labels = []string{"team-a"}
+	store.mutexes["prod"].Links = map[string]string{"runbook": "https://example.com/runbook"}
+	store.mutexes["prod"].LockedDescendants = []string{"prod/api"}
+	m, err := cache.GetMutex(rqx, "prod", false)
+	require.NoError(err)
+
+	// WHEN the caller changes what it was given
+	m.Labels[0] = "team-b"
+	m.Links["runbook"] = "https://example.com/other"
+	m.LockedDescendants[0] = "prod/db"
+	mutexes, err := cache.GetMutexes(rqx, []string{"prod"}, false)
+	require.NoError(err)
+	mutexes["prod"].Labels[0] = "team-c"
+
+	// THEN the cached copy should be unchanged
+	m, err = cache.GetMutex(rqx, "prod", false)
+	require.NoError(err)
+	require.Equal(1, store.reads)
+	require.Equal([]string{"team-a"}, m.Labels)
+	require.Equal("https://example.com/runbook", m.Links["runbook"])
+	require.Equal([]string{"prod/api"}, m.LockedDescendants)
+}
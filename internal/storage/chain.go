@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/sjansen/stopgap/internal/rqx"
+)
+
+// ChainProblem describes why an event doesn't fit a mutex's hash chain.
+type ChainProblem string
+
+const (
+	// ChainGap means one or more revisions before the event are missing.
+	ChainGap ChainProblem = "gap"
+	// ChainReordered means the event isn't linked to the event before it.
+	ChainReordered ChainProblem = "reordered"
+	// ChainModified means the event no longer matches its hash.
+	ChainModified ChainProblem = "modified"
+	// ChainUnhashed means the event was recorded without a hash.
+	ChainUnhashed ChainProblem = "unhashed"
+)
+
+// ChainBreak identifies an event that doesn't fit a mutex's hash chain.
+type ChainBreak struct {
+	Revision int64
+	Problem  ChainProblem
+}
+
+// VerifyMutexHistory walks the history of the named mutex and checks that
+// every event is intact and linked to the event before it. Events expire,
+// so a history may no longer start at revision 1, but only if its oldest
+// remaining event records that the event before it has expired.
+func (s *DynamoStore) VerifyMutexHistory(rqx *rqx.RequestContext, name string) ([]ChainBreak, error) {
+	id, err := mutexID(rqx, name)
+	if err != nil {
+		return nil, err
+	}
+	item, err := s.getMutex(id, "version, chain, chain_expires", true)
+	if err != nil {
+		return nil, err
+	}
+	return s.verifyHistory(id, item.Version, item.Chain)
+}
+
+// verifyHistory checks an entity's events against its current version
+// and the hash of its latest event.
+func (s *DynamoStore) verifyHistory(id string, version int64, chain string) ([]ChainBreak, error) {
+	events, err := s.getHistory(id, true)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var breaks []ChainBreak
+	var prev *Event
+	for _, e := range events {
+		if problem, err := checkLink(id, prev, e, now); err != nil {
+			return nil, err
+		} else if problem != "" {
+			breaks = append(breaks, ChainBreak{
+				Revision: e.Revision,
+				Problem:  problem,
+			})
+		}
+		prev = e
+	}
+
+	// Events newer than the mutex were written after it was read.
+	switch {
+	case prev == nil || prev.Revision < version:
+		breaks = append(breaks, ChainBreak{
+			Revision: version,
+			Problem:  ChainGap,
+		})
+	case prev.Revision == version && prev.Hash != chain:
+		breaks = append(breaks, ChainBreak{
+			Revision: version,
+			Problem:  ChainModified,
+		})
+	}
+	return breaks, nil
+}
+
+func checkLink(id string, prev, e *Event, now time.Time) (ChainProblem, error) {
+	if e.Hash == "" {
+		return ChainUnhashed, nil
+	}
+	hash, err := hashEvent(id, e)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case hash != e.Hash:
+		return ChainModified, nil
+	case prev == nil && e.Revision == 1:
+		if e.PrevHash != "" {
+			return ChainReordered, nil
+		}
+	case prev == nil:
+		// Earlier events may only be missing once they've expired.
+		if e.PrevExpires.IsZero() || now.Before(e.PrevExpires) {
+			return ChainGap, nil
+		}
+	case e.Revision != prev.Revision+1:
+		return ChainGap, nil
+	case prev.Hash == "":
+		// the chain starts after the last unhashed event
+		if e.PrevHash != "" {
+			return ChainReordered, nil
+		}
+	case e.PrevHash != prev.Hash:
+		return ChainReordered, nil
+	}
+	return "", nil
+}
+
+// link is stored with an entity's state, so its next event can be chained
+// to its latest event.
+type link struct {
+	Chain string `dynamodbav:"chain"`
+	// ChainExpires is when the latest event expires.
+	ChainExpires time.Time `dynamodbav:"chain_expires,unixtime"`
+}
+
+// chainExpires is the value stored as the entity's chain_expires.
+func (e *event) chainExpires() types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(e.TTL.Unix(), 10)}
+}
+
+func (e *event) hash() (string, error) {
+	exported, err := e.export()
+	if err != nil {
+		return "", err
+	}
+	return hashEvent(e.ID, exported)
+}
+
+// hashEvent links an event to its predecessor by hashing the previous
+// event's hash together with the event's canonical encoding.
+func hashEvent(id string, e *Event) (string, error) {
+	encoded, err := canonicalEvent(id, e)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write([]byte(e.PrevHash))
+	h.Write([]byte{'\n'})
+	h.Write(encoded)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type canonicalClient struct {
+	Type       string `json:"type"`
+	RemoteAddr string `json:"remote_addr"`
+	UserAgent  string `json:"user_agent"`
+}
+
+type canonicalUser struct {
+	UID     string `json:"uid"`
+	Name    string `json:"name"`
+	SlackID string `json:"slack_id"`
+}
+
+// canonicalEvent encodes the parts of an event covered by its hash.
+// Fields added since hashing began are omitted when empty, so older
+// events keep their hashes.
+// Identifying details are included by salted digest rather than by value,
+// so they can be redacted later without breaking the chain. Timestamps are
+// truncated to seconds to match how they are stored.
+func canonicalEvent(id string, e *Event) ([]byte, error) {
+	data := e.Data
+	if data == nil {
+		data = map[string]string{}
+	}
+	var prevExpires int64
+	if !e.PrevExpires.IsZero() {
+		prevExpires = e.PrevExpires.Unix()
+	}
+	return json.Marshal(&struct {
+		Entity      string            `json:"entity"`
+		Revision    int64             `json:"revision"`
+		Created     int64             `json:"created"`
+		Type        string            `json:"type"`
+		Client      canonicalClient   `json:"client"`
+		EUser       canonicalUser     `json:"euser"`
+		RUser       canonicalUser     `json:"ruser"`
+		Data        map[string]string `json:"data"`
+		PrevExpires int64             `json:"prev_expires,omitempty"`
+	}{
+		Entity:   id,
+		Revision: e.Revision,
+		Created:  e.Created.Unix(),
+		Type:     e.Type,
+		Client: canonicalClient{
+			Type:       e.Client.Type,
+			RemoteAddr: e.digest(redactRemoteAddr, e.Client.RemoteAddr),
+			UserAgent:  e.digest(redactUserAgent, e.Client.UserAgent),
+		},
+		EUser: canonicalUser{
+			UID:     e.EUser.UID.String(),
+			Name:    e.digest(redactEUserName, e.EUser.Name),
+			SlackID: e.EUser.SlackID,
+		},
+		RUser: canonicalUser{
+			UID:     e.RUser.UID.String(),
+			Name:    e.digest(redactRUserName, e.RUser.Name),
+			SlackID: e.RUser.SlackID,
+		},
+		Data:        data,
+		PrevExpires: prevExpires,
+	})
+}
+
+// digest returns the digest of a field, using the digest recorded when the
+// field was redacted if its value is gone.
+func (e *Event) digest(field, value string) string {
+	if d, ok := e.Redacted[field]; ok && value == "" {
+		return d
+	}
+	return digest(e.Salts[field], value)
+}
+
+// digest returns an HMAC of value keyed by salt. Events recorded before
+// salts were added have unsalted digests, which are kept so their hashes
+// still match.
+func digest(salt, value string) string {
+	if salt == "" {
+		sum := sha256.Sum256([]byte(value))
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/pkg/errors"
+
+	"github.com/sjansen/stopgap/internal/rqx"
+)
+
+// MutexDrift describes a mutex whose stored summary doesn't match the
+// state derived by replaying its events.
+type MutexDrift struct {
+	Tenant  string
+	Name    string
+	Stored  *Mutex
+	Derived *Mutex
+	// Incomplete is true when events are missing from the start or middle
+	// of the mutex's history, usually because they expired, so its state
+	// can't be derived. Derived is nil, and the mutex is never repaired.
+	Incomplete bool
+	Repaired   bool
+}
+
+// maxCheckAttempts limits how many times a check is restarted because
+// the mutex changed while it was being read.
+const maxCheckAttempts = 3
+
+// CheckMutex replays the events of the named mutex in revision order and
+// compares the result with its stored summary and version. It returns nil
+// if they match. If the history doesn't start at the mutex's creation, the
+// drift is reported as incomplete instead. When repair is true, the stored
+// summary and version are overwritten with the derived state, unless the
+// mutex changed after it was checked or its history is incomplete.
+func (s *DynamoStore) CheckMutex(rqx *rqx.RequestContext, name string, repair bool) (*MutexDrift, error) {
+	id, err := mutexID(rqx, name)
+	if err != nil {
+		return nil, err
+	}
+	return s.checkMutex(id, repair)
+}
+
+func (s *DynamoStore) checkMutex(id string, repair bool) (*MutexDrift, error) {
+	for i := 0; i < maxCheckAttempts; i++ {
+		item, err := s.getMutex(id, "version, description, summary", true)
+		if err != nil {
+			return nil, err
+		}
+		stored, err := s.exportMutex(id, item)
+		if err != nil {
+			return nil, err
+		}
+		events, err := s.getHistory(id, true)
+		if err != nil {
+			return nil, err
+		}
+		tenant, name := entityName(id)
+		if !completeHistory(events) {
+			return &MutexDrift{
+				Tenant:     tenant,
+				Name:       name,
+				Stored:     stored,
+				Incomplete: true,
+			}, nil
+		}
+		derived, err := replayMutex(events)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to replay "+id)
+		}
+		if sameMutexState(stored, derived) {
+			return nil, nil
+		}
+
+		// The mutex may have changed between the two reads.
+		current, err := s.getMutex(id, "version", true)
+		if err != nil {
+			return nil, err
+		}
+		if current.Version != stored.Version {
+			continue
+		}
+
+		drift := &MutexDrift{
+			Tenant:  tenant,
+			Name:    name,
+			Stored:  stored,
+			Derived: derived,
+		}
+		if repair {
+			if drift.Repaired, err = s.repairMutex(id, stored.Version, derived); err != nil {
+				return nil, err
+			}
+		}
+		return drift, nil
+	}
+	return nil, errors.New("mutex changed too often to check: " + id)
+}
+
+// CheckMutexes runs CheckMutex against every mutex in the table, in
+// every tenant, and returns the mutexes that have drifted.
+func (s *DynamoStore) CheckMutexes(repair bool) ([]*MutexDrift, error) {
+	items, err := s.scanMutexes(nil, "entity")
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*MutexDrift
+	for _, item := range items {
+		drift, err := s.checkMutex(item.ID, repair)
+		if err != nil {
+			return nil, err
+		}
+		if drift != nil {
+			result = append(result, drift)
+		}
+	}
+	return result, nil
+}
+
+func (s *DynamoStore) repairMutex(id string, version int64, derived *Mutex) (bool, error) {
+	summary, err := s.encodeSummary(id, derived)
+	if err != nil {
+		return false, err
+	}
+
+	// TODO: thread ctx
+	_, err = s.svc.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: s.table,
+		Key: map[string]types.AttributeValue{
+			"entity":   &types.AttributeValueMemberS{Value: id},
+			"revision": &types.AttributeValueMemberN{Value: "0"},
+		},
+		ConditionExpression: aws.String("version = :expected"),
+		UpdateExpression: aws.String(`
+			SET summary = :summary,
+			    version = :version
+		`),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":expected": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(version, 10),
+			},
+			":summary": summary,
+			":version": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(derived.Version, 10),
+			},
+		},
+	})
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// completeHistory returns true if events is every revision of an entity,
+// starting with its creation. Replaying anything less would lose the state
+// recorded by the missing events.
+func completeHistory(events []*Event) bool {
+	if len(events) < 1 {
+		return false
+	}
+	for i, e := range events {
+		if e.Revision != int64(i+1) {
+			return false
+		}
+	}
+	return true
+}
+
+func replayMutex(events []*Event) (*Mutex, error) {
+	m := &Mutex{}
+	for _, e := range events {
+		switch e.Type {
+		case "mutex-created":
+			m.Description = e.Data["description"]
+			m.Locked = false
+			m.LockedBy = ""
+			m.Message = ""
+		case "mutex-locked":
+			m.Locked = true
+			if LockMode(e.Data["mode"]) == LockShared {
+				m.Mode = LockShared
+				m.Holders = append(m.Holders, Holder{
+					SlackID:  e.EUser.SlackID,
+					Message:  e.Data["message"],
+					Acquired: e.Created,
+				})
+				sortHolders(m.Holders)
+			} else {
+				m.Mode = LockExclusive
+				m.LockedBy = e.EUser.SlackID
+				m.Message = e.Data["message"]
+			}
+		case "mutex-unlocked":
+			if LockMode(e.Data["mode"]) == LockShared {
+				m.Holders, _ = removeHolder(m.Holders, e.EUser.SlackID)
+				if len(m.Holders) > 0 {
+					break
+				}
+			}
+			m.Locked = false
+			m.LockedBy = ""
+			m.Message = ""
+			m.Mode = ""
+			m.Holders = nil
+			m.Queue = nil
+		case "mutex-queue-joined":
+			expires, err := strconv.ParseInt(e.Data["expires"], 10, 64)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid queue expiration")
+			}
+			m.Queue = append(removeWaiter(m.Queue, e.EUser.SlackID), Waiter{
+				SlackID:  e.EUser.SlackID,
+				Message:  e.Data["message"],
+				Mode:     LockMode(e.Data["mode"]),
+				Enqueued: e.Created,
+				Expires:  time.Unix(expires, 0),
+			})
+		case "mutex-queue-left":
+			m.Queue = removeWaiter(m.Queue, e.EUser.SlackID)
+		case "mutex-handed-off":
+			next := &Waiter{
+				SlackID: e.Data["locked_by"],
+				Message: e.Data["message"],
+				Mode:    LockMode(e.Data["mode"]),
+			}
+			giveLock(m, next, e.Created)
+			for i, w := range m.Queue {
+				if w.SlackID == next.SlackID {
+					m.Queue = m.Queue[i+1:]
+					break
+				}
+			}
+		case "mutex-updated":
+			if err := applyMutexUpdate(m, e.Data); err != nil {
+				return nil, err
+			}
+		case "mutex-message-updated":
+			setLockMessage(m, e.EUser.SlackID, e.Data["message"])
+		case "mutex-transferred":
+			m.LockedBy = e.Data["to"]
+			m.Message = e.Data["message"]
+			m.Queue = removeWaiter(m.Queue, e.Data["to"])
+		default:
+			return nil, errors.New("unrecognized event type: " + e.Type)
+		}
+		m.Version = e.Revision
+	}
+	return m, nil
+}
+
+func sameMutexState(stored, derived *Mutex) bool {
+	return stored.Version == derived.Version &&
+		stored.Locked == derived.Locked &&
+		stored.LockedBy == derived.LockedBy &&
+		stored.Message == derived.Message &&
+		stored.Mode == derived.Mode &&
+		sameHolders(stored.Holders, derived.Holders) &&
+		sameQueue(stored.Queue, derived.Queue)
+}
+
+func sameHolders(stored, derived []Holder) bool {
+	if len(stored) != len(derived) {
+		return false
+	}
+	for i := range stored {
+		if stored[i].SlackID != derived[i].SlackID ||
+			stored[i].Message != derived[i].Message {
+			return false
+		}
+	}
+	return true
+}
+
+func sameQueue(stored, derived []Waiter) bool {
+	if len(stored) != len(derived) {
+		return false
+	}
+	for i := range stored {
+		if stored[i].SlackID != derived[i].SlackID ||
+			stored[i].Message != derived[i].Message ||
+			stored[i].Mode != derived[i].Mode ||
+			!stored[i].Expires.Equal(derived[i].Expires) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrUnknownKey is returned when a value was encrypted with a key that
+// isn't in the keyring.
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// ErrInvalidCiphertext is returned when an encrypted value is malformed or
+// has been tampered with.
+var ErrInvalidCiphertext = errors.New("invalid ciphertext")
+
+// Values starting with reservedPrefix are never stored as is. Encrypted
+// values start with encryptedPrefix, and plaintext that happens to start
+// with reservedPrefix is escaped by adding escapedPrefix.
+const (
+	reservedPrefix  = "enc:"
+	encryptedPrefix = "enc:v1:"
+	escapedPrefix   = "enc:raw:"
+)
+
+// Keyring holds the keys used to encrypt sensitive fields. New values are
+// encrypted using the primary key. Other keys are only used to decrypt,
+// so that existing values remain readable after the primary is rotated.
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// NewKeyring creates a keyring from 256-bit keys indexed by key ID.
+func NewKeyring(primary string, keys map[string][]byte) (*Keyring, error) {
+	k := &Keyring{
+		primary: primary,
+		keys:    make(map[string]cipher.AEAD, len(keys)),
+	}
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, errors.New("invalid key ID: " + strconv.Quote(id))
+		}
+		if len(key) != 32 {
+			return nil, errors.New("key must be 32 bytes: " + id)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[id] = aead
+	}
+	if _, ok := k.keys[primary]; !ok {
+		return nil, errors.New("primary key not found: " + primary)
+	}
+	return k, nil
+}
+
+// WithKeyring enables client-side encryption of mutex descriptions, lock
+// messages and event data.
+func (s *DynamoStore) WithKeyring(k *Keyring) *DynamoStore {
+	s.keys = k
+	return s
+}
+
+// encrypt seals plaintext using a random data key, which is in turn
+// sealed using the primary key. The context binds the ciphertext to the
+// attribute it's stored in. Without a keyring, or when there's nothing to
+// hide, plaintext is returned unchanged unless it needs to be escaped.
+func (k *Keyring) encrypt(context, plaintext string) (string, error) {
+	if k == nil || plaintext == "" {
+		if strings.HasPrefix(plaintext, reservedPrefix) {
+			return escapedPrefix + plaintext, nil
+		}
+		return plaintext, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", errors.Wrap(err, "unable to generate data key")
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(aead, []byte(plaintext), []byte(context))
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := seal(k.keys[k.primary], dataKey, []byte(k.primary+":"+context))
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedPrefix + k.primary +
+		":" + base64.RawStdEncoding.EncodeToString(wrapped) +
+		":" + base64.RawStdEncoding.EncodeToString(ciphertext), nil
+}
+
+// decrypt reverses encrypt. Values that were stored before encryption was
+// enabled are returned unchanged.
+func (k *Keyring) decrypt(context, value string) (string, error) {
+	if strings.HasPrefix(value, escapedPrefix) {
+		return strings.TrimPrefix(value, escapedPrefix), nil
+	} else if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", ErrInvalidCiphertext
+	}
+	var master cipher.AEAD
+	if k != nil {
+		master = k.keys[parts[0]]
+	}
+	if master == nil {
+		return "", errors.Wrap(ErrUnknownKey, parts[0])
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrInvalidCiphertext
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrInvalidCiphertext
+	}
+
+	dataKey, err := open(master, wrapped, []byte(parts[0]+":"+context))
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(aead, ciphertext, []byte(context))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func (k *Keyring) encryptData(context string, data map[string]string) (map[string]string, error) {
+	result := make(map[string]string, len(data))
+	for key, value := range data {
+		v, err := k.encrypt(context+"/"+key, value)
+		if err != nil {
+			return nil, err
+		}
+		result[key] = v
+	}
+	return result, nil
+}
+
+func (k *Keyring) decryptData(context string, data map[string]string) (map[string]string, error) {
+	result := make(map[string]string, len(data))
+	for key, value := range data {
+		v, err := k.decrypt(context+"/"+key, value)
+		if err != nil {
+			return nil, err
+		}
+		result[key] = v
+	}
+	return result, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext, context []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "unable to generate nonce")
+	}
+	return aead.Seal(nonce, nonce, plaintext, context), nil
+}
+
+func open(aead cipher.AEAD, ciphertext, context []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, ErrInvalidCiphertext
+	}
+	n := aead.NonceSize()
+	plaintext, err := aead.Open(nil, ciphertext[:n], ciphertext[n:], context)
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	return plaintext, nil
+}
+
+func descriptionContext(id string) string {
+	return id + "/description"
+}
+
+func messageContext(id string) string {
+	return id + "/summary/message"
+}
+
+func waitingContext(id string) string {
+	return id + "/summary/waiting"
+}
+
+func holderContext(id string) string {
+	return id + "/summary/holders"
+}
+
+func reservationContext(id string) string {
+	return id + "/summary/reservations"
+}
+
+func eventContext(id string, revision int64) string {
+	return id + "/" + strconv.FormatInt(revision, 10) + "/data"
+}
@@ -4,7 +4,7 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
-	"strconv"
+	"sort"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -26,253 +26,341 @@ var ErrDeleteInProgress = errors.New("table deletion in progress")
 // ErrCreateTimedOut is returned when table creation takes too long.
 var ErrCreateTimedOut = errors.New("timed out waiting for table creation")
 
+// ErrMutexNotFound is returned when the named mutex doesn't exist.
+var ErrMutexNotFound = errors.New("mutex not found")
+
+// ErrAlreadyLocked is returned when locking a mutex that is locked.
+var ErrAlreadyLocked = errors.New("mutex already locked")
+
+// ErrNotLocked is returned when unlocking a mutex that isn't locked.
+var ErrNotLocked = errors.New("mutex not locked")
+
+// ErrMutexNotHeld is returned when unlocking, transferring or updating the
+// lock on a mutex that the requester doesn't hold.
+var ErrMutexNotHeld = errors.New("mutex not held")
+
 // DynamoStore stores mutex data in DynamoDB.
 type DynamoStore struct {
-	svc   *dynamodb.Client
-	table *string
+	svc    DynamoDBAPI
+	table  *string
+	keys   *Keyring
+	outbox bool
 }
 
 // Mutex can be used to coordinate access to shared resources.
 type Mutex struct {
+	Name        string
 	Version     int64
 	Description string
-	Locked      bool
-	LockedBy    string
-	Message     string
+	OwnerTeam   string
+	// Labels are sorted.
+	Labels []string
+	// Links are indexed by name, like "runbook" or "dashboard".
+	Links    map[string]string
+	Locked   bool
+	LockedBy string
+	Message  string
+	// Mode is empty when the mutex is unlocked.
+	Mode LockMode
+	// Holders share the lock when it is held in shared mode.
+	Holders []Holder
+	// Queue may include waiters whose entries have expired.
+	Queue []Waiter
+	// LockedDescendants are the names of locked mutexes underneath this
+	// one, which keep it from being locked.
+	LockedDescendants []string
 }
 
 // New creates a DynamoStore instance using default values.
-func New(svc *dynamodb.Client) *DynamoStore {
+func New(svc DynamoDBAPI) *DynamoStore {
 	return NewWithTableName(svc, DefaultTableName)
 }
 
 // NewWithTableName create a DynamoStore instance, overriding the default
 // table name.
-func NewWithTableName(svc *dynamodb.Client, table string) *DynamoStore {
+func NewWithTableName(svc DynamoDBAPI, table string) *DynamoStore {
 	return &DynamoStore{
 		svc:   svc,
 		table: aws.String(table),
 	}
 }
 
-func mutexEntityID(name string) string {
-	return "mutex:" + name
+// TableName returns the name of the table used to store data.
+func (s *DynamoStore) TableName() string {
+	return *s.table
 }
 
 // CreateMutex adds the named mutex.
 func (s *DynamoStore) CreateMutex(rqx *rqx.RequestContext, name, description string) error {
-	id := mutexEntityID(name)
-
-	t := &writeTransaction{}
-	err := t.addPut(&types.Put{
-		Item: map[string]types.AttributeValue{
-			"entity":      &types.AttributeValueMemberS{Value: id},
-			"revision":    &types.AttributeValueMemberN{Value: "0"},
-			"entity_type": &types.AttributeValueMemberS{Value: "mutex"},
-			"version":     &types.AttributeValueMemberN{Value: "1"},
-			"description": &types.AttributeValueMemberS{Value: description},
-			"summary": &types.AttributeValueMemberM{
-				Value: map[string]types.AttributeValue{
-					"locked": &types.AttributeValueMemberBOOL{Value: false},
-				},
-			},
-		},
-		TableName:           s.table,
-		ConditionExpression: aws.String("attribute_not_exists(entity)"),
-	}).addEvent(rqx, s.table, id, 1,
-		"mutex-created",
-		map[string]string{
-			"description": description,
-		},
-	)
+	if err := validName(name); err != nil {
+		return err
+	}
+	tenant, err := tenantOf(rqx)
 	if err != nil {
 		return err
 	}
-
-	return t.exec(s.svc)
-}
-
-// GetMutex returns the data for a given mutex from the DynamoStore instance.
-func (s *DynamoStore) GetMutex(name string, consistent bool) (*Mutex, error) {
-	id := mutexEntityID(name)
-	item, err := s.getMutex(id, "version, summary", consistent)
+	id := mutexEntityID(tenant, name)
+	encrypted, err := s.keys.encrypt(descriptionContext(id), description)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	m := &Mutex{
-		Version:  item.Version,
-		Locked:   item.Summary.Locked,
-		LockedBy: item.Summary.LockedBy,
-		Message:  item.Summary.Message,
+	for i := 0; i < maxUpdateAttempts; i++ {
+		pending, err := s.getDescendants(tenant, name)
+		if err != nil {
+			return err
+		}
+		err = s.createMutex(rqx, tenant, name, encrypted, description, pending)
+		if !conditionFailed(err, 2) {
+			return err
+		}
+		// a descendant was locked or unlocked after the placeholder was read
 	}
-	return m, nil
+	return errors.New("descendants changed too often to create: " + id)
 }
 
-// LockMutex locks the named mutex.
-func (s *DynamoStore) LockMutex(rqx *rqx.RequestContext, name, message string) error {
-	id := mutexEntityID(name)
-	item, err := s.getMutex(id, "version", true)
+// createMutex puts a new mutex, taking over the locked descendants held
+// by its placeholder.
+func (s *DynamoStore) createMutex(
+	rqx *rqx.RequestContext, tenant, name, encrypted, description string, pending *descendants,
+) error {
+	id := mutexEntityID(tenant, name)
+	event, err := s.newEvent(rqx, id, 1, link{},
+		"mutex-created",
+		map[string]string{
+			"description": description,
+		},
+	)
 	if err != nil {
 		return err
 	}
 
-	t := &writeTransaction{}
-	version := item.Version + 1
-	err = t.addUpdate(&types.Update{
-		TableName: s.table,
-		Key: map[string]types.AttributeValue{
-			"entity":   &types.AttributeValueMemberS{Value: id},
-			"revision": &types.AttributeValueMemberN{Value: "0"},
-		},
-		ConditionExpression: aws.String(
-			"summary.locked <> :locked",
-		),
-		UpdateExpression: aws.String(`
-			SET summary.locked = :locked,
-			    summary.locked_by = :locked_by,
-			    summary.message = :message,
-			    version = :version
-		`),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":locked":    &types.AttributeValueMemberBOOL{Value: true},
-			":locked_by": &types.AttributeValueMemberS{Value: rqx.EUser.SlackID},
-			":message":   &types.AttributeValueMemberS{Value: message},
-			":version": &types.AttributeValueMemberN{
-				Value: strconv.FormatInt(version, 10),
+	item := map[string]types.AttributeValue{
+		"entity":        &types.AttributeValueMemberS{Value: id},
+		"revision":      &types.AttributeValueMemberN{Value: "0"},
+		"entity_type":   &types.AttributeValueMemberS{Value: "mutex"},
+		"version":       &types.AttributeValueMemberN{Value: "1"},
+		"chain":         &types.AttributeValueMemberS{Value: event.Hash},
+		"chain_expires": event.chainExpires(),
+		"description":   &types.AttributeValueMemberS{Value: encrypted},
+		"summary": &types.AttributeValueMemberM{
+			Value: map[string]types.AttributeValue{
+				"locked": &types.AttributeValueMemberBOOL{Value: false},
 			},
 		},
-	}).addEvent(rqx, s.table, id, version,
-		"mutex-locked",
-		map[string]string{
-			"message": message,
-		},
-	)
+	}
+	if tenant != "" {
+		item["tenant"] = &types.AttributeValueMemberS{Value: tenant}
+	}
+	if len(pending.LockedDescendants) > 0 {
+		item["locked_descendants"] = &types.AttributeValueMemberSS{Value: pending.LockedDescendants}
+	}
+
+	t := s.newTransaction()
+	err = t.addPut(&types.Put{
+		Item:                item,
+		TableName:           s.table,
+		ConditionExpression: aws.String("attribute_not_exists(entity)"),
+	}).addEvent(s.table, event)
 	if err != nil {
 		return err
 	}
+	t.add(pending.takeOver(s.table))
 
-	return t.exec(s.svc)
+	return t.execChecked(s.svc, s.nameChecks(tenant, "mutex", name))
 }
 
-// UnlockMutex unlocks the named mutex.
-func (s *DynamoStore) UnlockMutex(rqx *rqx.RequestContext, name string) error {
-	id := mutexEntityID(name)
-	item, err := s.getMutex(id, "version", true)
+// GetMutex returns the data for a given mutex from the DynamoStore instance.
+func (s *DynamoStore) GetMutex(rqx *rqx.RequestContext, name string, consistent bool) (*Mutex, error) {
+	id, err := mutexID(rqx, name)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	t := &writeTransaction{}
-	version := item.Version + 1
-	err = t.addUpdate(&types.Update{
-		TableName: s.table,
-		Key: map[string]types.AttributeValue{
-			"entity":   &types.AttributeValueMemberS{Value: id},
-			"revision": &types.AttributeValueMemberN{Value: "0"},
-		},
-		ConditionExpression: aws.String(
-			"summary.locked <> :locked",
-		),
-		UpdateExpression: aws.String(`
-			SET summary.locked = :locked,
-			    version = :version
-			REMOVE summary.locked_by,
-			       summary.message
-		`),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":locked": &types.AttributeValueMemberBOOL{Value: false},
-			":version": &types.AttributeValueMemberN{
-				Value: strconv.FormatInt(version, 10),
-			},
-		},
-	}).addEvent(rqx, s.table, id, version,
-		"mutex-unlocked",
-		map[string]string{},
-	)
+	item, err := s.getMutex(id, "version, description, summary, locked_descendants, "+mutexMetadata, consistent)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return t.exec(s.svc)
+	return s.exportMutex(id, item)
 }
 
-// CreateTable creates the DynamoStore table, if it doesn't already exist.
-// This is only intended as a convenience function to make development and
-// testing easier. It is not intended for use in production.
-func (s *DynamoStore) CreateTable() error {
-	if ok, err := s.checkForTable(); err != nil {
+// LockMutex locks the named mutex, in exclusive mode unless another mode
+// is given.
+func (s *DynamoStore) LockMutex(rqx *rqx.RequestContext, name, message string, mode LockMode) error {
+	mode, err := mode.validate()
+	if err != nil {
 		return err
-	} else if ok {
-		return nil
 	}
-	if err := s.createTable(); err != nil {
+	id, err := mutexID(rqx, name)
+	if err != nil {
 		return err
 	}
-	if err := s.waitForTable(); err != nil {
+
+	slackID := rqx.EUser.SlackID
+	for i := 0; i < maxUpdateAttempts; i++ {
+		item, m, err := s.readMutex(id)
+		if err != nil {
+			return err
+		}
+		if m.Locked && (mode == LockExclusive || m.Mode != LockShared || m.IsHolder(slackID)) {
+			return ErrAlreadyLocked
+		}
+		// Shared holders can't jump the queue.
+		if m.Locked && len(m.Waiting(time.Now())) > 0 {
+			return ErrAlreadyLocked
+		}
+		if len(m.LockedDescendants) > 0 {
+			return errors.Wrap(ErrAlreadyLocked, m.LockedDescendants[0])
+		}
+
+		event, err := s.newEvent(rqx, id, item.Version+1, item.link,
+			"mutex-locked",
+			map[string]string{
+				"message": message,
+				"mode":    string(mode),
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		var update *types.Update
+		if mode == LockShared {
+			update, err = s.sharedLock(id, slackID, message, m, event)
+		} else {
+			update, err = s.exclusiveLock(id, slackID, message, event)
+		}
+		if err != nil {
+			return err
+		}
+		t := s.newTransaction()
+		if err = t.addUpdate(update).addEvent(s.table, event); err != nil {
+			return err
+		}
+		if !m.Locked {
+			ops, err := s.ancestorOps([]string{id}, true)
+			if err != nil {
+				return err
+			}
+			for _, op := range ops {
+				t.add(op)
+			}
+		}
+
+		err = t.exec(s.svc)
+		switch {
+		case conditionFailed(err, 0):
+			return ErrAlreadyLocked
+		case anyConditionFailed(err):
+			// the mutex or one of its ancestors changed after it was read
+			continue
+		}
 		return err
 	}
-	return s.updateTTL()
+	return errors.New("mutex changed too often to lock: " + id)
 }
 
-func (s *DynamoStore) checkForTable() (bool, error) {
-	describeTable := &dynamodb.DescribeTableInput{
-		TableName: s.table,
-	}
-	// TODO: thread ctx
-	result, err := s.svc.DescribeTable(context.TODO(), describeTable)
+// UnlockMutex releases the requester's hold on the named mutex. Once it
+// has no holders, the mutex is unlocked, or if anyone is waiting for it,
+// handed to the first of them instead.
+func (s *DynamoStore) UnlockMutex(rqx *rqx.RequestContext, name string) error {
+	return s.unlockMutex(rqx, name, false)
+}
+
+// unlockMutex is UnlockMutex, except that when holderOnly is set, an
+// exclusive lock is only released if the requester holds it.
+func (s *DynamoStore) unlockMutex(rqx *rqx.RequestContext, name string, holderOnly bool) error {
+	id, err := mutexID(rqx, name)
 	if err != nil {
-		var notFoundErr *types.ResourceNotFoundException
-		if errors.As(err, &notFoundErr) {
-			return false, nil
-		}
-		return false, err
+		return err
 	}
-	switch result.Table.TableStatus {
-	case types.TableStatusCreating:
-		return true, s.waitForTable()
-	case types.TableStatusDeleting:
-		return false, ErrDeleteInProgress
-	case types.TableStatusActive, types.TableStatusUpdating:
-		return true, nil
-	default:
-		return false, errors.New(
-			"unrecognized table status: " + string(result.Table.TableStatus),
-		)
+
+	slackID := rqx.EUser.SlackID
+	for i := 0; i < maxUpdateAttempts; i++ {
+		item, m, err := s.readMutex(id)
+		if err != nil {
+			return err
+		}
+		if !m.Locked {
+			return ErrNotLocked
+		} else if holderOnly && m.Mode != LockShared && m.LockedBy != slackID {
+			return ErrMutexNotHeld
+		}
+
+		var event *event
+		var ancestors []types.TransactWriteItem
+		version := item.Version + 1
+		data := map[string]string{}
+		if m.Mode == LockShared {
+			var ok bool
+			if m.Holders, ok = removeHolder(m.Holders, slackID); !ok {
+				return ErrMutexNotHeld
+			}
+			data["mode"] = string(LockShared)
+		}
+		// The queue is only handed off once the last holder unlocks.
+		var next *Waiter
+		ok := false
+		if len(m.Holders) < 1 {
+			next, ok = handOff(m, time.Now())
+		}
+		switch {
+		case len(m.Holders) > 0:
+			event, err = s.newEvent(rqx, id, version, item.link,
+				"mutex-unlocked",
+				data,
+			)
+		case ok:
+			event, err = s.newEvent(rqx, id, version, item.link,
+				"mutex-handed-off",
+				map[string]string{
+					"locked_by": next.SlackID,
+					"message":   next.Message,
+					"mode":      string(next.Mode),
+				},
+			)
+			if err == nil {
+				giveLock(m, next, event.Created)
+			}
+		default:
+			event, err = s.newEvent(rqx, id, version, item.link,
+				"mutex-unlocked",
+				data,
+			)
+			if err == nil {
+				ancestors, err = s.ancestorOps([]string{id}, false)
+			}
+			m.Locked = false
+			m.LockedBy = ""
+			m.Message = ""
+			m.Mode = ""
+			m.Queue = nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = s.putSummary(id, item.Version, m, event, ancestors...)
+		if !anyConditionFailed(err) {
+			return err
+		}
 	}
+	return errors.New("mutex changed too often to unlock: " + id)
 }
 
-func (s *DynamoStore) createTable() error {
-	createTable := &dynamodb.CreateTableInput{
-		BillingMode: types.BillingModePayPerRequest,
-		TableName:   s.table,
-		KeySchema: []types.KeySchemaElement{
-			{
-				AttributeName: aws.String("entity"),
-				KeyType:       types.KeyTypeHash,
-			},
-			{
-				AttributeName: aws.String("revision"),
-				KeyType:       types.KeyTypeRange,
-			},
-		},
-		AttributeDefinitions: []types.AttributeDefinition{
-			{
-				AttributeName: aws.String("entity"),
-				AttributeType: types.ScalarAttributeTypeS,
-			},
-			{
-				AttributeName: aws.String("revision"),
-				AttributeType: types.ScalarAttributeTypeN,
-			},
-		},
+func (s *DynamoStore) getMutex(id, projection string, consistent bool) (*mutex, error) {
+	item := &mutex{}
+	if ok, err := s.getEntity(id, projection, consistent, item); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrMutexNotFound
 	}
-	// TODO: thread ctx
-	_, err := s.svc.CreateTable(context.TODO(), createTable)
-	return err
+	return item, nil
 }
 
-func (s *DynamoStore) getMutex(id, projection string, consistent bool) (*mutex, error) {
+// getEntity reads the item that holds the current state of an entity, and
+// reports whether it exists.
+func (s *DynamoStore) getEntity(id, projection string, consistent bool, out interface{}) (bool, error) {
 	// TODO: thread ctx
 	result, err := s.svc.GetItem(context.TODO(), &dynamodb.GetItemInput{
 		ConsistentRead: aws.Bool(consistent),
@@ -284,59 +372,85 @@ func (s *DynamoStore) getMutex(id, projection string, consistent bool) (*mutex,
 		ProjectionExpression: aws.String(projection),
 	})
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
-	item := &mutex{}
-	err = attributevalue.UnmarshalMap(result.Item, item)
-	if err != nil {
-		return nil, err
+	if result.Item == nil {
+		return false, nil
 	}
 
-	return item, nil
+	return true, attributevalue.UnmarshalMap(result.Item, out)
 }
 
-func (s *DynamoStore) updateTTL() error {
-	updateTTL := &dynamodb.UpdateTimeToLiveInput{
-		TableName: s.table,
-		TimeToLiveSpecification: &types.TimeToLiveSpecification{
-			AttributeName: aws.String("ttl"),
-			Enabled:       aws.Bool(true),
-		},
+func (s *DynamoStore) exportMutex(id string, item *mutex) (*Mutex, error) {
+	description, err := s.keys.decrypt(descriptionContext(id), item.Description)
+	if err != nil {
+		return nil, err
+	}
+	message, err := s.keys.decrypt(messageContext(id), item.Summary.Message)
+	if err != nil {
+		return nil, err
 	}
-	// TODO: thread ctx
-	_, err := s.svc.UpdateTimeToLive(context.TODO(), updateTTL)
-	return err
-}
 
-func (s *DynamoStore) waitForTable() error {
-	describeTable := &dynamodb.DescribeTableInput{
-		TableName: s.table,
+	_, name := entityName(id)
+	m := &Mutex{
+		Name:        name,
+		Description: description,
+		Version:     item.Version,
+		Locked:      item.Summary.Locked,
+		LockedBy:    item.Summary.LockedBy,
+		Message:     message,
+		Mode:        item.Summary.Mode,
+		OwnerTeam:   item.OwnerTeam,
+		Labels:      item.Labels,
+		Links:       item.Links,
+	}
+	sort.Strings(m.Labels)
+	if len(item.LockedDescendants) > 0 {
+		m.LockedDescendants = append([]string(nil), item.LockedDescendants...)
+		sort.Strings(m.LockedDescendants)
 	}
-	for i := 0; i < 60; i++ {
-		time.Sleep(1 * time.Second)
-		// TODO: thread ctx
-		result, err := s.svc.DescribeTable(context.TODO(), describeTable)
+	if m.Locked && m.Mode == "" {
+		// mutexes locked before modes were added
+		m.Mode = LockExclusive
+	}
+	for slackID, h := range item.Summary.Holders {
+		message, err := s.keys.decrypt(holderContext(id), h.Message)
 		if err != nil {
-			var notFoundErr *types.ResourceNotFoundException
-			if !errors.As(err, &notFoundErr) {
-				return err
-			}
+			return nil, err
 		}
-		switch result.Table.TableStatus {
-		case types.TableStatusCreating:
-			// continue loop
-		case types.TableStatusDeleting:
-			return ErrDeleteInProgress
-		case types.TableStatusActive, types.TableStatusUpdating:
-			return nil
+		m.Holders = append(m.Holders, Holder{
+			SlackID:  slackID,
+			Message:  message,
+			Acquired: h.Acquired,
+		})
+	}
+	sortHolders(m.Holders)
+	for _, w := range item.Summary.Waiting {
+		message, err := s.keys.decrypt(waitingContext(id), w.Message)
+		if err != nil {
+			return nil, err
 		}
+		m.Queue = append(m.Queue, Waiter{
+			SlackID:  w.SlackID,
+			Message:  message,
+			Mode:     w.Mode,
+			Enqueued: w.Enqueued,
+			Expires:  w.Expires,
+		})
 	}
-	return ErrCreateTimedOut
+	return m, nil
 }
 
 type writeTransaction struct {
-	ops []types.TransactWriteItem
+	ops    []types.TransactWriteItem
+	outbox bool
+}
+
+func (s *DynamoStore) newTransaction() *writeTransaction {
+	return &writeTransaction{
+		outbox: s.outbox,
+	}
 }
 
 func (t *writeTransaction) add(op types.TransactWriteItem) *writeTransaction {
@@ -344,16 +458,18 @@ func (t *writeTransaction) add(op types.TransactWriteItem) *writeTransaction {
 	return t
 }
 
-func (t *writeTransaction) addEvent(
+// newEvent creates an event chained to the previous event's hash. Event
+// data is hashed before it is encrypted.
+func (s *DynamoStore) newEvent(
 	rqx *rqx.RequestContext,
-	table *string,
 	entity string,
 	revision int64,
+	prev link,
 	typ string,
 	data map[string]string,
-) error {
+) (*event, error) {
 	now := time.Now()
-	event, err := attributevalue.MarshalMap(&event{
+	e := &event{
 		base: base{
 			ID:       entity,
 			Revision: revision,
@@ -375,19 +491,44 @@ func (t *writeTransaction) addEvent(
 			Name:    rqx.RUser.Name,
 			SlackID: rqx.RUser.SlackID,
 		},
-		Type: typ,
-		Data: data,
-	})
+		Type:     typ,
+		Data:     data,
+		PrevHash: prev.Chain,
+	}
+	if !prev.ChainExpires.IsZero() {
+		expires := prev.ChainExpires
+		e.PrevExpires = &expires
+	}
+	if err := e.salt(); err != nil {
+		return nil, err
+	}
+	hash, err := e.hash()
+	if err != nil {
+		return nil, err
+	}
+	e.Hash = hash
+	e.Data, err = s.keys.encryptData(eventContext(entity, revision), data)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (t *writeTransaction) addEvent(table *string, e *event) error {
+	item, err := attributevalue.MarshalMap(e)
 	if err != nil {
 		return err
 	}
 	t.addPut(&types.Put{
 		TableName: table,
-		Item:      event,
+		Item:      item,
 		ConditionExpression: aws.String(
 			"attribute_not_exists(revision)",
 		),
 	})
+	if t.outbox {
+		return t.addOutbox(table, e)
+	}
 	return nil
 }
 
@@ -403,7 +544,7 @@ func (t *writeTransaction) addUpdate(op *types.Update) *writeTransaction {
 	})
 }
 
-func (t *writeTransaction) exec(svc *dynamodb.Client) error {
+func (t *writeTransaction) exec(svc DynamoDBAPI) error {
 	token := make([]byte, 20)
 	if _, err := rand.Read(token); err != nil {
 		return errors.Wrap(err, "unable to generate request token")
@@ -418,6 +559,16 @@ func (t *writeTransaction) exec(svc *dynamodb.Client) error {
 	return err
 }
 
+// conditionFailed reports whether a transaction was canceled because the
+// condition on its i-th operation wasn't met.
+func conditionFailed(err error, i int) bool {
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) || i >= len(canceled.CancellationReasons) {
+		return false
+	}
+	return aws.ToString(canceled.CancellationReasons[i].Code) == "ConditionalCheckFailed"
+}
+
 type base struct {
 	ID       string `dynamodbav:"entity"`
 	Revision int64  `dynamodbav:"revision"`
@@ -446,16 +597,30 @@ type event struct {
 
 	Type string            `dynamodbav:"type"`
 	Data map[string]string `dynamodbav:"data"`
+
+	PrevHash    string            `dynamodbav:"prev_hash,omitempty"`
+	PrevExpires *time.Time        `dynamodbav:"prev_expires,unixtime,omitempty"`
+	Hash        string            `dynamodbav:"hash,omitempty"`
+	Redacted    map[string]string `dynamodbav:"redacted,omitempty"`
+	Salts       map[string]string `dynamodbav:"salts,omitempty"`
 }
 
 type mutex struct {
 	entity
-	Summary mutexSummary `dynamodbav:"summary"`
+	OwnerTeam string            `dynamodbav:"owner_team,omitempty"`
+	Labels    []string          `dynamodbav:"labels,stringset,omitempty"`
+	Links     map[string]string `dynamodbav:"links,omitempty"`
+	link
+	Summary           mutexSummary `dynamodbav:"summary"`
+	LockedDescendants []string     `dynamodbav:"locked_descendants,stringset,omitempty"`
 }
 type mutexSummary struct {
-	Locked   bool   `dynamodbav:"locked"`
-	LockedBy string `dynamodbav:"locked_by"`
-	Message  string `dynamodbav:"message"`
+	Locked   bool              `dynamodbav:"locked"`
+	LockedBy string            `dynamodbav:"locked_by,omitempty"`
+	Message  string            `dynamodbav:"message,omitempty"`
+	Mode     LockMode          `dynamodbav:"mode,omitempty"`
+	Holders  map[string]holder `dynamodbav:"holders,omitempty"`
+	Waiting  []waiter          `dynamodbav:"waiting,omitempty"`
 }
 
 type user struct {
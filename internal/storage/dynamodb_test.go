@@ -0,0 +1,98 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sjansen/stopgap/internal/rqx"
+	"github.com/sjansen/stopgap/internal/storage"
+)
+
+// stubAPI returns canned responses. Calls it doesn't expect panic.
+type stubAPI struct {
+	storage.DynamoDBAPI
+
+	items        map[string]map[string]types.AttributeValue
+	transactions []*dynamodb.TransactWriteItemsInput
+	transactErr  error
+}
+
+func (s *stubAPI) GetItem(
+	ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.GetItemOutput, error) {
+	entity := params.Key["entity"].(*types.AttributeValueMemberS).Value
+	return &dynamodb.GetItemOutput{Item: s.items[entity]}, nil
+}
+
+func (s *stubAPI) TransactWriteItems(
+	ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.TransactWriteItemsOutput, error) {
+	s.transactions = append(s.transactions, params)
+	return &dynamodb.TransactWriteItemsOutput{}, s.transactErr
+}
+
+func TestDynamoStoreWithStub(t *testing.T) {
+	require := require.New(t)
+
+	svc := &stubAPI{
+		items: map[string]map[string]types.AttributeValue{
+			"mutex:conch": {
+				"entity":   &types.AttributeValueMemberS{Value: "mutex:conch"},
+				"revision": &types.AttributeValueMemberN{Value: "0"},
+				"version":  &types.AttributeValueMemberN{Value: "7"},
+				"chain":    &types.AttributeValueMemberS{Value: "abc123"},
+			},
+		},
+	}
+	store := storage.New(svc)
+	rqx := &rqx.RequestContext{
+		Ctx:   context.TODO(),
+		EUser: rqx.User{SlackID: "UFoo42"},
+	}
+
+	// GIVEN a mutex that doesn't exist
+	// WHEN it is read
+	_, err := store.GetMutex(rqx, "triton", true)
+	// THEN the error should say so
+	require.ErrorIs(err, storage.ErrMutexNotFound)
+
+	// GIVEN an unlocked mutex
+	// WHEN it is locked
+	err = store.LockMutex(rqx, "conch", "migrations", storage.LockExclusive)
+	// THEN the mutex and its next event should be written together
+	require.NoError(err)
+	require.Len(svc.transactions, 1)
+	ops := svc.transactions[0].TransactItems
+	require.Len(ops, 2)
+	require.NotNil(ops[0].Update)
+	require.Equal(
+		&types.AttributeValueMemberN{Value: "8"},
+		ops[0].Update.ExpressionAttributeValues[":version"],
+	)
+	require.NotNil(ops[1].Put)
+	require.Equal(
+		&types.AttributeValueMemberN{Value: "8"},
+		ops[1].Put.Item["revision"],
+	)
+	require.Equal(
+		&types.AttributeValueMemberS{Value: "abc123"},
+		ops[1].Put.Item["prev_hash"],
+	)
+
+	// GIVEN a locked mutex and a write that fails
+	svc.items["mutex:conch"]["summary"] = &types.AttributeValueMemberM{
+		Value: map[string]types.AttributeValue{
+			"locked": &types.AttributeValueMemberBOOL{Value: true},
+		},
+	}
+	svc.transactErr = errors.New("throttled")
+	// WHEN the mutex is unlocked
+	err = store.UnlockMutex(rqx, "conch")
+	// THEN the error should be returned
+	require.EqualError(err, "throttled")
+}
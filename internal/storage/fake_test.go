@@ -0,0 +1,24 @@
+//go:build !integration
+// +build !integration
+
+package storage_test
+
+import (
+	"github.com/sjansen/stopgap/internal/dynamofake"
+)
+
+// Without the integration tag, tests run against an in-process fake. The
+// fake processes small batches, so retries of unprocessed keys are tested.
+var fake = func() *dynamofake.Client {
+	c := dynamofake.New()
+	c.BatchGetLimit = 40
+	return c
+}()
+
+func createClient() *dynamofake.Client {
+	return fake
+}
+
+func createStreamsClient() *dynamofake.Streams {
+	return fake.Streams()
+}
@@ -0,0 +1,517 @@
+package storage
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/pkg/errors"
+
+	"github.com/sjansen/stopgap/internal/rqx"
+)
+
+// ErrAliasNotFound is returned when the named alias doesn't exist.
+var ErrAliasNotFound = errors.New("alias not found")
+
+// ErrGroupNotFound is returned when the named group doesn't exist.
+var ErrGroupNotFound = errors.New("group not found")
+
+// ErrNameInUse is returned when creating a mutex, alias or group with a
+// name that is already used by one of the others.
+var ErrNameInUse = errors.New("name in use")
+
+// Mutexes, aliases and groups share a namespace within each tenant, so a
+// name always refers to the same thing.
+var namedKinds = []string{"mutex", "alias", "group"}
+
+// Alias is another name for a mutex.
+type Alias struct {
+	Name    string
+	Version int64
+	Target  string
+}
+
+// Group is a name for several mutexes, which can be locked, unlocked and
+// checked together. Members are the names of mutexes or aliases, sorted.
+type Group struct {
+	Name    string
+	Version int64
+	Members []string
+}
+
+type alias struct {
+	entity
+	link
+	Target string `dynamodbav:"target"`
+}
+
+type group struct {
+	entity
+	link
+	Members []string `dynamodbav:"members,stringset"`
+}
+
+// CreateAlias adds an alias for the target mutex.
+func (s *DynamoStore) CreateAlias(rqx *rqx.RequestContext, name, target string) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+	tenant, err := tenantOf(rqx)
+	if err != nil {
+		return err
+	}
+	id := entityID(tenant, "alias", name)
+	event, err := s.newEvent(rqx, id, 1, link{},
+		"alias-created",
+		map[string]string{
+			"target": target,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	item := s.newNamedItem(tenant, "alias", id, event)
+	item["target"] = &types.AttributeValueMemberS{Value: target}
+	return s.createNamed(tenant, "alias", name, item, event, s.targetCheck(tenant, target))
+}
+
+// GetAlias returns the data for the named alias.
+func (s *DynamoStore) GetAlias(rqx *rqx.RequestContext, name string) (*Alias, error) {
+	id, err := tenantEntityID(rqx, "alias", name)
+	if err != nil {
+		return nil, err
+	}
+	item, err := s.getAlias(id)
+	if err != nil {
+		return nil, err
+	}
+	return &Alias{
+		Name:    name,
+		Version: item.Version,
+		Target:  item.Target,
+	}, nil
+}
+
+// UpdateAlias points the named alias at a different mutex.
+func (s *DynamoStore) UpdateAlias(rqx *rqx.RequestContext, name, target string) error {
+	tenant, err := tenantOf(rqx)
+	if err != nil {
+		return err
+	}
+	id := entityID(tenant, "alias", name)
+
+	for i := 0; i < maxUpdateAttempts; i++ {
+		item, err := s.getAlias(id)
+		if err != nil {
+			return err
+		}
+		event, err := s.newEvent(rqx, id, item.Version+1, item.link,
+			"alias-updated",
+			map[string]string{
+				"target":   target,
+				"previous": item.Target,
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		err = s.updateNamed(id, item.Version, event,
+			"target", &types.AttributeValueMemberS{Value: target},
+			s.targetCheck(tenant, target),
+		)
+		if !conditionFailed(err, 0) {
+			return err
+		}
+	}
+	return errors.New("alias changed too often to update: " + id)
+}
+
+// GetAliasHistory returns the events recorded for the named alias, oldest
+// first.
+func (s *DynamoStore) GetAliasHistory(rqx *rqx.RequestContext, name string, consistent bool) ([]*Event, error) {
+	id, err := tenantEntityID(rqx, "alias", name)
+	if err != nil {
+		return nil, err
+	}
+	return s.getHistory(id, consistent)
+}
+
+// CreateGroup adds a group of mutexes. Members may be mutexes or aliases,
+// but not other groups.
+func (s *DynamoStore) CreateGroup(rqx *rqx.RequestContext, name string, members []string) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+	tenant, err := tenantOf(rqx)
+	if err != nil {
+		return err
+	}
+	members, err = s.checkMembers(rqx, tenant, members)
+	if err != nil {
+		return err
+	}
+	id := entityID(tenant, "group", name)
+	event, err := s.newEvent(rqx, id, 1, link{},
+		"group-created",
+		map[string]string{
+			"members": encodeNames(members),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	item := s.newNamedItem(tenant, "group", id, event)
+	item["members"] = &types.AttributeValueMemberSS{Value: members}
+	return s.createNamed(tenant, "group", name, item, event)
+}
+
+// GetGroup returns the data for the named group.
+func (s *DynamoStore) GetGroup(rqx *rqx.RequestContext, name string) (*Group, error) {
+	id, err := tenantEntityID(rqx, "group", name)
+	if err != nil {
+		return nil, err
+	}
+	item, err := s.getGroup(id)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(item.Members)
+	return &Group{
+		Name:    name,
+		Version: item.Version,
+		Members: item.Members,
+	}, nil
+}
+
+// UpdateGroup replaces the members of the named group.
+func (s *DynamoStore) UpdateGroup(rqx *rqx.RequestContext, name string, members []string) error {
+	tenant, err := tenantOf(rqx)
+	if err != nil {
+		return err
+	}
+	members, err = s.checkMembers(rqx, tenant, members)
+	if err != nil {
+		return err
+	}
+	id := entityID(tenant, "group", name)
+
+	for i := 0; i < maxUpdateAttempts; i++ {
+		item, err := s.getGroup(id)
+		if err != nil {
+			return err
+		}
+		sort.Strings(item.Members)
+		event, err := s.newEvent(rqx, id, item.Version+1, item.link,
+			"group-updated",
+			map[string]string{
+				"members":  encodeNames(members),
+				"previous": encodeNames(item.Members),
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		err = s.updateNamed(id, item.Version, event,
+			"members", &types.AttributeValueMemberSS{Value: members},
+		)
+		if !conditionFailed(err, 0) {
+			return err
+		}
+	}
+	return errors.New("group changed too often to update: " + id)
+}
+
+// GetGroupHistory returns the events recorded for the named group, oldest
+// first.
+func (s *DynamoStore) GetGroupHistory(rqx *rqx.RequestContext, name string, consistent bool) ([]*Event, error) {
+	id, err := tenantEntityID(rqx, "group", name)
+	if err != nil {
+		return nil, err
+	}
+	return s.getHistory(id, consistent)
+}
+
+// ResolveNames returns the names of the mutexes a name refers to, sorted.
+// A mutex resolves to itself, an alias to its target, and a group to its
+// members, after resolving any aliases among them. Names that aren't found
+// also resolve to themselves, and are left for the caller to report.
+func (s *DynamoStore) ResolveNames(rqx *rqx.RequestContext, name string) ([]string, error) {
+	tenant, err := tenantOf(rqx)
+	if err != nil {
+		return nil, err
+	}
+	found, err := s.getNamed(rqx, tenant, []string{name})
+	if err != nil {
+		return nil, err
+	}
+
+	item := found[name]
+	if item == nil || item.EntityType != "group" {
+		return []string{item.resolve(name)}, nil
+	}
+	members := item.Members
+
+	found, err = s.getNamed(rqx, tenant, members)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(members))
+	for _, member := range members {
+		result = append(result, found[member].resolve(member))
+	}
+	result = uniqueNames(result)
+	sort.Strings(result)
+	return result, nil
+}
+
+// named is any of the kinds of entity that share a namespace.
+type named struct {
+	entity
+	Target  string   `dynamodbav:"target"`
+	Members []string `dynamodbav:"members,stringset"`
+}
+
+func (n *named) resolve(name string) string {
+	if n != nil && n.EntityType == "alias" {
+		return n.Target
+	}
+	return name
+}
+
+// getNamed looks up names as every kind of entity at once, and returns
+// what was found indexed by name.
+func (s *DynamoStore) getNamed(rqx *rqx.RequestContext, tenant string, names []string) (map[string]*named, error) {
+	ids := map[string]string{}
+	keys := make([]map[string]types.AttributeValue, 0, len(names)*len(namedKinds))
+	for _, name := range names {
+		for _, kind := range namedKinds {
+			id := entityID(tenant, kind, name)
+			if _, ok := ids[id]; ok {
+				continue
+			}
+			ids[id] = name
+			keys = append(keys, map[string]types.AttributeValue{
+				"entity":   &types.AttributeValueMemberS{Value: id},
+				"revision": &types.AttributeValueMemberN{Value: "0"},
+			})
+		}
+	}
+
+	result := make(map[string]*named, len(names))
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > batchGetLimit {
+			n = batchGetLimit
+		}
+		items, err := s.batchGet(rqx.Ctx, keys[:n], "entity, entity_type, target, members", true)
+		if err != nil {
+			return nil, err
+		}
+		keys = keys[n:]
+
+		for _, item := range items {
+			n := &named{}
+			if err := attributevalue.UnmarshalMap(item, n); err != nil {
+				return nil, err
+			}
+			result[ids[n.ID]] = n
+		}
+	}
+	return result, nil
+}
+
+// checkMembers removes duplicate members, and makes sure the rest are
+// mutexes or aliases.
+func (s *DynamoStore) checkMembers(rqx *rqx.RequestContext, tenant string, members []string) ([]string, error) {
+	members = uniqueNames(members)
+	if len(members) < 1 {
+		return nil, errors.New("groups must have at least one member")
+	}
+	sort.Strings(members)
+
+	found, err := s.getNamed(rqx, tenant, members)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range members {
+		switch item := found[member]; {
+		case item == nil:
+			return nil, errors.Wrap(ErrMutexNotFound, member)
+		case item.EntityType == "group":
+			return nil, errors.Errorf("groups can't contain other groups: %s", member)
+		}
+	}
+	return members, nil
+}
+
+func (s *DynamoStore) getAlias(id string) (*alias, error) {
+	item := &alias{}
+	if ok, err := s.getEntity(id, "version, chain, chain_expires, target", true, item); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrAliasNotFound
+	}
+	return item, nil
+}
+
+func (s *DynamoStore) getGroup(id string) (*group, error) {
+	item := &group{}
+	if ok, err := s.getEntity(id, "version, chain, chain_expires, members", true, item); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrGroupNotFound
+	}
+	return item, nil
+}
+
+func (s *DynamoStore) newNamedItem(tenant, kind, id string, e *event) map[string]types.AttributeValue {
+	item := map[string]types.AttributeValue{
+		"entity":        &types.AttributeValueMemberS{Value: id},
+		"revision":      &types.AttributeValueMemberN{Value: "0"},
+		"entity_type":   &types.AttributeValueMemberS{Value: kind},
+		"version":       &types.AttributeValueMemberN{Value: "1"},
+		"chain":         &types.AttributeValueMemberS{Value: e.Hash},
+		"chain_expires": e.chainExpires(),
+	}
+	if tenant != "" {
+		item["tenant"] = &types.AttributeValueMemberS{Value: tenant}
+	}
+	return item
+}
+
+// check is a condition that must hold for a change to be made, along with
+// the error returned when it doesn't.
+type check struct {
+	condition *types.ConditionCheck
+	err       error
+}
+
+// execChecked adds the checks to a transaction and executes it.
+func (t *writeTransaction) execChecked(svc DynamoDBAPI, checks []check) error {
+	first := len(t.ops)
+	for _, c := range checks {
+		t.add(types.TransactWriteItem{ConditionCheck: c.condition})
+	}
+	err := t.exec(svc)
+	for i, c := range checks {
+		if conditionFailed(err, first+i) {
+			return c.err
+		}
+	}
+	return err
+}
+
+// nameChecks make sure a name isn't used by any other kind of entity.
+func (s *DynamoStore) nameChecks(tenant, kind, name string) []check {
+	var checks []check
+	for _, other := range namedKinds {
+		if other == kind {
+			continue
+		}
+		checks = append(checks, check{
+			condition: &types.ConditionCheck{
+				TableName: s.table,
+				Key: map[string]types.AttributeValue{
+					"entity":   &types.AttributeValueMemberS{Value: entityID(tenant, other, name)},
+					"revision": &types.AttributeValueMemberN{Value: "0"},
+				},
+				ConditionExpression: aws.String("attribute_not_exists(entity)"),
+			},
+			err: errors.Wrap(ErrNameInUse, name),
+		})
+	}
+	return checks
+}
+
+// createNamed puts a new alias or group, along with its first event, as
+// long as its name isn't used by any other kind of entity.
+func (s *DynamoStore) createNamed(
+	tenant, kind, name string,
+	item map[string]types.AttributeValue,
+	e *event,
+	checks ...check,
+) error {
+	t := s.newTransaction()
+	err := t.addPut(&types.Put{
+		Item:                item,
+		TableName:           s.table,
+		ConditionExpression: aws.String("attribute_not_exists(entity)"),
+	}).addEvent(s.table, e)
+	if err != nil {
+		return err
+	}
+	return t.execChecked(s.svc, append(checks, s.nameChecks(tenant, kind, name)...))
+}
+
+// updateNamed sets a single attribute of an alias or group, along with its
+// next event, unless it changed after it was read.
+func (s *DynamoStore) updateNamed(
+	id string, expected int64, e *event,
+	attr string, value types.AttributeValue,
+	checks ...check,
+) error {
+	t := s.newTransaction()
+	err := t.addUpdate(&types.Update{
+		TableName: s.table,
+		Key: map[string]types.AttributeValue{
+			"entity":   &types.AttributeValueMemberS{Value: id},
+			"revision": &types.AttributeValueMemberN{Value: "0"},
+		},
+		ConditionExpression: aws.String("version = :expected"),
+		UpdateExpression: aws.String(`
+			SET #attr = :value,
+			    version = :version,
+			    chain = :chain,
+			    chain_expires = :chain_expires
+		`),
+		ExpressionAttributeNames: map[string]string{
+			"#attr": attr,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":expected": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(expected, 10),
+			},
+			":value": value,
+			":version": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(e.Revision, 10),
+			},
+			":chain":         &types.AttributeValueMemberS{Value: e.Hash},
+			":chain_expires": e.chainExpires(),
+		},
+	}).addEvent(s.table, e)
+	if err != nil {
+		return err
+	}
+	return t.execChecked(s.svc, checks)
+}
+
+// targetCheck makes sure an alias's target is a mutex.
+func (s *DynamoStore) targetCheck(tenant, target string) check {
+	return check{
+		condition: &types.ConditionCheck{
+			TableName: s.table,
+			Key: map[string]types.AttributeValue{
+				"entity":   &types.AttributeValueMemberS{Value: mutexEntityID(tenant, target)},
+				"revision": &types.AttributeValueMemberN{Value: "0"},
+			},
+			ConditionExpression: aws.String("attribute_exists(entity)"),
+		},
+		err: errors.Wrap(ErrMutexNotFound, target),
+	}
+}
+
+// encodeNames encodes names the same way whether or not they are nil.
+func encodeNames(names []string) string {
+	if names == nil {
+		names = []string{}
+	}
+	b, _ := json.Marshal(names)
+	return string(b)
+}
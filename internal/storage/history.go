@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/oklog/ulid/v2"
+	"github.com/pkg/errors"
+
+	"github.com/sjansen/stopgap/internal/rqx"
+)
+
+// Event records a single change to a mutex.
+type Event struct {
+	Entity   string
+	Tenant   string
+	Revision int64
+	Created  time.Time
+	Type     string
+	Client   rqx.Client
+	EUser    rqx.User
+	RUser    rqx.User
+	Data     map[string]string
+	PrevHash string
+	// PrevExpires is when the event before this one expires, so that its
+	// absence can be told apart from tampering. It is zero for the first
+	// event, and for events recorded before it was tracked.
+	PrevExpires time.Time
+	Hash        string
+
+	// Redacted holds the digests of identifying details that have been
+	// removed from the event, indexed by field.
+	Redacted map[string]string
+	// Salts holds the random keys used to digest identifying details that
+	// haven't been redacted, indexed by field. A salt is removed along
+	// with its detail, so the digest left behind can't be reversed by
+	// guessing the detail.
+	Salts map[string]string
+}
+
+// GetMutexHistory returns the events recorded for the named mutex, oldest
+// first. Events expire, so the history may not start at creation.
+func (s *DynamoStore) GetMutexHistory(rqx *rqx.RequestContext, name string, consistent bool) ([]*Event, error) {
+	id, err := mutexID(rqx, name)
+	if err != nil {
+		return nil, err
+	}
+	return s.getHistory(id, consistent)
+}
+
+func (s *DynamoStore) getHistory(id string, consistent bool) ([]*Event, error) {
+	items, err := s.queryEvents(id, consistent)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]*Event, 0, len(items))
+	for _, item := range items {
+		e, err := item.export()
+		if err != nil {
+			return nil, err
+		}
+		e.Data, err = s.keys.decryptData(eventContext(id, e.Revision), e.Data)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func (s *DynamoStore) queryEvents(id string, consistent bool) ([]*event, error) {
+	input := &dynamodb.QueryInput{
+		ConsistentRead:         aws.Bool(consistent),
+		TableName:              s.table,
+		KeyConditionExpression: aws.String("entity = :entity AND revision > :revision"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":entity":   &types.AttributeValueMemberS{Value: id},
+			":revision": &types.AttributeValueMemberN{Value: "0"},
+		},
+	}
+
+	var events []*event
+	for {
+		// TODO: thread ctx
+		result, err := s.svc.Query(context.TODO(), input)
+		if err != nil {
+			return nil, err
+		}
+		page := make([]*event, 0, len(result.Items))
+		if err = attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, err
+		}
+		events = append(events, page...)
+		if len(result.LastEvaluatedKey) == 0 {
+			return events, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+func (e *event) export() (*Event, error) {
+	euser, err := e.EUser.export()
+	if err != nil {
+		return nil, err
+	}
+	ruser, err := e.RUser.export()
+	if err != nil {
+		return nil, err
+	}
+	tenant, _ := splitEntityID(e.ID)
+	var prevExpires time.Time
+	if e.PrevExpires != nil {
+		prevExpires = *e.PrevExpires
+	}
+	return &Event{
+		Entity:   e.ID,
+		Tenant:   tenant,
+		Revision: e.Revision,
+		Created:  e.Created,
+		Type:     e.Type,
+		Client: rqx.Client{
+			Type:       e.Client.Type,
+			RemoteAddr: e.Client.RemoteAddr,
+			UserAgent:  e.Client.UserAgent,
+		},
+		EUser:       euser,
+		RUser:       ruser,
+		Data:        e.Data,
+		PrevHash:    e.PrevHash,
+		PrevExpires: prevExpires,
+		Hash:        e.Hash,
+		Redacted:    e.Redacted,
+		Salts:       e.Salts,
+	}, nil
+}
+
+func (u *user) export() (rqx.User, error) {
+	result := rqx.User{
+		Name:    u.Name,
+		SlackID: u.SlackID,
+	}
+	if u.UID != "" {
+		uid, err := ulid.Parse(u.UID)
+		if err != nil {
+			return result, errors.Wrap(err, "invalid user ID")
+		}
+		result.UID = uid
+	}
+	return result, nil
+}
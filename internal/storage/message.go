@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/sjansen/stopgap/internal/rqx"
+)
+
+// UpdateLockMessage replaces the message the requester left when they
+// locked the named mutex, without unlocking it.
+func (s *DynamoStore) UpdateLockMessage(rqx *rqx.RequestContext, name, message string) error {
+	id, err := mutexID(rqx, name)
+	if err != nil {
+		return err
+	}
+
+	slackID := rqx.EUser.SlackID
+	for i := 0; i < maxUpdateAttempts; i++ {
+		item, m, err := s.readMutex(id)
+		if err != nil {
+			return err
+		}
+		if !m.Locked {
+			return ErrNotLocked
+		} else if !m.IsHolder(slackID) {
+			return ErrMutexNotHeld
+		}
+
+		event, err := s.newEvent(rqx, id, item.Version+1, item.link,
+			"mutex-message-updated",
+			map[string]string{
+				"message": message,
+			},
+		)
+		if err != nil {
+			return err
+		}
+		setLockMessage(m, slackID, message)
+
+		err = s.putSummary(id, item.Version, m, event)
+		if !conditionFailed(err, 0) {
+			return err
+		}
+	}
+	return errors.New("mutex changed too often to update message: " + id)
+}
+
+func setLockMessage(m *Mutex, slackID, message string) {
+	if m.Mode != LockShared {
+		m.Message = message
+		return
+	}
+	for i := range m.Holders {
+		if m.Holders[i].SlackID == slackID {
+			m.Holders[i].Message = message
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/pkg/errors"
+
+	"github.com/sjansen/stopgap/internal/rqx"
+)
+
+// ErrVersionConflict is returned when a mutex is updated based on a
+// version that is no longer current.
+var ErrVersionConflict = errors.New("mutex version conflict")
+
+// mutexMetadata is the projection needed to export a mutex's metadata.
+const mutexMetadata = "owner_team, labels, links"
+
+// MutexUpdate lists the metadata to change. Nil fields are left alone.
+type MutexUpdate struct {
+	// Version, if set, must be the mutex's current version.
+	Version     int64
+	Description *string
+	OwnerTeam   *string
+	// Labels replace the mutex's labels.
+	Labels []string
+	// Links replace the mutex's links, like "runbook" or "dashboard".
+	Links map[string]string
+}
+
+// UpdateMutex changes the named mutex's metadata, and records an event
+// listing the old and new values of each field that changed. Nothing is
+// recorded if no fields changed.
+func (s *DynamoStore) UpdateMutex(rqx *rqx.RequestContext, name string, update *MutexUpdate) error {
+	id, err := mutexID(rqx, name)
+	if err != nil {
+		return err
+	}
+	if update.Labels != nil {
+		copied := *update
+		copied.Labels = uniqueNames(update.Labels)
+		sort.Strings(copied.Labels)
+		update = &copied
+	}
+
+	for i := 0; i < maxUpdateAttempts; i++ {
+		item, err := s.getMutex(id, "version, chain, chain_expires, description, summary, "+mutexMetadata, true)
+		if err != nil {
+			return err
+		}
+		if update.Version != 0 && update.Version != item.Version {
+			return errors.Wrapf(ErrVersionConflict,
+				"expected %d, found %d", update.Version, item.Version,
+			)
+		}
+		m, err := s.exportMutex(id, item)
+		if err != nil {
+			return err
+		}
+
+		data := update.diff(m)
+		if len(data) < 1 {
+			return nil
+		}
+		event, err := s.newEvent(rqx, id, item.Version+1, item.link, "mutex-updated", data)
+		if err != nil {
+			return err
+		}
+		changed, err := s.encodeMetadata(id, update)
+		if err != nil {
+			return err
+		}
+
+		err = s.putMetadata(id, item.Version, changed, event)
+		if !conditionFailed(err, 0) {
+			return err
+		} else if update.Version != 0 {
+			return errors.Wrap(ErrVersionConflict, "changed while updating")
+		}
+	}
+	return errors.New("mutex changed too often to update: " + id)
+}
+
+// diff returns the old and new values of each field the update changes,
+// as event data.
+func (u *MutexUpdate) diff(m *Mutex) map[string]string {
+	data := map[string]string{}
+	add := func(field, from, to string) {
+		if from != to {
+			data[field] = to
+			data["previous_"+field] = from
+		}
+	}
+	if u.Description != nil {
+		add("description", m.Description, *u.Description)
+	}
+	if u.OwnerTeam != nil {
+		add("owner_team", m.OwnerTeam, *u.OwnerTeam)
+	}
+	if u.Labels != nil {
+		add("labels", encodeNames(m.Labels), encodeNames(u.Labels))
+	}
+	if u.Links != nil {
+		add("links", encodeLinks(m.Links), encodeLinks(u.Links))
+	}
+	return data
+}
+
+// applyMutexUpdate copies the fields changed by a "mutex-updated" event.
+func applyMutexUpdate(m *Mutex, data map[string]string) error {
+	if v, ok := data["description"]; ok {
+		m.Description = v
+	}
+	if v, ok := data["owner_team"]; ok {
+		m.OwnerTeam = v
+	}
+	if v, ok := data["labels"]; ok {
+		m.Labels = nil
+		if err := json.Unmarshal([]byte(v), &m.Labels); err != nil {
+			return errors.Wrap(err, "invalid labels")
+		}
+	}
+	if v, ok := data["links"]; ok {
+		m.Links = nil
+		if err := json.Unmarshal([]byte(v), &m.Links); err != nil {
+			return errors.Wrap(err, "invalid links")
+		}
+	}
+	return nil
+}
+
+// encodeMetadata returns the attribute values that should be set, and
+// the attributes that should be removed because they are now empty.
+func (s *DynamoStore) encodeMetadata(id string, u *MutexUpdate) (map[string]types.AttributeValue, error) {
+	changed := map[string]types.AttributeValue{}
+	if u.Description != nil {
+		encrypted, err := s.keys.encrypt(descriptionContext(id), *u.Description)
+		if err != nil {
+			return nil, err
+		}
+		changed["description"] = &types.AttributeValueMemberS{Value: encrypted}
+	}
+	if u.OwnerTeam != nil {
+		changed["owner_team"] = nil
+		if *u.OwnerTeam != "" {
+			changed["owner_team"] = &types.AttributeValueMemberS{Value: *u.OwnerTeam}
+		}
+	}
+	if u.Labels != nil {
+		changed["labels"] = nil
+		if len(u.Labels) > 0 {
+			changed["labels"] = &types.AttributeValueMemberSS{Value: u.Labels}
+		}
+	}
+	if u.Links != nil {
+		changed["links"] = nil
+		if len(u.Links) > 0 {
+			links := make(map[string]types.AttributeValue, len(u.Links))
+			for k, v := range u.Links {
+				links[k] = &types.AttributeValueMemberS{Value: v}
+			}
+			changed["links"] = &types.AttributeValueMemberM{Value: links}
+		}
+	}
+	return changed, nil
+}
+
+// putMetadata sets or removes metadata attributes, along with the
+// mutex's next event, unless the mutex changed after it was read. Nil
+// values are removed, since DynamoDB doesn't store empty sets.
+func (s *DynamoStore) putMetadata(
+	id string, expected int64, changed map[string]types.AttributeValue, e *event,
+) error {
+	fields := make([]string, 0, len(changed))
+	for field := range changed {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	update := "SET version = :version, chain = :chain, chain_expires = :chain_expires"
+	remove := ""
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{
+		":expected": &types.AttributeValueMemberN{
+			Value: strconv.FormatInt(expected, 10),
+		},
+		":version": &types.AttributeValueMemberN{
+			Value: strconv.FormatInt(e.Revision, 10),
+		},
+		":chain":         &types.AttributeValueMemberS{Value: e.Hash},
+		":chain_expires": e.chainExpires(),
+	}
+	for i, field := range fields {
+		name := "#f" + strconv.Itoa(i)
+		names[name] = field
+		if v := changed[field]; v != nil {
+			update += ", " + name + " = :f" + strconv.Itoa(i)
+			values[":f"+strconv.Itoa(i)] = v
+		} else if remove == "" {
+			remove = " REMOVE " + name
+		} else {
+			remove += ", " + name
+		}
+	}
+
+	t := s.newTransaction()
+	err := t.addUpdate(&types.Update{
+		TableName: s.table,
+		Key: map[string]types.AttributeValue{
+			"entity":   &types.AttributeValueMemberS{Value: id},
+			"revision": &types.AttributeValueMemberN{Value: "0"},
+		},
+		ConditionExpression:       aws.String("version = :expected"),
+		UpdateExpression:          aws.String(update + remove),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}).addEvent(s.table, e)
+	if err != nil {
+		return err
+	}
+
+	return t.exec(s.svc)
+}
+
+// encodeLinks sorts links by name, and encodes them the same way whether
+// or not they are nil.
+func encodeLinks(links map[string]string) string {
+	if links == nil {
+		links = map[string]string{}
+	}
+	b, _ := json.Marshal(links)
+	return string(b)
+}
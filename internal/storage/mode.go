@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/pkg/errors"
+)
+
+// LockMode controls whether a mutex can be held by more than one
+// requester at a time.
+type LockMode string
+
+const (
+	// LockExclusive allows a single holder, and is the default.
+	LockExclusive LockMode = "exclusive"
+	// LockShared allows any number of holders, as long as none of them
+	// needs the mutex exclusively.
+	LockShared LockMode = "shared"
+)
+
+func (mode LockMode) validate() (LockMode, error) {
+	switch mode {
+	case "":
+		return LockExclusive, nil
+	case LockExclusive, LockShared:
+		return mode, nil
+	}
+	return "", errors.Errorf("invalid lock mode: %q", mode)
+}
+
+// IsHolder reports whether the given user holds the mutex, in either mode.
+func (m *Mutex) IsHolder(slackID string) bool {
+	if m.Locked && m.LockedBy == slackID {
+		return true
+	}
+	for _, h := range m.Holders {
+		if h.SlackID == slackID {
+			return true
+		}
+	}
+	return false
+}
+
+// exclusiveLock builds an update that locks an unlocked mutex.
+func (s *DynamoStore) exclusiveLock(id, slackID, message string, e *event) (*types.Update, error) {
+	encrypted, err := s.keys.encrypt(messageContext(id), message)
+	if err != nil {
+		return nil, err
+	}
+	return &types.Update{
+		TableName: s.table,
+		Key: map[string]types.AttributeValue{
+			"entity":   &types.AttributeValueMemberS{Value: id},
+			"revision": &types.AttributeValueMemberN{Value: "0"},
+		},
+		ConditionExpression: aws.String(
+			"summary.locked <> :locked AND attribute_not_exists(locked_descendants)",
+		),
+		UpdateExpression: aws.String(`
+			SET summary.locked = :locked,
+			    summary.locked_by = :locked_by,
+			    summary.message = :message,
+			    summary.#mode = :mode,
+			    version = :version,
+			    chain = :chain,
+			    chain_expires = :chain_expires
+		`),
+		ExpressionAttributeNames: map[string]string{
+			"#mode": "mode",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":locked":    &types.AttributeValueMemberBOOL{Value: true},
+			":locked_by": &types.AttributeValueMemberS{Value: slackID},
+			":message":   &types.AttributeValueMemberS{Value: encrypted},
+			":mode":      &types.AttributeValueMemberS{Value: string(LockExclusive)},
+			":version": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(e.Revision, 10),
+			},
+			":chain":         &types.AttributeValueMemberS{Value: e.Hash},
+			":chain_expires": e.chainExpires(),
+		},
+	}, nil
+}
+
+// sharedLock builds an update that adds a shared holder to a mutex that is
+// unlocked, or that is only held by other shared holders.
+func (s *DynamoStore) sharedLock(id, slackID, message string, m *Mutex, e *event) (*types.Update, error) {
+	encrypted, err := s.keys.encrypt(holderContext(id), message)
+	if err != nil {
+		return nil, err
+	}
+	h, err := attributevalue.Marshal(&holder{
+		Message:  encrypted,
+		Acquired: e.Created,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	update := &types.Update{
+		TableName: s.table,
+		Key: map[string]types.AttributeValue{
+			"entity":   &types.AttributeValueMemberS{Value: id},
+			"revision": &types.AttributeValueMemberN{Value: "0"},
+		},
+		ExpressionAttributeNames: map[string]string{
+			"#mode": "mode",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":mode": &types.AttributeValueMemberS{Value: string(LockShared)},
+			":version": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(e.Revision, 10),
+			},
+			":chain":         &types.AttributeValueMemberS{Value: e.Hash},
+			":chain_expires": e.chainExpires(),
+		},
+	}
+	if !m.Locked {
+		update.ConditionExpression = aws.String(
+			"summary.locked <> :locked AND attribute_not_exists(locked_descendants)",
+		)
+		update.UpdateExpression = aws.String(`
+			SET summary.locked = :locked,
+			    summary.#mode = :mode,
+			    summary.holders = :holders,
+			    version = :version,
+			    chain = :chain,
+			    chain_expires = :chain_expires
+		`)
+		update.ExpressionAttributeValues[":locked"] = &types.AttributeValueMemberBOOL{Value: true}
+		update.ExpressionAttributeValues[":holders"] = &types.AttributeValueMemberM{
+			Value: map[string]types.AttributeValue{slackID: h},
+		}
+		return update, nil
+	}
+
+	update.ConditionExpression = aws.String(
+		"summary.#mode = :mode AND attribute_not_exists(summary.holders.#holder)",
+	)
+	update.UpdateExpression = aws.String(`
+		SET summary.holders.#holder = :holder,
+		    version = :version,
+		    chain = :chain,
+		    chain_expires = :chain_expires
+	`)
+	update.ExpressionAttributeNames["#holder"] = slackID
+	update.ExpressionAttributeValues[":holder"] = h
+	return update, nil
+}
+
+func removeHolder(holders []Holder, slackID string) ([]Holder, bool) {
+	for i, h := range holders {
+		if h.SlackID == slackID {
+			return append(holders[:i:i], holders[i+1:]...), true
+		}
+	}
+	return holders, false
+}
+
+// sortHolders orders holders by when they acquired a lock.
+func sortHolders(holders []Holder) {
+	sort.Slice(holders, func(i, j int) bool {
+		a, b := holders[i], holders[j]
+		if !a.Acquired.Equal(b.Acquired) {
+			return a.Acquired.Before(b.Acquired)
+		}
+		return a.SlackID < b.SlackID
+	})
+}
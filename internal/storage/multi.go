@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"sort"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/pkg/errors"
+
+	"github.com/sjansen/stopgap/internal/rqx"
+)
+
+// ErrTooManyMutexes is returned when more mutexes are locked at once than
+// fit in a single transaction.
+var ErrTooManyMutexes = errors.New("too many mutexes")
+
+// ErrNestedMutexes is returned when a mutex is locked along with one of
+// its ancestors.
+var ErrNestedMutexes = errors.New("unable to lock a mutex along with its ancestor")
+
+// transactWriteLimit is the most operations DynamoDB accepts in one
+// TransactWriteItems call.
+const transactWriteLimit = 100
+
+// LockMutexes exclusively locks all of the named mutexes, or none of them.
+// Each mutex gets its own event, and the events share an operation ID so
+// they can be linked later. If any of the mutexes is already locked, the
+// error names the first one found.
+func (s *DynamoStore) LockMutexes(rqx *rqx.RequestContext, names []string, message string) error {
+	tenant, err := tenantOf(rqx)
+	if err != nil {
+		return err
+	}
+
+	// Sorting makes the order of events, and errors, predictable.
+	names = uniqueNames(names)
+	sort.Strings(names)
+	opsPerMutex := 2
+	if s.outbox {
+		opsPerMutex++
+	}
+	if len(names) < 1 {
+		return nil
+	} else if len(names)*opsPerMutex > transactWriteLimit {
+		return errors.Wrapf(ErrTooManyMutexes,
+			"%d > %d", len(names), transactWriteLimit/opsPerMutex,
+		)
+	}
+	requested := make(map[string]bool, len(names))
+	for _, name := range names {
+		requested[name] = true
+	}
+	for _, name := range names {
+		for _, ancestor := range ancestorNames(name) {
+			if requested[ancestor] {
+				return errors.Wrapf(ErrNestedMutexes, "%s under %s", name, ancestor)
+			}
+		}
+	}
+
+	operation := ulid.Make().String()
+	slackID := rqx.EUser.SlackID
+	for i := 0; i < maxUpdateAttempts; i++ {
+		t := s.newTransaction()
+		ids := make([]string, 0, len(names))
+		for _, name := range names {
+			id := mutexEntityID(tenant, name)
+			item, m, err := s.readMutex(id)
+			if err != nil {
+				return errors.Wrap(err, name)
+			}
+			if m.Locked {
+				return errors.Wrap(ErrAlreadyLocked, name)
+			} else if len(m.LockedDescendants) > 0 {
+				return errors.Wrap(ErrAlreadyLocked, m.LockedDescendants[0])
+			}
+			ids = append(ids, id)
+
+			event, err := s.newEvent(rqx, id, item.Version+1, item.link,
+				"mutex-locked",
+				map[string]string{
+					"message":   message,
+					"mode":      string(LockExclusive),
+					"operation": operation,
+				},
+			)
+			if err != nil {
+				return err
+			}
+			update, err := s.exclusiveLock(id, slackID, message, event)
+			if err != nil {
+				return err
+			}
+			if err = t.addUpdate(update).addEvent(s.table, event); err != nil {
+				return err
+			}
+		}
+
+		ops, err := s.ancestorOps(ids, true)
+		if err != nil {
+			return err
+		}
+		for _, op := range ops {
+			t.add(op)
+		}
+		if len(t.ops) > transactWriteLimit {
+			return errors.Wrapf(ErrTooManyMutexes,
+				"%d operations > %d", len(t.ops), transactWriteLimit,
+			)
+		}
+
+		err = t.exec(s.svc)
+		for j, name := range names {
+			if conditionFailed(err, j*opsPerMutex) {
+				return errors.Wrap(ErrAlreadyLocked, name)
+			}
+		}
+		if !anyConditionFailed(err) {
+			return err
+		}
+		// the mutexes or their ancestors changed after they were read
+	}
+	return errors.New("mutexes changed too often to lock")
+}
+
+func uniqueNames(names []string) []string {
+	seen := make(map[string]bool, len(names))
+	result := make([]string, 0, len(names))
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+	}
+	return result
+}
@@ -0,0 +1,467 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/pkg/errors"
+)
+
+// Defaults used when a dispatcher doesn't specify its own values.
+const (
+	DefaultOutboxAttempts   = 8
+	DefaultOutboxBackoff    = 1 * time.Second
+	DefaultOutboxMaxBackoff = 5 * time.Minute
+	DefaultOutboxLease      = 1 * time.Minute
+)
+
+// Outbox entries are stored in a single partition, sorted by creation.
+const outboxEntityID = "outbox"
+
+const (
+	outboxPending = "pending"
+	outboxDead    = "dead"
+)
+
+// Notifier delivers a notification about an event. Returning an error
+// causes delivery to be retried later.
+type Notifier func(ctx context.Context, e *Event) error
+
+// OutboxEntry is a notification that hasn't been delivered.
+type OutboxEntry struct {
+	ID        int64
+	Created   time.Time
+	Entity    string
+	Revision  int64
+	Attempts  int
+	LastError string
+}
+
+// WithOutbox records an outbox entry for every event, in the same
+// transaction as the event, so that notifications aren't lost if the
+// process dies before sending them.
+func (s *DynamoStore) WithOutbox() *DynamoStore {
+	s.outbox = true
+	return s
+}
+
+// Dispatcher delivers outbox entries at least once. Failed deliveries are
+// retried with exponential backoff, until MaxAttempts is reached and the
+// entry becomes a dead letter.
+type Dispatcher struct {
+	MaxAttempts  int
+	Backoff      time.Duration
+	MaxBackoff   time.Duration
+	Lease        time.Duration
+	PollInterval time.Duration
+	// Now defaults to time.Now.
+	Now func() time.Time
+	// OnError is called with each error returned by Dispatch, which don't
+	// stop Run. By default they are ignored.
+	OnError func(error)
+
+	store  *DynamoStore
+	notify Notifier
+}
+
+// NewDispatcher creates a dispatcher using default values.
+func (s *DynamoStore) NewDispatcher(notify Notifier) *Dispatcher {
+	return &Dispatcher{
+		MaxAttempts:  DefaultOutboxAttempts,
+		Backoff:      DefaultOutboxBackoff,
+		MaxBackoff:   DefaultOutboxMaxBackoff,
+		Lease:        DefaultOutboxLease,
+		PollInterval: DefaultPollInterval,
+		store:        s,
+		notify:       notify,
+	}
+}
+
+// OutboxErrors is returned by Dispatch when some entries couldn't be
+// claimed or updated, indexed by entry ID. Entries whose lease expires
+// are retried, so they may be delivered again.
+type OutboxErrors map[int64]error
+
+func (e OutboxErrors) Error() string {
+	ids := make([]int64, 0, len(e))
+	for id := range e {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	msgs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		msgs = append(msgs, strconv.FormatInt(id, 10)+": "+e[id].Error())
+	}
+	return fmt.Sprintf("unable to dispatch %d outbox entries (%s)", len(e), strings.Join(msgs, "; "))
+}
+
+// Run dispatches entries until the context is canceled. Errors are passed
+// to OnError, and dispatching is tried again after PollInterval.
+func (d *Dispatcher) Run(ctx context.Context) error {
+	for {
+		if _, err := d.Dispatch(ctx); err != nil && d.OnError != nil {
+			d.OnError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d.PollInterval):
+		}
+	}
+}
+
+// Dispatch attempts to deliver every entry that is due, and returns the
+// number delivered. Failed deliveries are recorded on their entries
+// rather than returned. An entry that can't be claimed or updated doesn't
+// stop the others; their errors are returned together as OutboxErrors.
+func (d *Dispatcher) Dispatch(ctx context.Context) (int, error) {
+	now := d.now()
+	entries, err := d.store.queryOutbox(ctx,
+		"#status = :status AND next_attempt <= :now",
+		map[string]types.AttributeValue{
+			":status": &types.AttributeValueMemberS{Value: outboxPending},
+			":now": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(now.Unix(), 10),
+			},
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	failed := OutboxErrors{}
+	for _, entry := range entries {
+		ok, err := d.store.claimOutbox(ctx, entry, now.Add(d.Lease))
+		if err != nil {
+			failed[entry.Revision] = err
+			continue
+		} else if !ok {
+			continue
+		}
+		if err = d.deliver(ctx, entry); err == nil {
+			count++
+			err = d.store.deleteOutbox(ctx, entry)
+		} else {
+			err = d.store.failOutbox(ctx, entry, err, d.retryAt(now, entry.Attempts))
+		}
+		if err != nil {
+			failed[entry.Revision] = err
+		}
+	}
+	if len(failed) > 0 {
+		return count, failed
+	}
+	return count, nil
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, entry *outboxEntry) error {
+	e, err := d.store.getEvent(ctx, entry.EventEntity, entry.EventRevision)
+	if err != nil {
+		return err
+	}
+	return d.notify(ctx, e)
+}
+
+// retryAt returns when an entry should next be attempted, or the zero
+// time if it shouldn't be.
+func (d *Dispatcher) retryAt(now time.Time, attempts int) time.Time {
+	if attempts >= d.MaxAttempts {
+		return time.Time{}
+	}
+	delay := d.Backoff
+	for i := 1; i < attempts && delay < d.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.MaxBackoff {
+		delay = d.MaxBackoff
+	}
+	return now.Add(delay)
+}
+
+func (d *Dispatcher) now() time.Time {
+	if d.Now != nil {
+		return d.Now()
+	}
+	return time.Now()
+}
+
+// DeadLetters returns the entries that ran out of delivery attempts.
+func (s *DynamoStore) DeadLetters(ctx context.Context) ([]*OutboxEntry, error) {
+	entries, err := s.queryOutbox(ctx,
+		"#status = :status",
+		map[string]types.AttributeValue{
+			":status": &types.AttributeValueMemberS{Value: outboxDead},
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*OutboxEntry, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, &OutboxEntry{
+			ID:        e.Revision,
+			Created:   e.Created,
+			Entity:    e.EventEntity,
+			Revision:  e.EventRevision,
+			Attempts:  e.Attempts,
+			LastError: e.LastError,
+		})
+	}
+	return result, nil
+}
+
+// RequeueDeadLetter resets a dead letter so it will be delivered again.
+func (s *DynamoStore) RequeueDeadLetter(ctx context.Context, id int64) error {
+	_, err := s.svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           s.table,
+		Key:                 outboxKey(id),
+		ConditionExpression: aws.String("#status = :dead"),
+		UpdateExpression: aws.String(`
+			SET #status = :pending,
+			    attempts = :attempts,
+			    next_attempt = :now
+		`),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":dead":     &types.AttributeValueMemberS{Value: outboxDead},
+			":pending":  &types.AttributeValueMemberS{Value: outboxPending},
+			":attempts": &types.AttributeValueMemberN{Value: "0"},
+			":now": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(time.Now().Unix(), 10),
+			},
+		},
+	})
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return errors.New("dead letter not found: " + strconv.FormatInt(id, 10))
+		}
+	}
+	return err
+}
+
+// addOutbox records that notifications should be sent about an event.
+// IDs combine the creation time with random bits, so they sort roughly
+// in creation order. A collision fails the transaction rather than
+// overwriting another entry.
+func (t *writeTransaction) addOutbox(table *string, e *event) error {
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		return errors.Wrap(err, "unable to generate outbox ID")
+	}
+	id := e.Created.UnixMilli()<<20 | int64(binary.BigEndian.Uint32(random)&0xfffff)
+
+	item, err := attributevalue.MarshalMap(&outboxEntry{
+		base: base{
+			ID:       outboxEntityID,
+			Revision: id,
+		},
+		Created:       e.Created,
+		EventEntity:   e.ID,
+		EventRevision: e.Revision,
+		Status:        outboxPending,
+		NextAttempt:   e.Created,
+	})
+	if err != nil {
+		return err
+	}
+	t.addPut(&types.Put{
+		TableName: table,
+		Item:      item,
+		ConditionExpression: aws.String(
+			"attribute_not_exists(revision)",
+		),
+	})
+	return nil
+}
+
+func (s *DynamoStore) queryOutbox(
+	ctx context.Context,
+	filter string,
+	values map[string]types.AttributeValue,
+) ([]*outboxEntry, error) {
+	values[":entity"] = &types.AttributeValueMemberS{Value: outboxEntityID}
+	input := &dynamodb.QueryInput{
+		ConsistentRead:         aws.Bool(true),
+		TableName:              s.table,
+		KeyConditionExpression: aws.String("entity = :entity"),
+		FilterExpression:       aws.String(filter),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: values,
+	}
+
+	var entries []*outboxEntry
+	for {
+		result, err := s.svc.Query(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		page := make([]*outboxEntry, 0, len(result.Items))
+		if err = attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, err
+		}
+		entries = append(entries, page...)
+		if len(result.LastEvaluatedKey) == 0 {
+			return entries, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// claimOutbox counts a delivery attempt, and hides the entry from other
+// dispatchers until the lease expires. It returns false if another
+// dispatcher claimed the entry first.
+func (s *DynamoStore) claimOutbox(ctx context.Context, e *outboxEntry, lease time.Time) (bool, error) {
+	_, err := s.svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           s.table,
+		Key:                 outboxKey(e.Revision),
+		ConditionExpression: aws.String("#status = :pending AND attempts = :attempts"),
+		UpdateExpression: aws.String(`
+			SET attempts = :next,
+			    next_attempt = :lease
+		`),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pending": &types.AttributeValueMemberS{Value: outboxPending},
+			":attempts": &types.AttributeValueMemberN{
+				Value: strconv.Itoa(e.Attempts),
+			},
+			":next": &types.AttributeValueMemberN{
+				Value: strconv.Itoa(e.Attempts + 1),
+			},
+			":lease": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(lease.Unix(), 10),
+			},
+		},
+	})
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return false, nil
+		}
+		return false, err
+	}
+	e.Attempts++
+	return true, nil
+}
+
+func (s *DynamoStore) deleteOutbox(ctx context.Context, e *outboxEntry) error {
+	_, err := s.svc.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: s.table,
+		Key:       outboxKey(e.Revision),
+	})
+	return err
+}
+
+// failOutbox records a failed delivery. The entry becomes a dead letter
+// if retryAt is zero. Nothing is recorded if another dispatcher has since
+// claimed the entry.
+func (s *DynamoStore) failOutbox(ctx context.Context, e *outboxEntry, cause error, retryAt time.Time) error {
+	status, next := outboxPending, retryAt
+	if retryAt.IsZero() {
+		status, next = outboxDead, time.Now()
+	}
+	_, err := s.svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           s.table,
+		Key:                 outboxKey(e.Revision),
+		ConditionExpression: aws.String("attempts = :attempts"),
+		UpdateExpression: aws.String(`
+			SET #status = :status,
+			    next_attempt = :next,
+			    last_error = :error
+		`),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":attempts": &types.AttributeValueMemberN{
+				Value: strconv.Itoa(e.Attempts),
+			},
+			":status": &types.AttributeValueMemberS{Value: status},
+			":next": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(next.Unix(), 10),
+			},
+			":error": &types.AttributeValueMemberS{Value: cause.Error()},
+		},
+	})
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return nil
+		}
+	}
+	return err
+}
+
+func (s *DynamoStore) getEvent(ctx context.Context, id string, revision int64) (*Event, error) {
+	result, err := s.svc.GetItem(ctx, &dynamodb.GetItemInput{
+		ConsistentRead: aws.Bool(true),
+		TableName:      s.table,
+		Key: map[string]types.AttributeValue{
+			"entity": &types.AttributeValueMemberS{Value: id},
+			"revision": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(revision, 10),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, errors.New(
+			"event not found: " + id + "/" + strconv.FormatInt(revision, 10),
+		)
+	}
+
+	item := &event{}
+	if err := attributevalue.UnmarshalMap(result.Item, item); err != nil {
+		return nil, err
+	}
+	e, err := item.export()
+	if err != nil {
+		return nil, err
+	}
+	e.Data, err = s.keys.decryptData(eventContext(id, revision), e.Data)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func outboxKey(id int64) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"entity": &types.AttributeValueMemberS{Value: outboxEntityID},
+		"revision": &types.AttributeValueMemberN{
+			Value: strconv.FormatInt(id, 10),
+		},
+	}
+}
+
+type outboxEntry struct {
+	base
+	Created       time.Time `dynamodbav:"created,unixtime"`
+	EventEntity   string    `dynamodbav:"event_entity"`
+	EventRevision int64     `dynamodbav:"event_revision"`
+	Status        string    `dynamodbav:"status"`
+	Attempts      int       `dynamodbav:"attempts"`
+	NextAttempt   time.Time `dynamodbav:"next_attempt,unixtime"`
+	LastError     string    `dynamodbav:"last_error,omitempty"`
+}
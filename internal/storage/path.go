@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/pkg/errors"
+
+	"github.com/sjansen/stopgap/internal/rqx"
+)
+
+// ErrInvalidName is returned when creating a mutex, or a semaphore, alias
+// or group, whose name isn't a valid path.
+var ErrInvalidName = errors.New("invalid mutex name")
+
+// Mutex names are paths, like "prod/us-east/api". Locking a mutex freezes
+// everything underneath it, so a mutex can't be locked while any of its
+// ancestors or descendants are locked. Each ancestor keeps a set of its
+// locked descendants, which is updated in the same transaction that locks
+// or unlocks the descendant. Until an ancestor is created, its set is kept
+// in a placeholder entity, which the ancestor takes over when it's created.
+const pathSeparator = "/"
+
+// MutexTree rolls up the state of a mutex and its descendants.
+type MutexTree struct {
+	Name string
+	// Mutex is nil when the name is only a parent of other mutexes.
+	Mutex *Mutex
+	// Descendants are sorted by name.
+	Descendants []*Mutex
+	// Count and Locked include the mutex itself.
+	Count  int
+	Locked int
+	// FrozenBy is the name of the nearest locked ancestor, if any.
+	FrozenBy string
+}
+
+func validName(name string) error {
+	for _, part := range strings.Split(name, pathSeparator) {
+		if part == "" {
+			return errors.Wrapf(ErrInvalidName, "%q", name)
+		}
+	}
+	return nil
+}
+
+// ancestorNames returns the ancestors of a name, starting at the root.
+func ancestorNames(name string) []string {
+	var result []string
+	for i := range name {
+		if name[i] == pathSeparator[0] {
+			result = append(result, name[:i])
+		}
+	}
+	return result
+}
+
+// isDescendant reports whether name is underneath ancestor. Every name is
+// underneath the root, "".
+func isDescendant(name, ancestor string) bool {
+	return ancestor == "" || strings.HasPrefix(name, ancestor+pathSeparator)
+}
+
+// GetMutexTree returns the state of the named mutex and its descendants.
+// The name doesn't need to be a mutex, as long as it has descendants.
+func (s *DynamoStore) GetMutexTree(rqx *rqx.RequestContext, name string) (*MutexTree, error) {
+	mutexes, err := s.ListMutexes(rqx)
+	if err != nil {
+		return nil, err
+	}
+	tree := newMutexTree(mutexes, name)
+	if tree.Count < 1 {
+		return nil, ErrMutexNotFound
+	}
+	return tree, nil
+}
+
+// ListMutexTrees returns the state of each child of the named parent,
+// rolled up with the child's descendants, sorted by name. The children of
+// the root, "", are the top-level names.
+func (s *DynamoStore) ListMutexTrees(rqx *rqx.RequestContext, parent string) ([]*MutexTree, error) {
+	mutexes, err := s.ListMutexes(rqx)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := ""
+	if parent != "" {
+		prefix = parent + pathSeparator
+	}
+	var children []string
+	seen := map[string]bool{}
+	for _, m := range mutexes {
+		if !isDescendant(m.Name, parent) {
+			continue
+		}
+		child, _, _ := strings.Cut(m.Name[len(prefix):], pathSeparator)
+		child = prefix + child
+		if !seen[child] {
+			seen[child] = true
+			children = append(children, child)
+		}
+	}
+	sort.Strings(children)
+
+	result := make([]*MutexTree, 0, len(children))
+	for _, child := range children {
+		result = append(result, newMutexTree(mutexes, child))
+	}
+	return result, nil
+}
+
+// newMutexTree expects mutexes to be sorted by name.
+func newMutexTree(mutexes []*Mutex, name string) *MutexTree {
+	tree := &MutexTree{Name: name}
+	for _, m := range mutexes {
+		switch {
+		case m.Name == name:
+			tree.Mutex = m
+		case isDescendant(m.Name, name):
+			tree.Descendants = append(tree.Descendants, m)
+		default:
+			if m.Locked && isDescendant(name, m.Name) {
+				// ancestors sort first, so the nearest one wins
+				tree.FrozenBy = m.Name
+			}
+			continue
+		}
+		tree.Count++
+		if m.Locked {
+			tree.Locked++
+		}
+	}
+	return tree
+}
+
+// descendants is the placeholder that holds the locked descendants of a
+// mutex that doesn't exist yet.
+type descendants struct {
+	entity
+	LockedDescendants []string `dynamodbav:"locked_descendants,stringset,omitempty"`
+}
+
+func descendantsEntityID(tenant, name string) string {
+	return entityID(tenant, "descendants", name)
+}
+
+// getDescendants returns the placeholder for the named mutex, with version
+// 0 if none of its descendants have been locked.
+func (s *DynamoStore) getDescendants(tenant, name string) (*descendants, error) {
+	id := descendantsEntityID(tenant, name)
+	item := &descendants{}
+	if _, err := s.getEntity(id, "entity, version, locked_descendants", true, item); err != nil {
+		return nil, err
+	}
+	item.ID = id
+	sort.Strings(item.LockedDescendants)
+	return item, nil
+}
+
+// takeOver removes a mutex's placeholder when the mutex is created, and
+// fails if the placeholder changed after it was read.
+func (d *descendants) takeOver(table *string) types.TransactWriteItem {
+	key := map[string]types.AttributeValue{
+		"entity":   &types.AttributeValueMemberS{Value: d.ID},
+		"revision": &types.AttributeValueMemberN{Value: "0"},
+	}
+	if d.Version == 0 {
+		return types.TransactWriteItem{
+			ConditionCheck: &types.ConditionCheck{
+				TableName:           table,
+				Key:                 key,
+				ConditionExpression: aws.String("attribute_not_exists(entity)"),
+			},
+		}
+	}
+	return types.TransactWriteItem{
+		Delete: &types.Delete{
+			TableName:           table,
+			Key:                 key,
+			ConditionExpression: aws.String("version = :version"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":version": &types.AttributeValueMemberN{
+					Value: strconv.FormatInt(d.Version, 10),
+				},
+			},
+		},
+	}
+}
+
+// lockedAncestor returns the name of the nearest locked ancestor of a
+// mutex, or "" if none of its ancestors are locked.
+func (s *DynamoStore) lockedAncestor(id string) (string, error) {
+	tenant, name := entityName(id)
+	ancestors := ancestorNames(name)
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		item, err := s.getMutex(mutexEntityID(tenant, ancestors[i]), "summary", true)
+		if errors.Is(err, ErrMutexNotFound) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if item.Summary.Locked {
+			return ancestors[i], nil
+		}
+	}
+	return "", nil
+}
+
+// ancestorOps returns the operations that record mutexes as locked, or
+// unlocked, in each of their ancestors, or in the placeholders of the
+// ancestors that don't exist. When locking, the operations fail if an
+// ancestor has been locked. Either way, they fail if an ancestor that
+// didn't exist has been created, so the change can be restarted.
+func (s *DynamoStore) ancestorOps(ids []string, lock bool) ([]types.TransactWriteItem, error) {
+	descendants := map[string][]string{}
+	for _, id := range ids {
+		tenant, name := entityName(id)
+		for _, ancestor := range ancestorNames(name) {
+			ancestorID := mutexEntityID(tenant, ancestor)
+			descendants[ancestorID] = append(descendants[ancestorID], name)
+		}
+	}
+	ancestors := make([]string, 0, len(descendants))
+	for id := range descendants {
+		ancestors = append(ancestors, id)
+	}
+	sort.Strings(ancestors)
+
+	ops := make([]types.TransactWriteItem, 0, len(ancestors))
+	for _, id := range ancestors {
+		key := map[string]types.AttributeValue{
+			"entity":   &types.AttributeValueMemberS{Value: id},
+			"revision": &types.AttributeValueMemberN{Value: "0"},
+		}
+		names := &types.AttributeValueMemberSS{Value: descendants[id]}
+		item, err := s.getMutex(id, "summary", true)
+		if errors.Is(err, ErrMutexNotFound) {
+			tenant, name := entityName(id)
+			update := "SET entity_type = :type ADD version :one, locked_descendants :names"
+			if !lock {
+				update = "SET entity_type = :type ADD version :one DELETE locked_descendants :names"
+			}
+			ops = append(ops, types.TransactWriteItem{
+				ConditionCheck: &types.ConditionCheck{
+					TableName:           s.table,
+					Key:                 key,
+					ConditionExpression: aws.String("attribute_not_exists(entity)"),
+				},
+			}, types.TransactWriteItem{
+				Update: &types.Update{
+					TableName: s.table,
+					Key: map[string]types.AttributeValue{
+						"entity":   &types.AttributeValueMemberS{Value: descendantsEntityID(tenant, name)},
+						"revision": &types.AttributeValueMemberN{Value: "0"},
+					},
+					UpdateExpression: aws.String(update),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":type":  &types.AttributeValueMemberS{Value: "descendants"},
+						":one":   &types.AttributeValueMemberN{Value: "1"},
+						":names": names,
+					},
+				},
+			})
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if !lock {
+			ops = append(ops, types.TransactWriteItem{
+				Update: &types.Update{
+					TableName:           s.table,
+					Key:                 key,
+					ConditionExpression: aws.String("attribute_exists(entity)"),
+					UpdateExpression:    aws.String("DELETE locked_descendants :names"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":names": names,
+					},
+				},
+			})
+			continue
+		}
+
+		if item.Summary.Locked {
+			_, name := entityName(id)
+			return nil, errors.Wrap(ErrAlreadyLocked, name)
+		}
+		ops = append(ops, types.TransactWriteItem{
+			Update: &types.Update{
+				TableName: s.table,
+				Key:       key,
+				ConditionExpression: aws.String(
+					"attribute_exists(entity) AND summary.locked <> :locked",
+				),
+				UpdateExpression: aws.String("ADD locked_descendants :names"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":locked": &types.AttributeValueMemberBOOL{Value: true},
+					":names":  names,
+				},
+			},
+		})
+	}
+	return ops, nil
+}
+
+// anyConditionFailed reports whether a transaction was canceled because
+// the condition on any of its operations wasn't met.
+func anyConditionFailed(err error) bool {
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		return false
+	}
+	for _, reason := range canceled.CancellationReasons {
+		if aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+			return true
+		}
+	}
+	return false
+}
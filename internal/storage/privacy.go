@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/oklog/ulid/v2"
+	"github.com/pkg/errors"
+)
+
+// Fields that can be redacted from events.
+const (
+	redactRemoteAddr = "client.remote_addr"
+	redactUserAgent  = "client.user_agent"
+	redactEUserName  = "euser.name"
+	redactRUserName  = "ruser.name"
+)
+
+// RetentionPolicy controls how long identifying details are kept in event
+// history. A zero duration keeps them until the event expires.
+type RetentionPolicy struct {
+	// ClientDetails is how long an event keeps the remote address and
+	// user agent of the client that caused it.
+	ClientDetails time.Duration
+}
+
+// ApplyRetentionPolicy redacts identifying details that are older than the
+// policy allows, and returns the number of events changed. The action and
+// the IDs of the users involved are kept. Redacted details are replaced
+// by their salted digests, so the hash chain can still be verified, and
+// their salts are removed, so the details can't be recovered by guessing.
+func (s *DynamoStore) ApplyRetentionPolicy(p RetentionPolicy, now time.Time) (int, error) {
+	if p.ClientDetails <= 0 {
+		return 0, nil
+	}
+
+	events, err := s.scanEvents(
+		`attribute_exists(#type) AND created < :cutoff AND (
+			attribute_exists(#client.remote_addr) OR
+			attribute_exists(#client.user_agent)
+		)`,
+		map[string]string{
+			"#client": "client",
+			"#type":   "type",
+		},
+		map[string]types.AttributeValue{
+			":cutoff": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(now.Add(-p.ClientDetails).Unix(), 10),
+			},
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, e := range events {
+		ok, err := s.redactEvent(e, redactRemoteAddr, redactUserAgent)
+		if err != nil {
+			return count, err
+		}
+		if ok {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// EraseUser redacts the name of the given user from event history, along
+// with the client details of every request they made, and returns the
+// number of events changed. The user's IDs are kept so the history stays
+// auditable. Free-form event data, like lock messages, isn't changed.
+func (s *DynamoStore) EraseUser(uid ulid.ULID) (int, error) {
+	events, err := s.scanUserEvents(uid)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, e := range events {
+		var fields []string
+		if e.EUser.UID == uid.String() {
+			fields = append(fields, redactEUserName)
+		}
+		if e.RUser.UID == uid.String() {
+			fields = append(fields, redactRUserName, redactRemoteAddr, redactUserAgent)
+		}
+		ok, err := s.redactEvent(e, fields...)
+		if err != nil {
+			return count, err
+		}
+		if ok {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// ExportUser returns every event that involves the given user.
+func (s *DynamoStore) ExportUser(uid ulid.ULID) ([]*Event, error) {
+	items, err := s.scanUserEvents(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]*Event, 0, len(items))
+	for _, item := range items {
+		e, err := item.export()
+		if err != nil {
+			return nil, err
+		}
+		e.Data, err = s.keys.decryptData(eventContext(item.ID, e.Revision), e.Data)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func (s *DynamoStore) scanUserEvents(uid ulid.ULID) ([]*event, error) {
+	return s.scanEvents(
+		"#euser.#uid = :uid OR #ruser.#uid = :uid",
+		map[string]string{
+			"#euser": "euser",
+			"#ruser": "ruser",
+			"#uid":   "uid",
+		},
+		map[string]types.AttributeValue{
+			":uid": &types.AttributeValueMemberS{Value: uid.String()},
+		},
+	)
+}
+
+func (s *DynamoStore) scanEvents(
+	filter string,
+	names map[string]string,
+	values map[string]types.AttributeValue,
+) ([]*event, error) {
+	input := &dynamodb.ScanInput{
+		TableName:                 s.table,
+		FilterExpression:          aws.String(filter),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}
+
+	var events []*event
+	for {
+		// TODO: thread ctx
+		result, err := s.svc.Scan(context.TODO(), input)
+		if err != nil {
+			return nil, err
+		}
+		page := make([]*event, 0, len(result.Items))
+		if err = attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, err
+		}
+		events = append(events, page...)
+		if len(result.LastEvaluatedKey) == 0 {
+			return events, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// redactEvent removes fields from an event, recording their digests and
+// removing their salts. It returns false if there was nothing to remove,
+// or if the event changed after it was read.
+func (s *DynamoStore) redactEvent(e *event, fields ...string) (bool, error) {
+	redacted := make(map[string]string, len(e.Redacted)+len(fields))
+	for k, v := range e.Redacted {
+		redacted[k] = v
+	}
+	names := map[string]string{
+		"#hash": "hash",
+	}
+	var paths []string
+	for i, field := range fields {
+		value, parent, attr := e.identifyingDetail(field)
+		if value == "" {
+			continue
+		}
+		redacted[field] = digest(e.Salts[field], value)
+		names["#"+parent] = parent
+		names["#"+attr] = attr
+		paths = append(paths, "#"+parent+".#"+attr)
+		if _, ok := e.Salts[field]; ok {
+			salt := "#salt" + strconv.Itoa(i)
+			names["#salts"] = "salts"
+			names[salt] = field
+			paths = append(paths, "#salts."+salt)
+		}
+	}
+	if len(paths) < 1 {
+		return false, nil
+	}
+
+	value, err := attributevalue.Marshal(redacted)
+	if err != nil {
+		return false, err
+	}
+	values := map[string]types.AttributeValue{
+		":redacted": value,
+	}
+	condition := "attribute_not_exists(#hash)"
+	if e.Hash != "" {
+		condition = "#hash = :hash"
+		values[":hash"] = &types.AttributeValueMemberS{Value: e.Hash}
+	}
+
+	// TODO: thread ctx
+	_, err = s.svc.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: s.table,
+		Key: map[string]types.AttributeValue{
+			"entity": &types.AttributeValueMemberS{Value: e.ID},
+			"revision": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(e.Revision, 10),
+			},
+		},
+		ConditionExpression: aws.String(condition),
+		UpdateExpression: aws.String(
+			"SET redacted = :redacted REMOVE " + strings.Join(paths, ", "),
+		),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// salt generates a random salt for each identifying detail of a new event.
+func (e *event) salt() error {
+	for _, field := range []string{
+		redactRemoteAddr, redactUserAgent, redactEUserName, redactRUserName,
+	} {
+		if value, _, _ := e.identifyingDetail(field); value == "" {
+			continue
+		}
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+		if e.Salts == nil {
+			e.Salts = make(map[string]string)
+		}
+		e.Salts[field] = hex.EncodeToString(salt)
+	}
+	return nil
+}
+
+// identifyingDetail returns the value of a redactable field, and the
+// attribute it is stored in.
+func (e *event) identifyingDetail(field string) (value, parent, attr string) {
+	switch field {
+	case redactRemoteAddr:
+		return e.Client.RemoteAddr, "client", "remote_addr"
+	case redactUserAgent:
+		return e.Client.UserAgent, "client", "user_agent"
+	case redactEUserName:
+		return e.EUser.Name, "euser", "name"
+	case redactRUserName:
+		return e.RUser.Name, "ruser", "name"
+	}
+	return "", "", ""
+}
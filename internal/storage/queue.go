@@ -0,0 +1,343 @@
+package storage
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/pkg/errors"
+
+	"github.com/sjansen/stopgap/internal/rqx"
+)
+
+// ErrNotQueued is returned when the requester isn't waiting for a mutex.
+var ErrNotQueued = errors.New("not waiting for mutex")
+
+// maxUpdateAttempts limits how many times a change based on the current
+// state of a mutex is restarted because the mutex changed first.
+const maxUpdateAttempts = 3
+
+// Waiter is a request to lock a mutex as soon as it is unlocked.
+type Waiter struct {
+	SlackID  string
+	Message  string
+	Mode     LockMode
+	Enqueued time.Time
+	Expires  time.Time
+}
+
+type waiter struct {
+	SlackID  string    `dynamodbav:"slack_id"`
+	Message  string    `dynamodbav:"message,omitempty"`
+	Mode     LockMode  `dynamodbav:"mode,omitempty"`
+	Enqueued time.Time `dynamodbav:"enqueued,unixtime"`
+	Expires  time.Time `dynamodbav:"expires,unixtime"`
+}
+
+// Waiting returns the requesters waiting for the mutex whose entries
+// haven't expired, in the order they will be given the lock.
+func (m *Mutex) Waiting(now time.Time) []Waiter {
+	var result []Waiter
+	for _, w := range m.Queue {
+		if now.Before(w.Expires) {
+			result = append(result, w)
+		}
+	}
+	return result
+}
+
+// QueuePosition returns the position of the given user in the mutex's
+// wait queue, starting at 1, or 0 if they aren't waiting.
+func (m *Mutex) QueuePosition(slackID string, now time.Time) int {
+	for i, w := range m.Waiting(now) {
+		if w.SlackID == slackID {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// WaitForMutex locks the named mutex if it can be locked in the given
+// mode, and otherwise adds the requester to the end of its wait queue
+// until ttl has passed. It returns the requester's position in the queue,
+// or 0 if the mutex was locked. Requesters that are already waiting keep
+// their place. Requesters can't wait while an ancestor or descendant of
+// the mutex is locked, because the mutex wouldn't be handed to them when
+// it's unlocked, so ErrAlreadyLocked is returned instead.
+func (s *DynamoStore) WaitForMutex(
+	rqx *rqx.RequestContext, name, message string, mode LockMode, ttl time.Duration,
+) (int, error) {
+	mode, err := mode.validate()
+	if err != nil {
+		return 0, err
+	}
+	if ttl <= 0 {
+		return 0, errors.New("queue TTL must be positive")
+	}
+	id, err := mutexID(rqx, name)
+	if err != nil {
+		return 0, err
+	}
+
+	slackID := rqx.EUser.SlackID
+	for i := 0; i < maxUpdateAttempts; i++ {
+		item, m, err := s.readMutex(id)
+		if err != nil {
+			return 0, err
+		}
+
+		now := time.Now()
+		switch {
+		case m.IsHolder(slackID):
+			return 0, ErrAlreadyLocked
+		case len(m.LockedDescendants) > 0:
+			return 0, errors.Wrap(ErrAlreadyLocked, m.LockedDescendants[0])
+		case !m.Locked:
+			if ancestor, err := s.lockedAncestor(id); err != nil {
+				return 0, err
+			} else if ancestor != "" {
+				return 0, errors.Wrap(ErrAlreadyLocked, ancestor)
+			}
+			fallthrough
+		case m.Mode == LockShared && mode == LockShared && len(m.Waiting(now)) < 1:
+			err = s.LockMutex(rqx, name, message, mode)
+			if errors.Is(err, ErrAlreadyLocked) {
+				continue
+			}
+			return 0, err
+		}
+		if position := m.QueuePosition(slackID, now); position > 0 {
+			return position, nil
+		}
+
+		expires := now.Add(ttl)
+		event, err := s.newEvent(rqx, id, item.Version+1, item.link,
+			"mutex-queue-joined",
+			map[string]string{
+				"message": message,
+				"mode":    string(mode),
+				"expires": strconv.FormatInt(expires.Unix(), 10),
+			},
+		)
+		if err != nil {
+			return 0, err
+		}
+		m.Queue = append(removeWaiter(m.Queue, slackID), Waiter{
+			SlackID:  slackID,
+			Message:  message,
+			Mode:     mode,
+			Enqueued: event.Created,
+			Expires:  expires,
+		})
+
+		err = s.putSummary(id, item.Version, m, event)
+		if conditionFailed(err, 0) {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		return m.QueuePosition(slackID, now), nil
+	}
+	return 0, errors.New("mutex changed too often to wait: " + id)
+}
+
+// LeaveQueue removes the requester from the named mutex's wait queue.
+func (s *DynamoStore) LeaveQueue(rqx *rqx.RequestContext, name string) error {
+	id, err := mutexID(rqx, name)
+	if err != nil {
+		return err
+	}
+
+	slackID := rqx.EUser.SlackID
+	for i := 0; i < maxUpdateAttempts; i++ {
+		item, m, err := s.readMutex(id)
+		if err != nil {
+			return err
+		}
+		if m.QueuePosition(slackID, time.Now()) < 1 {
+			return ErrNotQueued
+		}
+
+		event, err := s.newEvent(rqx, id, item.Version+1, item.link,
+			"mutex-queue-left",
+			map[string]string{},
+		)
+		if err != nil {
+			return err
+		}
+		m.Queue = removeWaiter(m.Queue, slackID)
+
+		err = s.putSummary(id, item.Version, m, event)
+		if !conditionFailed(err, 0) {
+			return err
+		}
+	}
+	return errors.New("mutex changed too often to leave queue: " + id)
+}
+
+// GetQueuePosition returns the requester's position in the named mutex's
+// wait queue, starting at 1.
+func (s *DynamoStore) GetQueuePosition(rqx *rqx.RequestContext, name string) (int, error) {
+	m, err := s.GetMutex(rqx, name, true)
+	if err != nil {
+		return 0, err
+	}
+	position := m.QueuePosition(rqx.EUser.SlackID, time.Now())
+	if position < 1 {
+		return 0, ErrNotQueued
+	}
+	return position, nil
+}
+
+// handOff gives the lock to the first waiter that hasn't expired. Waiters
+// ahead of it have expired, and are dropped.
+func handOff(m *Mutex, now time.Time) (*Waiter, bool) {
+	for i, w := range m.Queue {
+		if now.Before(w.Expires) {
+			m.Queue = m.Queue[i+1:]
+			return &w, true
+		}
+	}
+	return nil, false
+}
+
+// giveLock makes a waiter the mutex's only holder.
+func giveLock(m *Mutex, w *Waiter, now time.Time) {
+	m.Locked = true
+	m.LockedBy = ""
+	m.Message = ""
+	m.Holders = nil
+	m.Mode = w.Mode
+	if m.Mode == "" {
+		m.Mode = LockExclusive
+	}
+	if m.Mode == LockShared {
+		m.Holders = []Holder{{
+			SlackID:  w.SlackID,
+			Message:  w.Message,
+			Acquired: now,
+		}}
+	} else {
+		m.LockedBy = w.SlackID
+		m.Message = w.Message
+	}
+}
+
+func removeWaiter(queue []Waiter, slackID string) []Waiter {
+	result := make([]Waiter, 0, len(queue))
+	for _, w := range queue {
+		if w.SlackID != slackID {
+			result = append(result, w)
+		}
+	}
+	return result
+}
+
+func (s *DynamoStore) readMutex(id string) (*mutex, *Mutex, error) {
+	item, err := s.getMutex(id, "version, chain, chain_expires, summary, locked_descendants", true)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := s.exportMutex(id, item)
+	if err != nil {
+		return nil, nil, err
+	}
+	return item, m, nil
+}
+
+// putSummary replaces the summary of a mutex, along with its next event,
+// unless the mutex changed after it was read.
+func (s *DynamoStore) putSummary(
+	id string, expected int64, m *Mutex, e *event, related ...types.TransactWriteItem,
+) error {
+	summary, err := s.encodeSummary(id, m)
+	if err != nil {
+		return err
+	}
+	return s.putState(id, expected, summary, e, related...)
+}
+
+// putState replaces the summary of any entity, along with its next event,
+// unless the entity changed after it was read. Related operations are
+// applied in the same transaction.
+func (s *DynamoStore) putState(
+	id string, expected int64, summary types.AttributeValue, e *event, related ...types.TransactWriteItem,
+) error {
+	t := s.newTransaction()
+	err := t.addUpdate(&types.Update{
+		TableName: s.table,
+		Key: map[string]types.AttributeValue{
+			"entity":   &types.AttributeValueMemberS{Value: id},
+			"revision": &types.AttributeValueMemberN{Value: "0"},
+		},
+		ConditionExpression: aws.String("version = :expected"),
+		UpdateExpression: aws.String(`
+			SET summary = :summary,
+			    version = :version,
+			    chain = :chain,
+			    chain_expires = :chain_expires
+		`),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":expected": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(expected, 10),
+			},
+			":summary": summary,
+			":version": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(e.Revision, 10),
+			},
+			":chain":         &types.AttributeValueMemberS{Value: e.Hash},
+			":chain_expires": e.chainExpires(),
+		},
+	}).addEvent(s.table, e)
+	if err != nil {
+		return err
+	}
+	for _, op := range related {
+		t.add(op)
+	}
+
+	return t.exec(s.svc)
+}
+
+// encodeSummary encrypts and marshals the summary of a mutex.
+func (s *DynamoStore) encodeSummary(id string, m *Mutex) (types.AttributeValue, error) {
+	message, err := s.keys.encrypt(messageContext(id), m.Message)
+	if err != nil {
+		return nil, err
+	}
+	summary := &mutexSummary{
+		Locked:   m.Locked,
+		LockedBy: m.LockedBy,
+		Message:  message,
+		Mode:     m.Mode,
+	}
+	if len(m.Holders) > 0 {
+		summary.Holders = make(map[string]holder, len(m.Holders))
+	}
+	for _, h := range m.Holders {
+		message, err := s.keys.encrypt(holderContext(id), h.Message)
+		if err != nil {
+			return nil, err
+		}
+		summary.Holders[h.SlackID] = holder{
+			Message:  message,
+			Acquired: h.Acquired,
+		}
+	}
+	for _, w := range m.Queue {
+		message, err := s.keys.encrypt(waitingContext(id), w.Message)
+		if err != nil {
+			return nil, err
+		}
+		summary.Waiting = append(summary.Waiting, waiter{
+			SlackID:  w.SlackID,
+			Message:  message,
+			Mode:     w.Mode,
+			Enqueued: w.Enqueued,
+			Expires:  w.Expires,
+		})
+	}
+	return attributevalue.Marshal(summary)
+}
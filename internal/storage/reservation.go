@@ -0,0 +1,407 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/oklog/ulid/v2"
+	"github.com/pkg/errors"
+
+	"github.com/sjansen/stopgap/internal/rqx"
+)
+
+// ErrReservationConflict is returned when a reservation overlaps another
+// reservation for the same mutex.
+var ErrReservationConflict = errors.New("reservation conflict")
+
+// ErrReservationNotFound is returned when the requester doesn't have a
+// reservation with the given ID.
+var ErrReservationNotFound = errors.New("reservation not found")
+
+// Reservation books a mutex for a future time slot. The mutex is locked
+// for the requester when the slot starts, and unlocked when it ends.
+type Reservation struct {
+	ID      string
+	Mutex   string
+	SlackID string
+	Message string
+	Start   time.Time
+	End     time.Time
+	// Started is true once the mutex has been locked for the reservation.
+	Started bool
+}
+
+// Each mutex's reservations are kept together in a single entity, so
+// conflicts can be detected by a single conditional write. While it has
+// reservations, the entity is in the schedule index, sorted by when its
+// next reservation is due to start or end.
+type reservations struct {
+	entity
+	link
+	Summary reservationSummary `dynamodbav:"summary"`
+}
+
+type reservationSummary struct {
+	Reservations []reservation `dynamodbav:"reservations,omitempty"`
+}
+
+type reservation struct {
+	ID      string    `dynamodbav:"id"`
+	UID     string    `dynamodbav:"uid,omitempty"`
+	SlackID string    `dynamodbav:"slack_id"`
+	Message string    `dynamodbav:"message,omitempty"`
+	Start   time.Time `dynamodbav:"start,unixtime"`
+	End     time.Time `dynamodbav:"end,unixtime"`
+	Started bool      `dynamodbav:"started,omitempty"`
+}
+
+// ReserveMutex books the named mutex from start until end. Reservations
+// for the same mutex can't overlap.
+func (s *DynamoStore) ReserveMutex(
+	rqx *rqx.RequestContext, name, message string, start, end time.Time,
+) (*Reservation, error) {
+	start, end = start.Truncate(time.Second), end.Truncate(time.Second)
+	if !start.Before(end) {
+		return nil, errors.New("reservations must end after they start")
+	} else if !end.After(time.Now()) {
+		return nil, errors.New("reservations must end in the future")
+	}
+	tenant, err := tenantOf(rqx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.getMutex(mutexEntityID(tenant, name), "entity", true); err != nil {
+		return nil, err
+	}
+
+	r := reservation{
+		ID:      ulid.Make().String(),
+		UID:     rqx.EUser.UID.String(),
+		SlackID: rqx.EUser.SlackID,
+		Message: message,
+		Start:   start,
+		End:     end,
+	}
+	id := entityID(tenant, "reservations", name)
+	err = s.updateReservations(rqx, id, func(list []reservation) ([]reservation, string, map[string]string, error) {
+		for _, other := range list {
+			if start.Before(other.End) && other.Start.Before(end) {
+				return nil, "", nil, errors.Wrapf(ErrReservationConflict,
+					"%s to %s", other.Start.UTC().Format(time.RFC3339), other.End.UTC().Format(time.RFC3339),
+				)
+			}
+		}
+		return append(list, r), "reservation-created", map[string]string{
+			"id":      r.ID,
+			"message": message,
+			"start":   strconv.FormatInt(start.Unix(), 10),
+			"end":     strconv.FormatInt(end.Unix(), 10),
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.export(name), nil
+}
+
+// CancelReservation removes one of the requester's reservations for the
+// named mutex. Reservations that have started can't be canceled, but the
+// mutex can be unlocked early instead.
+func (s *DynamoStore) CancelReservation(rqx *rqx.RequestContext, name, reservationID string) error {
+	id, err := tenantEntityID(rqx, "reservations", name)
+	if err != nil {
+		return err
+	}
+	slackID := rqx.EUser.SlackID
+	return s.updateReservations(rqx, id, func(list []reservation) ([]reservation, string, map[string]string, error) {
+		for i, r := range list {
+			if r.ID != reservationID || r.SlackID != slackID {
+				continue
+			} else if r.Started {
+				return nil, "", nil, errors.New("reservation already started: " + r.ID)
+			}
+			return append(list[:i:i], list[i+1:]...), "reservation-canceled", map[string]string{
+				"id": r.ID,
+			}, nil
+		}
+		return nil, "", nil, ErrReservationNotFound
+	})
+}
+
+// ListReservations returns the named mutex's reservations that haven't
+// ended, sorted by when they start.
+func (s *DynamoStore) ListReservations(rqx *rqx.RequestContext, name string) ([]*Reservation, error) {
+	tenant, err := tenantOf(rqx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.getMutex(mutexEntityID(tenant, name), "entity", false); err != nil {
+		return nil, err
+	}
+	item, err := s.getReservations(entityID(tenant, "reservations", name))
+	if err != nil {
+		return nil, err
+	}
+	list, err := s.exportReservations(item)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	result := make([]*Reservation, 0, len(list))
+	for _, r := range list {
+		if r.End.After(now) {
+			result = append(result, r.export(name))
+		}
+	}
+	return result, nil
+}
+
+// GetReservationHistory returns the events recorded for the named mutex's
+// reservations, oldest first.
+func (s *DynamoStore) GetReservationHistory(rqx *rqx.RequestContext, name string, consistent bool) ([]*Event, error) {
+	id, err := tenantEntityID(rqx, "reservations", name)
+	if err != nil {
+		return nil, err
+	}
+	return s.getHistory(id, consistent)
+}
+
+// updateReservations applies a change to a mutex's reservations, and
+// records it as an event. The change is restarted if the reservations are
+// changed by someone else first.
+func (s *DynamoStore) updateReservations(
+	rqx *rqx.RequestContext,
+	id string,
+	change func([]reservation) ([]reservation, string, map[string]string, error),
+) error {
+	for i := 0; i < maxUpdateAttempts; i++ {
+		item, err := s.getReservations(id)
+		if err != nil {
+			return err
+		}
+		list, err := s.exportReservations(item)
+		if err != nil {
+			return err
+		}
+
+		list, typ, data, err := change(list)
+		if err != nil {
+			return err
+		}
+		event, err := s.newEvent(rqx, id, item.Version+1, item.link, typ, data)
+		if err != nil {
+			return err
+		}
+		summary, err := s.encodeReservations(id, list)
+		if err != nil {
+			return err
+		}
+
+		due := nextDue(list)
+		if item.Version == 0 {
+			err = s.createReservations(id, summary, due, event)
+			if conditionFailed(err, 0) {
+				continue
+			}
+			return err
+		}
+		err = s.putReservations(id, item.Version, summary, due, event)
+		if !conditionFailed(err, 0) {
+			return err
+		}
+	}
+	return errors.New("reservations changed too often to update: " + id)
+}
+
+func (s *DynamoStore) createReservations(id string, summary types.AttributeValue, due time.Time, e *event) error {
+	tenant, _ := splitEntityID(id)
+	item := s.newNamedItem(tenant, "reservations", id, e)
+	item["summary"] = summary
+	if !due.IsZero() {
+		item["schedule"] = &types.AttributeValueMemberS{Value: scheduleReservations}
+		item["due"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(due.Unix(), 10)}
+	}
+
+	t := s.newTransaction()
+	err := t.addPut(&types.Put{
+		Item:                item,
+		TableName:           s.table,
+		ConditionExpression: aws.String("attribute_not_exists(entity)"),
+	}).addEvent(s.table, e)
+	if err != nil {
+		return err
+	}
+	return t.exec(s.svc)
+}
+
+// putReservations replaces a mutex's reservations, along with its next
+// event, unless they changed after they were read. A zero due time removes
+// them from the schedule index.
+func (s *DynamoStore) putReservations(
+	id string, expected int64, summary types.AttributeValue, due time.Time, e *event,
+) error {
+	update := `
+		SET summary = :summary,
+		    version = :version,
+		    chain = :chain,
+		    chain_expires = :chain_expires,
+		    schedule = :schedule,
+		    due = :due
+	`
+	values := map[string]types.AttributeValue{
+		":expected": &types.AttributeValueMemberN{
+			Value: strconv.FormatInt(expected, 10),
+		},
+		":summary": summary,
+		":version": &types.AttributeValueMemberN{
+			Value: strconv.FormatInt(e.Revision, 10),
+		},
+		":chain":         &types.AttributeValueMemberS{Value: e.Hash},
+		":chain_expires": e.chainExpires(),
+	}
+	if due.IsZero() {
+		update = `
+			SET summary = :summary,
+			    version = :version,
+			    chain = :chain,
+			    chain_expires = :chain_expires
+			REMOVE schedule, due
+		`
+	} else {
+		values[":schedule"] = &types.AttributeValueMemberS{Value: scheduleReservations}
+		values[":due"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(due.Unix(), 10)}
+	}
+
+	t := s.newTransaction()
+	err := t.addUpdate(&types.Update{
+		TableName: s.table,
+		Key: map[string]types.AttributeValue{
+			"entity":   &types.AttributeValueMemberS{Value: id},
+			"revision": &types.AttributeValueMemberN{Value: "0"},
+		},
+		ConditionExpression:       aws.String("version = :expected"),
+		UpdateExpression:          aws.String(update),
+		ExpressionAttributeValues: values,
+	}).addEvent(s.table, e)
+	if err != nil {
+		return err
+	}
+	return t.exec(s.svc)
+}
+
+// nextDue returns when the scheduler next needs to start or end one of
+// the reservations, or zero if there are none.
+func nextDue(list []reservation) time.Time {
+	var due time.Time
+	for _, r := range list {
+		next := r.Start
+		if r.Started {
+			next = r.End
+		}
+		if due.IsZero() || next.Before(due) {
+			due = next
+		}
+	}
+	return due
+}
+
+// getReservations returns an empty entity, with version 0, if the mutex
+// has never been reserved.
+func (s *DynamoStore) getReservations(id string) (*reservations, error) {
+	item := &reservations{}
+	if _, err := s.getEntity(id, "entity, version, chain, chain_expires, summary", true, item); err != nil {
+		return nil, err
+	}
+	item.ID = id
+	return item, nil
+}
+
+// exportReservations decrypts reservations, and sorts them by when they
+// start.
+func (s *DynamoStore) exportReservations(item *reservations) ([]reservation, error) {
+	list := make([]reservation, 0, len(item.Summary.Reservations))
+	for _, r := range item.Summary.Reservations {
+		message, err := s.keys.decrypt(reservationContext(item.ID), r.Message)
+		if err != nil {
+			return nil, err
+		}
+		r.Message = message
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Start.Before(list[j].Start)
+	})
+	return list, nil
+}
+
+func (s *DynamoStore) encodeReservations(id string, list []reservation) (types.AttributeValue, error) {
+	summary := &reservationSummary{}
+	for _, r := range list {
+		message, err := s.keys.encrypt(reservationContext(id), r.Message)
+		if err != nil {
+			return nil, err
+		}
+		r.Message = message
+		summary.Reservations = append(summary.Reservations, r)
+	}
+	return attributevalue.Marshal(summary)
+}
+
+// scheduleReservations is the schedule index partition that holds every
+// mutex's reservations, in every tenant.
+const scheduleReservations = "reservations"
+
+// dueReservations returns the IDs of the reservation entities, in every
+// tenant, that have a reservation due to start or end by now. The index
+// is eventually consistent, so the entities need to be read again before
+// they are changed.
+func (s *DynamoStore) dueReservations(ctx context.Context, now time.Time) ([]string, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              s.table,
+		IndexName:              aws.String(scheduleIndex.Name),
+		KeyConditionExpression: aws.String("schedule = :schedule AND due <= :now"),
+		ProjectionExpression:   aws.String("entity"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":schedule": &types.AttributeValueMemberS{Value: scheduleReservations},
+			":now":      &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	}
+
+	var ids []string
+	for {
+		result, err := s.svc.Query(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		page := make([]base, 0, len(result.Items))
+		if err = attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, err
+		}
+		for _, item := range page {
+			ids = append(ids, item.ID)
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			return ids, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+func (r *reservation) export(name string) *Reservation {
+	return &Reservation{
+		ID:      r.ID,
+		Mutex:   name,
+		SlackID: r.SlackID,
+		Message: r.Message,
+		Start:   r.Start,
+		End:     r.End,
+		Started: r.Started,
+	}
+}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/pkg/errors"
+
+	"github.com/sjansen/stopgap/internal/rqx"
+)
+
+// DefaultSchedulerInterval is how often a scheduler checks for reservations
+// by default, so reservations may start and end up to this much late.
+const DefaultSchedulerInterval = 15 * time.Second
+
+// Scheduler locks reserved mutexes when their reservations start, and
+// unlocks them when their reservations end. A reservation that starts
+// while its mutex is locked by someone else is retried on the next tick.
+type Scheduler struct {
+	PollInterval time.Duration
+	// Now defaults to time.Now.
+	Now func() time.Time
+	// OnError is called with the ReservationErrors from each tick, which
+	// don't stop Run. By default they are ignored.
+	OnError func(ReservationErrors)
+
+	store *DynamoStore
+}
+
+// NewScheduler creates a scheduler using default values.
+func (s *DynamoStore) NewScheduler() *Scheduler {
+	return &Scheduler{
+		PollInterval: DefaultSchedulerInterval,
+		store:        s,
+	}
+}
+
+// ReservationErrors is returned by Tick when some reservations couldn't be
+// started or ended. Errors are indexed by reservation ID, or by entity ID
+// when none of a mutex's reservations could be read. The reservations are
+// retried on the next tick.
+type ReservationErrors map[string]error
+
+func (e ReservationErrors) Error() string {
+	ids := make([]string, 0, len(e))
+	for id := range e {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	msgs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		msgs = append(msgs, id+": "+e[id].Error())
+	}
+	return fmt.Sprintf("unable to schedule %d reservations (%s)", len(e), strings.Join(msgs, "; "))
+}
+
+// Run starts and ends reservations until the context is canceled, or the
+// reservations can't be read. Errors changing individual reservations are
+// passed to OnError instead.
+func (sc *Scheduler) Run(ctx context.Context) error {
+	for {
+		_, err := sc.Tick(ctx)
+		var failed ReservationErrors
+		if errors.As(err, &failed) {
+			if sc.OnError != nil {
+				sc.OnError(failed)
+			}
+		} else if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sc.PollInterval):
+		}
+	}
+}
+
+// Tick starts every reservation that is due to start, ends every
+// reservation that is due to end, and returns the number of reservations
+// changed. A reservation that can't be changed doesn't stop the others;
+// their errors are returned together as ReservationErrors.
+func (sc *Scheduler) Tick(ctx context.Context) (int, error) {
+	now := sc.now()
+	ids, err := sc.store.dueReservations(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	failed := ReservationErrors{}
+	for _, id := range ids {
+		item, err := sc.store.getReservations(id)
+		if err != nil {
+			failed[id] = err
+			continue
+		}
+		list, err := sc.store.exportReservations(item)
+		if err != nil {
+			failed[item.ID] = err
+			continue
+		}
+		for _, r := range list {
+			var changed bool
+			switch {
+			case !r.End.After(now):
+				changed, err = sc.end(ctx, item.ID, r)
+			case !r.Start.After(now) && !r.Started:
+				changed, err = sc.start(ctx, item.ID, r)
+			}
+			if err != nil {
+				failed[r.ID] = err
+			} else if changed {
+				count++
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return count, failed
+	}
+	return count, nil
+}
+
+// start locks the mutex for the reserver, unless they already hold it,
+// and marks the reservation as started.
+func (sc *Scheduler) start(ctx context.Context, id string, r reservation) (bool, error) {
+	tenant, name := entityName(id)
+	rqx := reserverContext(ctx, tenant, &r)
+
+	m, err := sc.store.GetMutex(rqx, name, true)
+	if err != nil {
+		return false, err
+	}
+	if !m.IsHolder(r.SlackID) {
+		err = sc.store.LockMutex(rqx, name, r.Message, LockExclusive)
+		if errors.Is(err, ErrAlreadyLocked) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+
+	err = sc.store.updateReservations(rqx, id, func(list []reservation) ([]reservation, string, map[string]string, error) {
+		for i := range list {
+			if list[i].ID == r.ID {
+				list[i].Started = true
+				return list, "reservation-started", map[string]string{"id": r.ID}, nil
+			}
+		}
+		return nil, "", nil, ErrReservationNotFound
+	})
+	if errors.Is(err, ErrReservationNotFound) {
+		// canceled after it was scanned
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// end unlocks the mutex, if the reservation started and the reserver
+// still holds it, and removes the reservation.
+func (sc *Scheduler) end(ctx context.Context, id string, r reservation) (bool, error) {
+	tenant, name := entityName(id)
+	rqx := reserverContext(ctx, tenant, &r)
+
+	unlocked := false
+	if r.Started {
+		err := sc.store.unlockMutex(rqx, name, true)
+		switch {
+		case err == nil:
+			unlocked = true
+		case errors.Is(err, ErrNotLocked), errors.Is(err, ErrMutexNotHeld):
+			// unlocked early, or transferred to someone else, who
+			// may have locked it again
+		default:
+			return false, err
+		}
+	}
+
+	err := sc.store.updateReservations(rqx, id, func(list []reservation) ([]reservation, string, map[string]string, error) {
+		for i := range list {
+			if list[i].ID == r.ID {
+				data := map[string]string{"id": r.ID, "unlocked": "false"}
+				if unlocked {
+					data["unlocked"] = "true"
+				}
+				return append(list[:i:i], list[i+1:]...), "reservation-ended", data, nil
+			}
+		}
+		return nil, "", nil, ErrReservationNotFound
+	})
+	if errors.Is(err, ErrReservationNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (sc *Scheduler) now() time.Time {
+	if sc.Now != nil {
+		return sc.Now()
+	}
+	return time.Now()
+}
+
+// reserverContext acts on behalf of the user who made a reservation.
+func reserverContext(ctx context.Context, tenant string, r *reservation) *rqx.RequestContext {
+	user := rqx.User{SlackID: r.SlackID}
+	if uid, err := ulid.Parse(r.UID); err == nil {
+		user.UID = uid
+	}
+	return &rqx.RequestContext{
+		Ctx:    ctx,
+		Client: rqx.Client{Type: "scheduler"},
+		EUser:  user,
+		RUser:  user,
+		Tenant: tenant,
+	}
+}
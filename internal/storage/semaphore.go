@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/pkg/errors"
+
+	"github.com/sjansen/stopgap/internal/rqx"
+)
+
+// ErrSemaphoreNotFound is returned when the named semaphore doesn't exist.
+var ErrSemaphoreNotFound = errors.New("semaphore not found")
+
+// ErrSemaphoreExists is returned when creating a semaphore whose name is
+// already taken.
+var ErrSemaphoreExists = errors.New("semaphore already exists")
+
+// ErrSemaphoreFull is returned when acquiring a semaphore that already has
+// as many holders as its capacity allows.
+var ErrSemaphoreFull = errors.New("semaphore full")
+
+// ErrAlreadyHeld is returned when acquiring a semaphore the requester
+// already holds.
+var ErrAlreadyHeld = errors.New("semaphore already held")
+
+// ErrNotHeld is returned when releasing a semaphore the requester doesn't
+// hold.
+var ErrNotHeld = errors.New("semaphore not held")
+
+// Semaphore can be used to share a pool of resources, by allowing up to
+// Capacity holders at once.
+type Semaphore struct {
+	Name        string
+	Version     int64
+	Description string
+	Capacity    int
+	// Holders are sorted by when they acquired the semaphore.
+	Holders []Holder
+}
+
+// Holder has acquired a semaphore.
+type Holder struct {
+	SlackID  string
+	Message  string
+	Acquired time.Time
+}
+
+type semaphore struct {
+	entity
+	Capacity int `dynamodbav:"max_holders"`
+	link
+	Summary semaphoreSummary `dynamodbav:"summary"`
+}
+
+type semaphoreSummary struct {
+	Holders map[string]holder `dynamodbav:"holders,omitempty"`
+}
+
+type holder struct {
+	Message  string    `dynamodbav:"message,omitempty"`
+	Acquired time.Time `dynamodbav:"acquired,unixtime"`
+}
+
+func semaphoreID(rqx *rqx.RequestContext, name string) (string, error) {
+	return tenantEntityID(rqx, "semaphore", name)
+}
+
+// CreateSemaphore adds the named semaphore.
+func (s *DynamoStore) CreateSemaphore(rqx *rqx.RequestContext, name, description string, capacity int) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+	if capacity < 1 {
+		return errors.New("semaphore capacity must be positive")
+	}
+	tenant, err := tenantOf(rqx)
+	if err != nil {
+		return err
+	}
+	id := entityID(tenant, "semaphore", name)
+	encrypted, err := s.keys.encrypt(descriptionContext(id), description)
+	if err != nil {
+		return err
+	}
+	event, err := s.newEvent(rqx, id, 1, link{},
+		"semaphore-created",
+		map[string]string{
+			"description": description,
+			"capacity":    strconv.Itoa(capacity),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	item := map[string]types.AttributeValue{
+		"entity":        &types.AttributeValueMemberS{Value: id},
+		"revision":      &types.AttributeValueMemberN{Value: "0"},
+		"entity_type":   &types.AttributeValueMemberS{Value: "semaphore"},
+		"version":       &types.AttributeValueMemberN{Value: "1"},
+		"chain":         &types.AttributeValueMemberS{Value: event.Hash},
+		"chain_expires": event.chainExpires(),
+		"description":   &types.AttributeValueMemberS{Value: encrypted},
+		"max_holders":   &types.AttributeValueMemberN{Value: strconv.Itoa(capacity)},
+		"summary": &types.AttributeValueMemberM{
+			Value: map[string]types.AttributeValue{},
+		},
+	}
+	if tenant != "" {
+		item["tenant"] = &types.AttributeValueMemberS{Value: tenant}
+	}
+
+	t := s.newTransaction()
+	err = t.addPut(&types.Put{
+		Item:                item,
+		TableName:           s.table,
+		ConditionExpression: aws.String("attribute_not_exists(entity)"),
+	}).addEvent(s.table, event)
+	if err != nil {
+		return err
+	}
+
+	err = t.exec(s.svc)
+	if conditionFailed(err, 0) {
+		return errors.Wrap(ErrSemaphoreExists, name)
+	}
+	return err
+}
+
+// GetSemaphore returns the data for the named semaphore.
+func (s *DynamoStore) GetSemaphore(rqx *rqx.RequestContext, name string, consistent bool) (*Semaphore, error) {
+	id, err := semaphoreID(rqx, name)
+	if err != nil {
+		return nil, err
+	}
+	item, err := s.getSemaphore(id, "version, description, max_holders, summary", consistent)
+	if err != nil {
+		return nil, err
+	}
+	return s.exportSemaphore(id, item)
+}
+
+// ListSemaphoreHolders returns the current holders of the named semaphore,
+// sorted by when they acquired it.
+func (s *DynamoStore) ListSemaphoreHolders(rqx *rqx.RequestContext, name string) ([]Holder, error) {
+	sem, err := s.GetSemaphore(rqx, name, true)
+	if err != nil {
+		return nil, err
+	}
+	return sem.Holders, nil
+}
+
+// GetSemaphoreHistory returns the events recorded for the named semaphore,
+// oldest first.
+func (s *DynamoStore) GetSemaphoreHistory(rqx *rqx.RequestContext, name string, consistent bool) ([]*Event, error) {
+	id, err := semaphoreID(rqx, name)
+	if err != nil {
+		return nil, err
+	}
+	return s.getHistory(id, consistent)
+}
+
+// VerifySemaphoreHistory checks the hash chain of the named semaphore's
+// events, like VerifyMutexHistory.
+func (s *DynamoStore) VerifySemaphoreHistory(rqx *rqx.RequestContext, name string) ([]ChainBreak, error) {
+	id, err := semaphoreID(rqx, name)
+	if err != nil {
+		return nil, err
+	}
+	item, err := s.getSemaphore(id, "version, chain, chain_expires", true)
+	if err != nil {
+		return nil, err
+	}
+	return s.verifyHistory(id, item.Version, item.Chain)
+}
+
+// AcquireSemaphore adds the requester to the named semaphore's holders,
+// if it has room.
+func (s *DynamoStore) AcquireSemaphore(rqx *rqx.RequestContext, name, message string) error {
+	slackID := rqx.EUser.SlackID
+	return s.updateSemaphore(rqx, name, func(sem *Semaphore) (string, map[string]string, error) {
+		for _, h := range sem.Holders {
+			if h.SlackID == slackID {
+				return "", nil, ErrAlreadyHeld
+			}
+		}
+		if len(sem.Holders) >= sem.Capacity {
+			return "", nil, ErrSemaphoreFull
+		}
+		sem.Holders = append(sem.Holders, Holder{
+			SlackID: slackID,
+			Message: message,
+		})
+		return "semaphore-acquired", map[string]string{"message": message}, nil
+	})
+}
+
+// ReleaseSemaphore removes the requester from the named semaphore's
+// holders.
+func (s *DynamoStore) ReleaseSemaphore(rqx *rqx.RequestContext, name string) error {
+	slackID := rqx.EUser.SlackID
+	return s.updateSemaphore(rqx, name, func(sem *Semaphore) (string, map[string]string, error) {
+		for i, h := range sem.Holders {
+			if h.SlackID == slackID {
+				sem.Holders = append(sem.Holders[:i:i], sem.Holders[i+1:]...)
+				return "semaphore-released", map[string]string{}, nil
+			}
+		}
+		return "", nil, ErrNotHeld
+	})
+}
+
+// updateSemaphore applies a change to the current holders of a semaphore,
+// and records it as an event. The change is restarted if the semaphore is
+// changed by someone else first.
+func (s *DynamoStore) updateSemaphore(
+	rqx *rqx.RequestContext,
+	name string,
+	change func(*Semaphore) (string, map[string]string, error),
+) error {
+	id, err := semaphoreID(rqx, name)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < maxUpdateAttempts; i++ {
+		item, err := s.getSemaphore(id, "version, chain, chain_expires, max_holders, summary", true)
+		if err != nil {
+			return err
+		}
+		sem, err := s.exportSemaphore(id, item)
+		if err != nil {
+			return err
+		}
+
+		typ, data, err := change(sem)
+		if err != nil {
+			return err
+		}
+		event, err := s.newEvent(rqx, id, item.Version+1, item.link, typ, data)
+		if err != nil {
+			return err
+		}
+		for j := range sem.Holders {
+			if sem.Holders[j].Acquired.IsZero() {
+				sem.Holders[j].Acquired = event.Created
+			}
+		}
+
+		summary, err := s.encodeSemaphoreSummary(id, sem)
+		if err != nil {
+			return err
+		}
+		err = s.putState(id, item.Version, summary, event)
+		if !conditionFailed(err, 0) {
+			return err
+		}
+	}
+	return errors.New("semaphore changed too often to update: " + id)
+}
+
+func (s *DynamoStore) getSemaphore(id, projection string, consistent bool) (*semaphore, error) {
+	item := &semaphore{}
+	if ok, err := s.getEntity(id, projection, consistent, item); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrSemaphoreNotFound
+	}
+	return item, nil
+}
+
+func (s *DynamoStore) exportSemaphore(id string, item *semaphore) (*Semaphore, error) {
+	description, err := s.keys.decrypt(descriptionContext(id), item.Description)
+	if err != nil {
+		return nil, err
+	}
+
+	_, name := entityName(id)
+	sem := &Semaphore{
+		Name:        name,
+		Version:     item.Version,
+		Description: description,
+		Capacity:    item.Capacity,
+	}
+	for slackID, h := range item.Summary.Holders {
+		message, err := s.keys.decrypt(holderContext(id), h.Message)
+		if err != nil {
+			return nil, err
+		}
+		sem.Holders = append(sem.Holders, Holder{
+			SlackID:  slackID,
+			Message:  message,
+			Acquired: h.Acquired,
+		})
+	}
+	sortHolders(sem.Holders)
+	return sem, nil
+}
+
+func (s *DynamoStore) encodeSemaphoreSummary(id string, sem *Semaphore) (types.AttributeValue, error) {
+	summary := &semaphoreSummary{
+		Holders: make(map[string]holder, len(sem.Holders)),
+	}
+	for _, h := range sem.Holders {
+		message, err := s.keys.encrypt(holderContext(id), h.Message)
+		if err != nil {
+			return nil, err
+		}
+		summary.Holders[h.SlackID] = holder{
+			Message:  message,
+			Acquired: h.Acquired,
+		}
+	}
+	return attributevalue.Marshal(summary)
+}
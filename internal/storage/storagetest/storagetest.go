@@ -0,0 +1,49 @@
+// Package storagetest helps test code that uses stopgap's storage against
+// DynamoDB, without tests interfering with each other.
+package storagetest
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+
+	"github.com/sjansen/stopgap/internal/storage"
+)
+
+// TablePrefix starts the name of every table created by this package.
+const TablePrefix = "stopgap-test-"
+
+// cleanupTimeout limits how long to wait for a table to be deleted.
+const cleanupTimeout = 60 * time.Second
+
+// NewStore creates a DynamoStore backed by a new, uniquely named table.
+// The table is deleted when the test finishes.
+func NewStore(t testing.TB, svc storage.DynamoDBAPI) *storage.DynamoStore {
+	t.Helper()
+
+	store := storage.NewWithTableName(svc, NewTableName(t, svc))
+	if err := store.CreateTable(); err != nil {
+		t.Fatalf("unable to create table %s: %v", store.TableName(), err)
+	}
+	return store
+}
+
+// NewTableName returns a unique table name without creating the table.
+// If the table is created, it is deleted when the test finishes.
+func NewTableName(t testing.TB, svc storage.DynamoDBAPI) string {
+	t.Helper()
+
+	name := TablePrefix + strings.ToLower(ulid.Make().String())
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancel()
+		store := storage.NewWithTableName(svc, name)
+		if err := store.DeleteTable(ctx); err != nil {
+			t.Errorf("unable to delete table %s: %v", name, err)
+		}
+	})
+	return name
+}
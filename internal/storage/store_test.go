@@ -0,0 +1,2165 @@
+package storage_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sjansen/stopgap/internal/rqx"
+	"github.com/sjansen/stopgap/internal/storage"
+	"github.com/sjansen/stopgap/internal/storage/storagetest"
+)
+
+func randomString() string {
+	bytes := make([]byte, 10)
+	for i := range bytes {
+		bytes[i] = byte(65 + rand.Intn(25))
+	}
+	return string(bytes)
+}
+
+// newRequest returns a request made by a test user in the default tenant.
+func newRequest(slackID string) *rqx.RequestContext {
+	return newTenantRequest("", slackID)
+}
+
+func newTenantRequest(tenant, slackID string) *rqx.RequestContext {
+	user := rqx.User{
+		Name:    "Test User",
+		SlackID: slackID,
+	}
+	return &rqx.RequestContext{
+		Ctx: context.TODO(),
+		Client: rqx.Client{
+			Type: "test case",
+		},
+		EUser:  user,
+		RUser:  user,
+		Tenant: tenant,
+	}
+}
+
+func TestCreateTable(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storage.NewWithTableName(svc, storagetest.NewTableName(t, svc))
+
+	// first time: created
+	err := store.CreateTable()
+	require.NoError(err)
+
+	// second time: noop
+	err = store.CreateTable()
+	require.NoError(err)
+
+	// first time: deleted
+	err = store.DeleteTable(context.TODO())
+	require.NoError(err)
+
+	// second time: noop
+	err = store.DeleteTable(context.TODO())
+	require.NoError(err)
+}
+
+func TestDynamoStore(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storagetest.NewStore(t, svc)
+
+	name := randomString()
+	user := rqx.User{
+		Name:    "Test User",
+		SlackID: "UFoo42",
+	}
+	rqx := &rqx.RequestContext{
+		Ctx: context.TODO(),
+		Client: rqx.Client{
+			Type: "test case",
+		},
+		EUser: user,
+		RUser: user,
+	}
+
+	err := store.CreateMutex(rqx, name, "a test mutex")
+	require.NoError(err)
+
+	m, err := store.GetMutex(rqx, name, true)
+	require.NoError(err)
+	require.False(m.Locked)
+
+	err = store.LockMutex(rqx, name, "first attempt", storage.LockExclusive)
+	require.NoError(err)
+
+	m, err = store.GetMutex(rqx, name, true)
+	require.NoError(err)
+	require.True(m.Locked)
+	require.Equal(user.SlackID, m.LockedBy)
+
+	err = store.LockMutex(rqx, name, "second attempt", storage.LockExclusive)
+	require.ErrorIs(err, storage.ErrAlreadyLocked)
+
+	err = store.UnlockMutex(rqx, name)
+	require.NoError(err)
+
+	m, err = store.GetMutex(rqx, name, true)
+	require.NoError(err)
+	require.False(m.Locked)
+	require.Empty(m.LockedBy)
+}
+
+func TestCheckMutex(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storagetest.NewStore(t, svc)
+
+	name := randomString()
+	user := rqx.User{
+		Name:    "Test User",
+		SlackID: "UFoo42",
+	}
+	rqx := &rqx.RequestContext{
+		Ctx: context.TODO(),
+		Client: rqx.Client{
+			Type: "test case",
+		},
+		EUser: user,
+		RUser: user,
+	}
+
+	err := store.CreateMutex(rqx, name, "a test mutex")
+	require.NoError(err)
+
+	err = store.LockMutex(rqx, name, "first attempt", storage.LockExclusive)
+	require.NoError(err)
+
+	events, err := store.GetMutexHistory(rqx, name, true)
+	require.NoError(err)
+	require.Len(events, 2)
+	require.Equal("mutex-created", events[0].Type)
+	require.Equal("mutex-locked", events[1].Type)
+	require.Equal(user.SlackID, events[1].EUser.SlackID)
+	require.Equal("first attempt", events[1].Data["message"])
+
+	drift, err := store.CheckMutex(rqx, name, false)
+	require.NoError(err)
+	require.Nil(drift)
+
+	_, err = svc.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(store.TableName()),
+		Key: map[string]types.AttributeValue{
+			"entity":   &types.AttributeValueMemberS{Value: "mutex:" + name},
+			"revision": &types.AttributeValueMemberN{Value: "0"},
+		},
+		UpdateExpression: aws.String(`
+			SET summary.locked = :locked
+			REMOVE summary.locked_by, summary.message
+		`),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":locked": &types.AttributeValueMemberBOOL{Value: false},
+		},
+	})
+	require.NoError(err)
+
+	drift, err = store.CheckMutex(rqx, name, false)
+	require.NoError(err)
+	require.NotNil(drift)
+	require.False(drift.Stored.Locked)
+	require.True(drift.Derived.Locked)
+	require.Equal(user.SlackID, drift.Derived.LockedBy)
+	require.False(drift.Repaired)
+
+	drifts, err := store.CheckMutexes(true)
+	require.NoError(err)
+	require.Len(drifts, 1)
+	require.Equal(name, drifts[0].Name)
+	require.True(drifts[0].Repaired)
+
+	m, err := store.GetMutex(rqx, name, true)
+	require.NoError(err)
+	require.True(m.Locked)
+	require.Equal(user.SlackID, m.LockedBy)
+	require.Equal("first attempt", m.Message)
+	require.Equal(int64(2), m.Version)
+
+	drift, err = store.CheckMutex(rqx, name, false)
+	require.NoError(err)
+	require.Nil(drift)
+}
+
+func TestCheckMutexWithIncompleteHistory(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storagetest.NewStore(t, svc)
+
+	name := randomString()
+	alice := newRequest("UAlice")
+	bob := newRequest("UBob")
+
+	// GIVEN a locked mutex with a waiter
+	err := store.CreateMutex(alice, name, "a test mutex")
+	require.NoError(err)
+	err = store.LockMutex(alice, name, "alice was here", storage.LockExclusive)
+	require.NoError(err)
+	position, err := store.WaitForMutex(bob, name, "bob was here", storage.LockExclusive, time.Hour)
+	require.NoError(err)
+	require.Equal(1, position)
+
+	// AND the oldest events have been deleted
+	for _, revision := range []int{1, 2} {
+		_, err := svc.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+			TableName: aws.String(store.TableName()),
+			Key: map[string]types.AttributeValue{
+				"entity":   &types.AttributeValueMemberS{Value: "mutex:" + name},
+				"revision": &types.AttributeValueMemberN{Value: strconv.Itoa(revision)},
+			},
+		})
+		require.NoError(err)
+	}
+
+	// WHEN the mutex is checked and repaired
+	drift, err := store.CheckMutex(alice, name, true)
+	require.NoError(err)
+
+	// THEN the history is reported as incomplete
+	require.NotNil(drift)
+	require.True(drift.Incomplete)
+	require.Nil(drift.Derived)
+	require.False(drift.Repaired)
+
+	drifts, err := store.CheckMutexes(true)
+	require.NoError(err)
+	require.Len(drifts, 1)
+	require.True(drifts[0].Incomplete)
+	require.False(drifts[0].Repaired)
+
+	// AND the stored state is left alone
+	m, err := store.GetMutex(alice, name, true)
+	require.NoError(err)
+	require.True(m.Locked)
+	require.Equal("UAlice", m.LockedBy)
+	require.Len(m.Queue, 1)
+	require.Equal("UBob", m.Queue[0].SlackID)
+}
+
+func TestVerifyMutexHistory(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storagetest.NewStore(t, svc)
+
+	name := randomString()
+	user := rqx.User{
+		Name:    "Test User",
+		SlackID: "UFoo42",
+	}
+	rqx := &rqx.RequestContext{
+		Ctx: context.TODO(),
+		Client: rqx.Client{
+			Type:       "test case",
+			RemoteAddr: "192.0.2.1",
+		},
+		EUser: user,
+		RUser: user,
+	}
+
+	err := store.CreateMutex(rqx, name, "a test mutex")
+	require.NoError(err)
+
+	err = store.LockMutex(rqx, name, "first attempt", storage.LockExclusive)
+	require.NoError(err)
+
+	err = store.UnlockMutex(rqx, name)
+	require.NoError(err)
+
+	breaks, err := store.VerifyMutexHistory(rqx, name)
+	require.NoError(err)
+	require.Empty(breaks)
+
+	events, err := store.GetMutexHistory(rqx, name, true)
+	require.NoError(err)
+	require.Len(events, 3)
+	require.Empty(events[0].PrevHash)
+	require.Equal(events[0].Hash, events[1].PrevHash)
+	require.Equal(events[1].Hash, events[2].PrevHash)
+
+	key := map[string]types.AttributeValue{
+		"entity":   &types.AttributeValueMemberS{Value: "mutex:" + name},
+		"revision": &types.AttributeValueMemberN{Value: "2"},
+	}
+	_, err = svc.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:        aws.String(store.TableName()),
+		Key:              key,
+		UpdateExpression: aws.String("SET #data.message = :message"),
+		ExpressionAttributeNames: map[string]string{
+			"#data": "data",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":message": &types.AttributeValueMemberS{Value: "nothing to see here"},
+		},
+	})
+	require.NoError(err)
+
+	breaks, err = store.VerifyMutexHistory(rqx, name)
+	require.NoError(err)
+	require.Equal([]storage.ChainBreak{{
+		Revision: 2,
+		Problem:  storage.ChainModified,
+	}}, breaks)
+
+	_, err = svc.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(store.TableName()),
+		Key:       key,
+	})
+	require.NoError(err)
+
+	breaks, err = store.VerifyMutexHistory(rqx, name)
+	require.NoError(err)
+	require.Equal([]storage.ChainBreak{{
+		Revision: 3,
+		Problem:  storage.ChainGap,
+	}}, breaks)
+
+	// events record when the event before them expires
+	require.True(events[0].PrevExpires.IsZero())
+	require.True(events[1].PrevExpires.After(time.Now()))
+
+	deleteEvents := func(name string, revisions ...int) {
+		for _, revision := range revisions {
+			_, err := svc.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+				TableName: aws.String(store.TableName()),
+				Key: map[string]types.AttributeValue{
+					"entity":   &types.AttributeValueMemberS{Value: "mutex:" + name},
+					"revision": &types.AttributeValueMemberN{Value: strconv.Itoa(revision)},
+				},
+			})
+			require.NoError(err)
+		}
+	}
+
+	// GIVEN a history whose oldest events were deleted before expiring
+	truncated := randomString()
+	err = store.CreateMutex(rqx, truncated, "a test mutex")
+	require.NoError(err)
+	err = store.LockMutex(rqx, truncated, "first attempt", storage.LockExclusive)
+	require.NoError(err)
+	deleteEvents(truncated, 1)
+	// WHEN it is verified
+	breaks, err = store.VerifyMutexHistory(rqx, truncated)
+	// THEN the gap should be reported
+	require.NoError(err)
+	require.Equal([]storage.ChainBreak{{
+		Revision: 2,
+		Problem:  storage.ChainGap,
+	}}, breaks)
+
+	// GIVEN a history whose oldest events have expired
+	expired := randomString()
+	err = store.CreateMutex(rqx, expired, "a test mutex")
+	require.NoError(err)
+	err = store.LockMutex(rqx, expired, "first attempt", storage.LockExclusive)
+	require.NoError(err)
+	_, err = svc.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName: aws.String(store.TableName()),
+		Key: map[string]types.AttributeValue{
+			"entity":   &types.AttributeValueMemberS{Value: "mutex:" + expired},
+			"revision": &types.AttributeValueMemberN{Value: "0"},
+		},
+		UpdateExpression: aws.String("SET chain_expires = :expires"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":expires": &types.AttributeValueMemberN{
+				Value: strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10),
+			},
+		},
+	})
+	require.NoError(err)
+	err = store.UnlockMutex(rqx, expired)
+	require.NoError(err)
+	deleteEvents(expired, 1, 2)
+	// WHEN it is verified
+	breaks, err = store.VerifyMutexHistory(rqx, expired)
+	// THEN nothing should be reported
+	require.NoError(err)
+	require.Empty(breaks)
+}
+
+func TestEncryption(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	oldKey := make([]byte, 32)
+	newKey := make([]byte, 32)
+	for i := range newKey {
+		oldKey[i] = byte(i)
+		newKey[i] = byte(255 - i)
+	}
+
+	keyring, err := storage.NewKeyring("2019-01", map[string][]byte{
+		"2019-01": oldKey,
+	})
+	require.NoError(err)
+	store := storagetest.NewStore(t, svc).WithKeyring(keyring)
+
+	name := randomString()
+	user := rqx.User{
+		Name:    "Test User",
+		SlackID: "UFoo42",
+	}
+	rqx := &rqx.RequestContext{
+		Ctx: context.TODO(),
+		Client: rqx.Client{
+			Type: "test case",
+		},
+		EUser: user,
+		RUser: user,
+	}
+
+	err = store.CreateMutex(rqx, name, "a secret mutex")
+	require.NoError(err)
+
+	err = store.LockMutex(rqx, name, "incident 42", storage.LockExclusive)
+	require.NoError(err)
+
+	result, err := svc.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(store.TableName()),
+		Key: map[string]types.AttributeValue{
+			"entity":   &types.AttributeValueMemberS{Value: "mutex:" + name},
+			"revision": &types.AttributeValueMemberN{Value: "0"},
+		},
+	})
+	require.NoError(err)
+	description := result.Item["description"].(*types.AttributeValueMemberS).Value
+	require.NotContains(description, "secret")
+	summary := result.Item["summary"].(*types.AttributeValueMemberM).Value
+	message := summary["message"].(*types.AttributeValueMemberS).Value
+	require.NotContains(message, "incident")
+
+	m, err := store.GetMutex(rqx, name, true)
+	require.NoError(err)
+	require.Equal("incident 42", m.Message)
+
+	keyring, err = storage.NewKeyring("2019-02", map[string][]byte{
+		"2019-01": oldKey,
+		"2019-02": newKey,
+	})
+	require.NoError(err)
+	store = storage.NewWithTableName(svc, store.TableName()).WithKeyring(keyring)
+
+	events, err := store.GetMutexHistory(rqx, name, true)
+	require.NoError(err)
+	require.Len(events, 2)
+	require.Equal("a secret mutex", events[0].Data["description"])
+	require.Equal("incident 42", events[1].Data["message"])
+
+	breaks, err := store.VerifyMutexHistory(rqx, name)
+	require.NoError(err)
+	require.Empty(breaks)
+
+	keyring, err = storage.NewKeyring("2019-02", map[string][]byte{
+		"2019-02": newKey,
+	})
+	require.NoError(err)
+	store = storage.NewWithTableName(svc, store.TableName()).WithKeyring(keyring)
+
+	_, err = store.GetMutex(rqx, name, true)
+	require.ErrorIs(err, storage.ErrUnknownKey)
+}
+
+func TestPlaintextThatLooksEncrypted(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storagetest.NewStore(t, svc)
+
+	name := randomString()
+	rqx := newRequest("UFoo42")
+
+	// GIVEN values that look like ciphertext, stored without a keyring
+	err := store.CreateMutex(rqx, name, "enc:v1:x:y:z")
+	require.NoError(err)
+	err = store.LockMutex(rqx, name, "enc:v1:a:b:c", storage.LockExclusive)
+	require.NoError(err)
+
+	// WHEN they are read, with or without a keyring
+	key := make([]byte, 32)
+	keyring, err := storage.NewKeyring("2019-01", map[string][]byte{
+		"2019-01": key,
+	})
+	require.NoError(err)
+	for _, store := range []*storage.DynamoStore{
+		store,
+		storage.NewWithTableName(svc, store.TableName()).WithKeyring(keyring),
+	} {
+		// THEN they are returned unchanged
+		m, err := store.GetMutex(rqx, name, true)
+		require.NoError(err)
+		require.Equal("enc:v1:x:y:z", m.Description)
+		require.Equal("enc:v1:a:b:c", m.Message)
+
+		events, err := store.GetMutexHistory(rqx, name, true)
+		require.NoError(err)
+		require.Len(events, 2)
+		require.Equal("enc:v1:a:b:c", events[1].Data["message"])
+
+		mutexes, err := store.ListMutexes(rqx)
+		require.NoError(err)
+		require.Len(mutexes, 1)
+
+		drift, err := store.CheckMutex(rqx, name, false)
+		require.NoError(err)
+		require.Nil(drift)
+	}
+}
+
+func TestPrivacy(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storagetest.NewStore(t, svc)
+
+	name := randomString()
+	alice := rqx.User{
+		UID:     ulid.Make(),
+		Name:    "Alice",
+		SlackID: "UAlice",
+	}
+	bob := rqx.User{
+		UID:     ulid.Make(),
+		Name:    "Bob",
+		SlackID: "UBob",
+	}
+	client := rqx.Client{
+		Type:       "test case",
+		RemoteAddr: "192.0.2.1",
+		UserAgent:  "stopgap-test/1.0",
+	}
+	reader := &rqx.RequestContext{Ctx: context.TODO()}
+
+	err := store.CreateMutex(&rqx.RequestContext{
+		Ctx:    context.TODO(),
+		Client: client,
+		EUser:  alice,
+		RUser:  alice,
+	}, name, "a test mutex")
+	require.NoError(err)
+
+	err = store.LockMutex(&rqx.RequestContext{
+		Ctx:    context.TODO(),
+		Client: client,
+		EUser:  bob,
+		RUser:  bob,
+	}, name, "deploying", storage.LockExclusive)
+	require.NoError(err)
+
+	count, err := store.ApplyRetentionPolicy(storage.RetentionPolicy{
+		ClientDetails: time.Hour,
+	}, time.Now())
+	require.NoError(err)
+	require.Zero(count)
+
+	count, err = store.ApplyRetentionPolicy(storage.RetentionPolicy{
+		ClientDetails: time.Hour,
+	}, time.Now().Add(2*time.Hour))
+	require.NoError(err)
+	require.GreaterOrEqual(count, 2)
+
+	events, err := store.GetMutexHistory(reader, name, true)
+	require.NoError(err)
+	require.Len(events, 2)
+	plain := sha256.Sum256([]byte(client.RemoteAddr))
+	for _, e := range events {
+		require.Equal("test case", e.Client.Type)
+		require.Empty(e.Client.RemoteAddr)
+		require.Empty(e.Client.UserAgent)
+		require.NotContains(e.Salts, "client.remote_addr")
+		require.NotContains(e.Salts, "client.user_agent")
+		require.Contains(e.Salts, "euser.name")
+		require.NotEmpty(e.Redacted["client.remote_addr"])
+		require.NotEqual(hex.EncodeToString(plain[:]), e.Redacted["client.remote_addr"])
+	}
+	require.NotEqual(events[0].Redacted["client.remote_addr"], events[1].Redacted["client.remote_addr"])
+	require.Equal("Bob", events[1].EUser.Name)
+
+	count, err = store.EraseUser(bob.UID)
+	require.NoError(err)
+	require.Equal(1, count)
+
+	exported, err := store.ExportUser(bob.UID)
+	require.NoError(err)
+	require.Len(exported, 1)
+	require.Equal("mutex-locked", exported[0].Type)
+	require.Equal("deploying", exported[0].Data["message"])
+	require.Equal(bob.UID, exported[0].EUser.UID)
+	require.Equal(bob.SlackID, exported[0].EUser.SlackID)
+	require.Empty(exported[0].EUser.Name)
+
+	breaks, err := store.VerifyMutexHistory(reader, name)
+	require.NoError(err)
+	require.Empty(breaks)
+}
+
+func TestGetMutexes(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storagetest.NewStore(t, svc)
+
+	prefix := randomString() + "-"
+	user := rqx.User{
+		Name:    "Test User",
+		SlackID: "UFoo42",
+	}
+	rqx := &rqx.RequestContext{
+		Ctx: context.TODO(),
+		Client: rqx.Client{
+			Type: "test case",
+		},
+		EUser: user,
+		RUser: user,
+	}
+
+	// more names than fit in a single request
+	names := make([]string, 0, 121)
+	for i := 0; i < 120; i++ {
+		name := prefix + strconv.Itoa(i)
+		err := store.CreateMutex(rqx, name, "a test mutex")
+		require.NoError(err)
+		names = append(names, name)
+	}
+	err := store.LockMutex(rqx, names[7], "locked for testing", storage.LockExclusive)
+	require.NoError(err)
+
+	missing := prefix + "missing"
+	names = append(names, missing, names[0])
+
+	mutexes, err := store.GetMutexes(rqx, names, true)
+	require.NoError(err)
+	require.Len(mutexes, 121)
+	require.Contains(mutexes, missing)
+	require.Nil(mutexes[missing])
+	for _, name := range names[:120] {
+		require.NotNil(mutexes[name], name)
+	}
+	require.True(mutexes[names[7]].Locked)
+	require.Equal("locked for testing", mutexes[names[7]].Message)
+	require.False(mutexes[names[8]].Locked)
+
+	_, err = store.GetMutex(rqx, missing, true)
+	require.ErrorIs(err, storage.ErrMutexNotFound)
+}
+
+func TestTenants(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storagetest.NewStore(t, svc)
+
+	name := randomString()
+	acme := newTenantRequest("acme", "UFoo42")
+	globex := newTenantRequest("globex", "UFoo42")
+	other := newRequest("UFoo42")
+
+	// the same name can be used by every tenant
+	for _, rqx := range []*rqx.RequestContext{acme, globex, other} {
+		err := store.CreateMutex(rqx, name, "owned by "+rqx.Tenant)
+		require.NoError(err)
+	}
+	err := store.CreateMutex(acme, name+"-2", "a second mutex")
+	require.NoError(err)
+
+	err = store.LockMutex(acme, name, "acme only", storage.LockExclusive)
+	require.NoError(err)
+
+	m, err := store.GetMutex(acme, name, true)
+	require.NoError(err)
+	require.True(m.Locked)
+	for _, rqx := range []*rqx.RequestContext{globex, other} {
+		m, err = store.GetMutex(rqx, name, true)
+		require.NoError(err)
+		require.False(m.Locked)
+		require.Equal("owned by "+rqx.Tenant, m.Description)
+	}
+
+	// mutexes in other tenants are invisible
+	_, err = store.GetMutex(globex, name+"-2", true)
+	require.ErrorIs(err, storage.ErrMutexNotFound)
+	err = store.LockMutex(globex, name+"-2", "not mine", storage.LockExclusive)
+	require.ErrorIs(err, storage.ErrMutexNotFound)
+
+	mutexes, err := store.ListMutexes(acme)
+	require.NoError(err)
+	require.Len(mutexes, 2)
+	require.Equal(name, mutexes[0].Name)
+	require.True(mutexes[0].Locked)
+	require.Equal(name+"-2", mutexes[1].Name)
+	require.Equal("a second mutex", mutexes[1].Description)
+
+	mutexes, err = store.ListMutexes(other)
+	require.NoError(err)
+	require.Len(mutexes, 1)
+	require.Equal(name, mutexes[0].Name)
+
+	exported, err := store.ExportTenant(acme)
+	require.NoError(err)
+	require.Len(exported, 2)
+	require.Equal(name, exported[0].Mutex.Name)
+	require.Len(exported[0].Events, 2)
+	require.Equal("acme", exported[0].Events[1].Tenant)
+	require.Equal("mutex-locked", exported[0].Events[1].Type)
+	require.Equal("acme only", exported[0].Events[1].Data["message"])
+
+	breaks, err := store.VerifyMutexHistory(acme, name)
+	require.NoError(err)
+	require.Empty(breaks)
+
+	drifts, err := store.CheckMutexes(false)
+	require.NoError(err)
+	require.Empty(drifts)
+
+	_, err = store.GetMutex(newTenantRequest("acme#mutex:x", "UFoo42"), name, true)
+	require.ErrorIs(err, storage.ErrInvalidTenant)
+}
+
+func TestWaitQueue(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storagetest.NewStore(t, svc)
+
+	name := randomString()
+	alice := newRequest("UAlice")
+	bob := newRequest("UBob")
+	carol := newRequest("UCarol")
+	dave := newRequest("UDave")
+
+	err := store.CreateMutex(alice, name, "a test mutex")
+	require.NoError(err)
+
+	position, err := store.WaitForMutex(alice, name, "alice was here", storage.LockExclusive, time.Hour)
+	require.NoError(err)
+	require.Zero(position)
+
+	position, err = store.WaitForMutex(bob, name, "bob was here", storage.LockExclusive, time.Second)
+	require.NoError(err)
+	require.Equal(1, position)
+	position, err = store.WaitForMutex(carol, name, "carol was here", storage.LockExclusive, time.Hour)
+	require.NoError(err)
+	require.Equal(2, position)
+	position, err = store.WaitForMutex(dave, name, "dave was here", storage.LockExclusive, time.Hour)
+	require.NoError(err)
+	require.Equal(3, position)
+
+	// waiting again doesn't lose your place
+	position, err = store.WaitForMutex(bob, name, "bob was here", storage.LockExclusive, time.Second)
+	require.NoError(err)
+	require.Equal(1, position)
+
+	err = store.LeaveQueue(dave, name)
+	require.NoError(err)
+	_, err = store.GetQueuePosition(dave, name)
+	require.ErrorIs(err, storage.ErrNotQueued)
+	err = store.LeaveQueue(dave, name)
+	require.ErrorIs(err, storage.ErrNotQueued)
+
+	// bob's entry expires
+	time.Sleep(1100 * time.Millisecond)
+	position, err = store.GetQueuePosition(carol, name)
+	require.NoError(err)
+	require.Equal(1, position)
+
+	err = store.UnlockMutex(alice, name)
+	require.NoError(err)
+	m, err := store.GetMutex(carol, name, true)
+	require.NoError(err)
+	require.True(m.Locked)
+	require.Equal("UCarol", m.LockedBy)
+	require.Equal("carol was here", m.Message)
+	require.Empty(m.Waiting(time.Now()))
+
+	err = store.UnlockMutex(carol, name)
+	require.NoError(err)
+	m, err = store.GetMutex(carol, name, true)
+	require.NoError(err)
+	require.False(m.Locked)
+	require.Empty(m.Queue)
+
+	err = store.UnlockMutex(carol, name)
+	require.ErrorIs(err, storage.ErrNotLocked)
+
+	breaks, err := store.VerifyMutexHistory(alice, name)
+	require.NoError(err)
+	require.Empty(breaks)
+	drift, err := store.CheckMutex(alice, name, false)
+	require.NoError(err)
+	require.Nil(drift)
+}
+
+func TestSemaphore(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storagetest.NewStore(t, svc)
+
+	name := randomString()
+	alice := newRequest("UAlice")
+	bob := newRequest("UBob")
+	carol := newRequest("UCarol")
+
+	err := store.CreateSemaphore(alice, name, "load test environments", 2)
+	require.NoError(err)
+	err = store.CreateSemaphore(alice, name, "load test environments", 2)
+	require.ErrorIs(err, storage.ErrSemaphoreExists)
+	err = store.CreateSemaphore(alice, name+"-empty", "nothing to share", 0)
+	require.Error(err)
+	for _, invalid := range []string{"", "pools/", "pools//load"} {
+		err = store.CreateSemaphore(alice, invalid, "badly named", 1)
+		require.ErrorIs(err, storage.ErrInvalidName)
+	}
+
+	// mutexes and semaphores don't share names
+	_, err = store.GetMutex(alice, name, true)
+	require.ErrorIs(err, storage.ErrMutexNotFound)
+
+	err = store.AcquireSemaphore(alice, name, "alice was here")
+	require.NoError(err)
+	err = store.AcquireSemaphore(alice, name, "alice was here")
+	require.ErrorIs(err, storage.ErrAlreadyHeld)
+	err = store.AcquireSemaphore(bob, name, "bob was here")
+	require.NoError(err)
+	err = store.AcquireSemaphore(carol, name, "carol was here")
+	require.ErrorIs(err, storage.ErrSemaphoreFull)
+
+	sem, err := store.GetSemaphore(carol, name, true)
+	require.NoError(err)
+	require.Equal(name, sem.Name)
+	require.Equal("load test environments", sem.Description)
+	require.Equal(2, sem.Capacity)
+	require.Equal(int64(3), sem.Version)
+
+	holders, err := store.ListSemaphoreHolders(carol, name)
+	require.NoError(err)
+	require.Len(holders, 2)
+	slackIDs := []string{holders[0].SlackID, holders[1].SlackID}
+	require.ElementsMatch([]string{"UAlice", "UBob"}, slackIDs)
+	for _, h := range holders {
+		require.False(h.Acquired.IsZero())
+	}
+
+	err = store.ReleaseSemaphore(carol, name)
+	require.ErrorIs(err, storage.ErrNotHeld)
+	err = store.ReleaseSemaphore(alice, name)
+	require.NoError(err)
+	err = store.AcquireSemaphore(carol, name, "carol was here")
+	require.NoError(err)
+
+	holders, err = store.ListSemaphoreHolders(alice, name)
+	require.NoError(err)
+	require.Len(holders, 2)
+	require.Equal("UBob", holders[0].SlackID)
+	require.Equal("bob was here", holders[0].Message)
+
+	events, err := store.GetSemaphoreHistory(alice, name, true)
+	require.NoError(err)
+	types := make([]string, 0, len(events))
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	require.Equal([]string{
+		"semaphore-created",
+		"semaphore-acquired",
+		"semaphore-acquired",
+		"semaphore-released",
+		"semaphore-acquired",
+	}, types)
+	require.Equal("2", events[0].Data["capacity"])
+	require.Equal("carol was here", events[4].Data["message"])
+
+	breaks, err := store.VerifySemaphoreHistory(alice, name)
+	require.NoError(err)
+	require.Empty(breaks)
+
+	_, err = store.GetSemaphore(alice, name+"-missing", true)
+	require.ErrorIs(err, storage.ErrSemaphoreNotFound)
+}
+
+func TestLockModes(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storagetest.NewStore(t, svc)
+
+	name := randomString()
+	alice := newRequest("UAlice")
+	bob := newRequest("UBob")
+	carol := newRequest("UCarol")
+	dave := newRequest("UDave")
+
+	err := store.CreateMutex(alice, name, "a test mutex")
+	require.NoError(err)
+
+	err = store.LockMutex(alice, name, "smoke tests", storage.LockShared)
+	require.NoError(err)
+	err = store.LockMutex(bob, name, "load tests", storage.LockShared)
+	require.NoError(err)
+	err = store.LockMutex(alice, name, "smoke tests", storage.LockShared)
+	require.ErrorIs(err, storage.ErrAlreadyLocked)
+	err = store.LockMutex(carol, name, "deploying", storage.LockExclusive)
+	require.ErrorIs(err, storage.ErrAlreadyLocked)
+	err = store.LockMutex(carol, name, "deploying", "sideways")
+	require.Error(err)
+
+	m, err := store.GetMutex(carol, name, true)
+	require.NoError(err)
+	require.True(m.Locked)
+	require.Equal(storage.LockShared, m.Mode)
+	require.Empty(m.LockedBy)
+	require.Len(m.Holders, 2)
+	require.True(m.IsHolder("UAlice"))
+	require.True(m.IsHolder("UBob"))
+	require.False(m.IsHolder("UCarol"))
+
+	// once someone is waiting, shared holders can't jump the queue
+	position, err := store.WaitForMutex(carol, name, "deploying", storage.LockExclusive, time.Hour)
+	require.NoError(err)
+	require.Equal(1, position)
+	err = store.LockMutex(dave, name, "more tests", storage.LockShared)
+	require.ErrorIs(err, storage.ErrAlreadyLocked)
+	position, err = store.WaitForMutex(dave, name, "more tests", storage.LockShared, time.Hour)
+	require.NoError(err)
+	require.Equal(2, position)
+
+	err = store.UnlockMutex(carol, name)
+	require.ErrorIs(err, storage.ErrMutexNotHeld)
+	err = store.UnlockMutex(alice, name)
+	require.NoError(err)
+	m, err = store.GetMutex(carol, name, true)
+	require.NoError(err)
+	require.True(m.Locked)
+	require.Equal([]string{"UBob"}, []string{m.Holders[0].SlackID})
+	require.Len(m.Holders, 1)
+
+	// the last shared holder hands the lock to the next in line
+	err = store.UnlockMutex(bob, name)
+	require.NoError(err)
+	m, err = store.GetMutex(carol, name, true)
+	require.NoError(err)
+	require.Equal(storage.LockExclusive, m.Mode)
+	require.Equal("UCarol", m.LockedBy)
+	require.Empty(m.Holders)
+
+	err = store.UnlockMutex(carol, name)
+	require.NoError(err)
+	m, err = store.GetMutex(carol, name, true)
+	require.NoError(err)
+	require.Equal(storage.LockShared, m.Mode)
+	require.Len(m.Holders, 1)
+	require.Equal("UDave", m.Holders[0].SlackID)
+	require.Equal("more tests", m.Holders[0].Message)
+
+	err = store.UnlockMutex(dave, name)
+	require.NoError(err)
+	m, err = store.GetMutex(carol, name, true)
+	require.NoError(err)
+	require.False(m.Locked)
+	require.Empty(m.Mode)
+
+	events, err := store.GetMutexHistory(alice, name, true)
+	require.NoError(err)
+	require.Equal("mutex-locked", events[1].Type)
+	require.Equal("shared", events[1].Data["mode"])
+	require.Equal("mutex-handed-off", events[6].Type)
+	require.Equal("exclusive", events[6].Data["mode"])
+
+	breaks, err := store.VerifyMutexHistory(alice, name)
+	require.NoError(err)
+	require.Empty(breaks)
+	drift, err := store.CheckMutex(alice, name, false)
+	require.NoError(err)
+	require.Nil(drift)
+}
+
+func TestLockMutexes(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storagetest.NewStore(t, svc)
+
+	user := rqx.User{
+		Name:    "Test User",
+		SlackID: "UTestUser",
+	}
+	rqx := &rqx.RequestContext{
+		Ctx: context.TODO(),
+		Client: rqx.Client{
+			Type: "test case",
+		},
+		EUser: user,
+		RUser: user,
+	}
+
+	api := "api-" + randomString()
+	db := "db-" + randomString()
+	web := "web-" + randomString()
+	for _, name := range []string{api, db, web} {
+		err := store.CreateMutex(rqx, name, "a test mutex")
+		require.NoError(err)
+	}
+
+	err := store.LockMutex(rqx, web, "hotfix", storage.LockExclusive)
+	require.NoError(err)
+
+	// nothing is locked unless everything can be
+	err = store.LockMutexes(rqx, []string{api, db, web}, "deploying")
+	require.ErrorIs(err, storage.ErrAlreadyLocked)
+	require.Contains(err.Error(), web)
+	err = store.LockMutexes(rqx, []string{api, "missing-" + randomString()}, "deploying")
+	require.ErrorIs(err, storage.ErrMutexNotFound)
+	mutexes, err := store.GetMutexes(rqx, []string{api, db}, true)
+	require.NoError(err)
+	require.False(mutexes[api].Locked)
+	require.False(mutexes[db].Locked)
+
+	err = store.LockMutexes(rqx, []string{db, api, db}, "deploying")
+	require.NoError(err)
+	mutexes, err = store.GetMutexes(rqx, []string{api, db}, true)
+	require.NoError(err)
+	for _, name := range []string{api, db} {
+		m := mutexes[name]
+		require.True(m.Locked)
+		require.Equal("UTestUser", m.LockedBy)
+		require.Equal("deploying", m.Message)
+		require.Equal(storage.LockExclusive, m.Mode)
+	}
+
+	apiEvents, err := store.GetMutexHistory(rqx, api, true)
+	require.NoError(err)
+	require.Len(apiEvents, 2)
+	dbEvents, err := store.GetMutexHistory(rqx, db, true)
+	require.NoError(err)
+	require.Len(dbEvents, 2)
+	require.Equal("mutex-locked", apiEvents[1].Type)
+	require.NotEmpty(apiEvents[1].Data["operation"])
+	require.Equal(apiEvents[1].Data["operation"], dbEvents[1].Data["operation"])
+
+	drift, err := store.CheckMutex(rqx, db, false)
+	require.NoError(err)
+	require.Nil(drift)
+
+	names := make([]string, 51)
+	for i := range names {
+		names[i] = randomString()
+	}
+	err = store.LockMutexes(rqx, names, "everything")
+	require.ErrorIs(err, storage.ErrTooManyMutexes)
+}
+
+func TestMutexPaths(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storagetest.NewStore(t, svc)
+
+	user := rqx.User{
+		Name:    "Test User",
+		SlackID: "UTestUser",
+	}
+	rqx := &rqx.RequestContext{
+		Ctx: context.TODO(),
+		Client: rqx.Client{
+			Type: "test case",
+		},
+		EUser: user,
+		RUser: user,
+	}
+
+	root := randomString()
+	region := root + "/us-east"
+	api := region + "/api"
+	db := region + "/db"
+	web := root + "/eu/web"
+	for _, name := range []string{root, region, api, db, web} {
+		err := store.CreateMutex(rqx, name, "a test mutex")
+		require.NoError(err)
+	}
+	err := store.CreateMutex(rqx, root+"//api", "a test mutex")
+	require.ErrorIs(err, storage.ErrInvalidName)
+
+	// a locked descendant blocks its ancestors, but not its siblings
+	err = store.LockMutex(rqx, api, "deploying", storage.LockExclusive)
+	require.NoError(err)
+	err = store.LockMutex(rqx, region, "freeze", storage.LockExclusive)
+	require.ErrorIs(err, storage.ErrAlreadyLocked)
+	err = store.LockMutex(rqx, root, "freeze", storage.LockShared)
+	require.ErrorIs(err, storage.ErrAlreadyLocked)
+	err = store.LockMutexes(rqx, []string{region, web}, "freeze")
+	require.ErrorIs(err, storage.ErrAlreadyLocked)
+	position, err := store.WaitForMutex(rqx, region, "freeze", storage.LockExclusive, time.Hour)
+	require.ErrorIs(err, storage.ErrAlreadyLocked)
+	require.Zero(position)
+	err = store.LockMutex(rqx, db, "migrating", storage.LockExclusive)
+	require.NoError(err)
+
+	m, err := store.GetMutex(rqx, root, true)
+	require.NoError(err)
+	require.False(m.Locked)
+	require.Equal([]string{api, db}, m.LockedDescendants)
+
+	tree, err := store.GetMutexTree(rqx, region)
+	require.NoError(err)
+	require.Equal(region, tree.Mutex.Name)
+	require.Len(tree.Descendants, 2)
+	require.Equal(3, tree.Count)
+	require.Equal(2, tree.Locked)
+	require.Empty(tree.FrozenBy)
+
+	trees, err := store.ListMutexTrees(rqx, root)
+	require.NoError(err)
+	require.Len(trees, 2)
+	require.Equal(root+"/eu", trees[0].Name)
+	require.Nil(trees[0].Mutex)
+	require.Equal(1, trees[0].Count)
+	require.Equal(0, trees[0].Locked)
+	require.Equal(region, trees[1].Name)
+	require.Equal(2, trees[1].Locked)
+
+	// a locked ancestor freezes its descendants
+	for _, name := range []string{api, db} {
+		err = store.UnlockMutex(rqx, name)
+		require.NoError(err)
+	}
+	err = store.LockMutex(rqx, region, "freeze", storage.LockExclusive)
+	require.NoError(err)
+	err = store.LockMutex(rqx, api, "deploying", storage.LockExclusive)
+	require.ErrorIs(err, storage.ErrAlreadyLocked)
+	position, err = store.WaitForMutex(rqx, api, "deploying", storage.LockExclusive, time.Hour)
+	require.ErrorIs(err, storage.ErrAlreadyLocked)
+	require.Zero(position)
+	err = store.LockMutexes(rqx, []string{db, web}, "deploying")
+	require.ErrorIs(err, storage.ErrAlreadyLocked)
+	err = store.LockMutexes(rqx, []string{root, web}, "deploying")
+	require.ErrorIs(err, storage.ErrNestedMutexes)
+	// "-" sorts before "/", so a parent and child needn't be adjacent
+	err = store.LockMutexes(rqx, []string{root, root + "-b", root + "/eu/web"}, "deploying")
+	require.ErrorIs(err, storage.ErrNestedMutexes)
+
+	tree, err = store.GetMutexTree(rqx, api)
+	require.NoError(err)
+	require.Equal(region, tree.FrozenBy)
+	require.Equal(0, tree.Locked)
+
+	// ancestors created later still see locked descendants
+	err = store.LockMutex(rqx, web, "deploying", storage.LockExclusive)
+	require.NoError(err)
+	err = store.CreateMutex(rqx, root+"/eu", "a test mutex")
+	require.NoError(err)
+	err = store.LockMutex(rqx, root+"/eu", "freeze", storage.LockExclusive)
+	require.ErrorIs(err, storage.ErrAlreadyLocked)
+	err = store.UnlockMutex(rqx, web)
+	require.NoError(err)
+	err = store.LockMutex(rqx, root+"/eu", "freeze", storage.LockExclusive)
+	require.NoError(err)
+
+	m, err = store.GetMutex(rqx, root, true)
+	require.NoError(err)
+	require.Equal([]string{root + "/eu", region}, m.LockedDescendants)
+
+	_, err = store.GetMutexTree(rqx, root+"/missing")
+	require.ErrorIs(err, storage.ErrMutexNotFound)
+}
+
+// racingAPI runs a function before the next transaction, to simulate a
+// concurrent change.
+type racingAPI struct {
+	storage.DynamoDBAPI
+
+	before func()
+}
+
+func (r *racingAPI) TransactWriteItems(
+	ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.TransactWriteItemsOutput, error) {
+	if before := r.before; before != nil {
+		r.before = nil
+		before()
+	}
+	return r.DynamoDBAPI.TransactWriteItems(ctx, params, optFns...)
+}
+
+func TestCreateMutexWhileDescendantLocks(t *testing.T) {
+	require := require.New(t)
+
+	svc := &racingAPI{DynamoDBAPI: createClient()}
+	store := storagetest.NewStore(t, svc)
+	other := storage.NewWithTableName(svc.DynamoDBAPI, store.TableName())
+
+	rqx := newRequest("UAlice")
+	root := randomString()
+	api := root + "/us-east/api"
+	err := store.CreateMutex(rqx, api, "a test mutex")
+	require.NoError(err)
+
+	// GIVEN a descendant locked while its ancestor is being created
+	svc.before = func() {
+		err := other.LockMutex(rqx, api, "deploying", storage.LockExclusive)
+		require.NoError(err)
+	}
+
+	// WHEN the ancestor is created
+	err = store.CreateMutex(rqx, root, "a test mutex")
+	require.NoError(err)
+
+	// THEN the ancestor knows the descendant is locked
+	m, err := store.GetMutex(rqx, root, true)
+	require.NoError(err)
+	require.Equal([]string{api}, m.LockedDescendants)
+	err = store.LockMutex(rqx, root, "freeze", storage.LockExclusive)
+	require.ErrorIs(err, storage.ErrAlreadyLocked)
+
+	// AND the ancestor can be locked once the descendant is unlocked
+	err = store.UnlockMutex(rqx, api)
+	require.NoError(err)
+	err = store.LockMutex(rqx, root, "freeze", storage.LockExclusive)
+	require.NoError(err)
+}
+
+func TestAliasesAndGroups(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storagetest.NewStore(t, svc)
+
+	user := rqx.User{
+		Name:    "Test User",
+		SlackID: "UTestUser",
+	}
+	rqx := &rqx.RequestContext{
+		Ctx: context.TODO(),
+		Client: rqx.Client{
+			Type: "test case",
+		},
+		EUser: user,
+		RUser: user,
+	}
+
+	for _, name := range []string{"prod", "staging", "staging-db"} {
+		err := store.CreateMutex(rqx, name, "a test mutex")
+		require.NoError(err)
+	}
+
+	err := store.CreateAlias(rqx, "live", "prod")
+	require.NoError(err)
+	err = store.CreateAlias(rqx, "production", "live")
+	require.ErrorIs(err, storage.ErrMutexNotFound)
+	err = store.CreateAlias(rqx, "staging", "prod")
+	require.ErrorIs(err, storage.ErrNameInUse)
+	err = store.CreateMutex(rqx, "live", "a test mutex")
+	require.ErrorIs(err, storage.ErrNameInUse)
+
+	names, err := store.ResolveNames(rqx, "live")
+	require.NoError(err)
+	require.Equal([]string{"prod"}, names)
+	names, err = store.ResolveNames(rqx, "missing")
+	require.NoError(err)
+	require.Equal([]string{"missing"}, names)
+
+	err = store.UpdateAlias(rqx, "live", "staging")
+	require.NoError(err)
+	alias, err := store.GetAlias(rqx, "live")
+	require.NoError(err)
+	require.Equal("staging", alias.Target)
+	require.Equal(int64(2), alias.Version)
+	err = store.UpdateAlias(rqx, "live", "missing")
+	require.ErrorIs(err, storage.ErrMutexNotFound)
+	err = store.UpdateAlias(rqx, "missing", "prod")
+	require.ErrorIs(err, storage.ErrAliasNotFound)
+
+	events, err := store.GetAliasHistory(rqx, "live", true)
+	require.NoError(err)
+	require.Len(events, 2)
+	require.Equal("alias-created", events[0].Type)
+	require.Equal("alias-updated", events[1].Type)
+	require.Equal("prod", events[1].Data["previous"])
+	require.Equal("staging", events[1].Data["target"])
+
+	err = store.CreateGroup(rqx, "all-staging", []string{"staging-db", "live", "staging"})
+	require.NoError(err)
+	err = store.CreateGroup(rqx, "nested", []string{"all-staging"})
+	require.Error(err)
+	err = store.CreateGroup(rqx, "broken", []string{"missing"})
+	require.ErrorIs(err, storage.ErrMutexNotFound)
+
+	group, err := store.GetGroup(rqx, "all-staging")
+	require.NoError(err)
+	require.Equal([]string{"live", "staging", "staging-db"}, group.Members)
+	names, err = store.ResolveNames(rqx, "all-staging")
+	require.NoError(err)
+	require.Equal([]string{"staging", "staging-db"}, names)
+
+	err = store.UpdateGroup(rqx, "all-staging", []string{"staging", "prod"})
+	require.NoError(err)
+	group, err = store.GetGroup(rqx, "all-staging")
+	require.NoError(err)
+	require.Equal([]string{"prod", "staging"}, group.Members)
+	require.Equal(int64(2), group.Version)
+	err = store.UpdateGroup(rqx, "missing", []string{"prod"})
+	require.ErrorIs(err, storage.ErrGroupNotFound)
+
+	events, err = store.GetGroupHistory(rqx, "all-staging", true)
+	require.NoError(err)
+	require.Len(events, 2)
+	require.Equal("group-created", events[0].Type)
+	require.Equal(`["live","staging","staging-db"]`, events[0].Data["members"])
+	require.Equal("group-updated", events[1].Type)
+	require.Equal(`["prod","staging"]`, events[1].Data["members"])
+
+	// aliases and groups aren't mutexes
+	mutexes, err := store.ListMutexes(rqx)
+	require.NoError(err)
+	require.Len(mutexes, 3)
+}
+
+func TestTransferMutex(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storagetest.NewStore(t, svc)
+
+	name := randomString()
+	alice := newRequest("UAlice")
+	bob := newRequest("UBob")
+
+	err := store.CreateMutex(alice, name, "a test mutex")
+	require.NoError(err)
+	err = store.TransferMutex(alice, name, "UBob", "your turn")
+	require.ErrorIs(err, storage.ErrNotLocked)
+
+	err = store.LockMutex(alice, name, "deploying", storage.LockExclusive)
+	require.NoError(err)
+	position, err := store.WaitForMutex(bob, name, "migrating", storage.LockExclusive, time.Hour)
+	require.NoError(err)
+	require.Equal(1, position)
+	err = store.TransferMutex(bob, name, "UAlice", "mine now")
+	require.ErrorIs(err, storage.ErrMutexNotHeld)
+	err = store.TransferMutex(alice, name, "UAlice", "still mine")
+	require.Error(err)
+
+	err = store.TransferMutex(alice, name, "UBob", "your turn")
+	require.NoError(err)
+	m, err := store.GetMutex(alice, name, true)
+	require.NoError(err)
+	require.True(m.Locked)
+	require.Equal("UBob", m.LockedBy)
+	require.Equal("your turn", m.Message)
+	require.Empty(m.Queue)
+
+	events, err := store.GetMutexHistory(alice, name, true)
+	require.NoError(err)
+	e := events[len(events)-1]
+	require.Equal("mutex-transferred", e.Type)
+	require.Equal("UAlice", e.Data["from"])
+	require.Equal("UBob", e.Data["to"])
+
+	drift, err := store.CheckMutex(alice, name, false)
+	require.NoError(err)
+	require.Nil(drift)
+
+	// nothing is sent unless the outbox is enabled
+	var delivered []*storage.Event
+	dispatcher := store.NewDispatcher(func(ctx context.Context, e *storage.Event) error {
+		delivered = append(delivered, e)
+		return nil
+	})
+	n, err := dispatcher.Dispatch(context.TODO())
+	require.NoError(err)
+	require.Equal(0, n)
+
+	store = storage.NewWithTableName(svc, store.TableName()).WithOutbox()
+	err = store.TransferMutex(bob, name, "UAlice", "back to you")
+	require.NoError(err)
+	n, err = dispatcher.Dispatch(context.TODO())
+	require.NoError(err)
+	require.Equal(1, n)
+	require.Equal("mutex-transferred", delivered[0].Type)
+	require.Equal("UAlice", delivered[0].Data["to"])
+
+	err = store.UnlockMutex(alice, name)
+	require.NoError(err)
+}
+
+func TestUpdateLockMessage(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storagetest.NewStore(t, svc)
+
+	alice := newRequest("UAlice")
+	bob := newRequest("UBob")
+
+	exclusive := randomString()
+	err := store.CreateMutex(alice, exclusive, "a test mutex")
+	require.NoError(err)
+	err = store.UpdateLockMessage(alice, exclusive, "running migration 3/5")
+	require.ErrorIs(err, storage.ErrNotLocked)
+	err = store.LockMutex(alice, exclusive, "running migration 1/5", storage.LockExclusive)
+	require.NoError(err)
+	err = store.UpdateLockMessage(bob, exclusive, "running migration 3/5")
+	require.ErrorIs(err, storage.ErrMutexNotHeld)
+
+	err = store.UpdateLockMessage(alice, exclusive, "running migration 3/5")
+	require.NoError(err)
+	m, err := store.GetMutex(alice, exclusive, true)
+	require.NoError(err)
+	require.True(m.Locked)
+	require.Equal("UAlice", m.LockedBy)
+	require.Equal("running migration 3/5", m.Message)
+	require.Equal(int64(3), m.Version)
+
+	shared := randomString()
+	err = store.CreateMutex(alice, shared, "a test mutex")
+	require.NoError(err)
+	for _, rqx := range []*rqx.RequestContext{alice, bob} {
+		err = store.LockMutex(rqx, shared, "load testing", storage.LockShared)
+		require.NoError(err)
+	}
+	err = store.UpdateLockMessage(bob, shared, "soak testing")
+	require.NoError(err)
+	m, err = store.GetMutex(alice, shared, true)
+	require.NoError(err)
+	require.Len(m.Holders, 2)
+	require.Equal("load testing", m.Holders[0].Message)
+	require.Equal("soak testing", m.Holders[1].Message)
+
+	for _, name := range []string{exclusive, shared} {
+		events, err := store.GetMutexHistory(alice, name, true)
+		require.NoError(err)
+		require.Equal("mutex-message-updated", events[len(events)-1].Type)
+
+		drift, err := store.CheckMutex(alice, name, false)
+		require.NoError(err)
+		require.Nil(drift)
+	}
+}
+
+func TestUpdateMutex(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storagetest.NewStore(t, svc)
+
+	user := rqx.User{
+		Name:    "Test User",
+		SlackID: "UTestUser",
+	}
+	rqx := &rqx.RequestContext{
+		Ctx: context.TODO(),
+		Client: rqx.Client{
+			Type: "test case",
+		},
+		EUser: user,
+		RUser: user,
+	}
+
+	api := randomString()
+	db := randomString()
+	for _, name := range []string{api, db} {
+		err := store.CreateMutex(rqx, name, "a test mutex")
+		require.NoError(err)
+	}
+
+	description := "the public API"
+	team := "platform"
+	err := store.UpdateMutex(rqx, api, &storage.MutexUpdate{
+		Version:     1,
+		Description: &description,
+		OwnerTeam:   &team,
+		Labels:      []string{"prod", "critical", "prod"},
+		Links: map[string]string{
+			"runbook": "https://example.com/runbook",
+		},
+	})
+	require.NoError(err)
+	err = store.UpdateMutex(rqx, api, &storage.MutexUpdate{
+		Version:     1,
+		Description: &description,
+	})
+	require.ErrorIs(err, storage.ErrVersionConflict)
+	err = store.UpdateMutex(rqx, db, &storage.MutexUpdate{
+		Labels: []string{"prod"},
+	})
+	require.NoError(err)
+
+	m, err := store.GetMutex(rqx, api, true)
+	require.NoError(err)
+	require.Equal(int64(2), m.Version)
+	require.Equal("the public API", m.Description)
+	require.Equal("platform", m.OwnerTeam)
+	require.Equal([]string{"critical", "prod"}, m.Labels)
+	require.Equal("https://example.com/runbook", m.Links["runbook"])
+
+	// unchanged fields aren't recorded, and empty fields are removed
+	empty := ""
+	err = store.UpdateMutex(rqx, api, &storage.MutexUpdate{
+		Description: &description,
+		OwnerTeam:   &empty,
+		Labels:      []string{"prod", "critical"},
+		Links:       map[string]string{},
+	})
+	require.NoError(err)
+	m, err = store.GetMutex(rqx, api, true)
+	require.NoError(err)
+	require.Equal(int64(3), m.Version)
+	require.Empty(m.OwnerTeam)
+	require.Empty(m.Links)
+	require.Equal([]string{"critical", "prod"}, m.Labels)
+
+	events, err := store.GetMutexHistory(rqx, api, true)
+	require.NoError(err)
+	require.Len(events, 3)
+	require.Equal("mutex-updated", events[1].Type)
+	require.Equal(map[string]string{
+		"description":          "the public API",
+		"previous_description": "a test mutex",
+		"owner_team":           "platform",
+		"previous_owner_team":  "",
+		"labels":               `["critical","prod"]`,
+		"previous_labels":      `[]`,
+		"links":                `{"runbook":"https://example.com/runbook"}`,
+		"previous_links":       `{}`,
+	}, events[1].Data)
+	require.Equal(map[string]string{
+		"owner_team":          "",
+		"previous_owner_team": "platform",
+		"links":               `{}`,
+		"previous_links":      `{"runbook":"https://example.com/runbook"}`,
+	}, events[2].Data)
+
+	drift, err := store.CheckMutex(rqx, api, false)
+	require.NoError(err)
+	require.Nil(drift)
+
+	mutexes, err := store.ListMutexes(rqx, "prod")
+	require.NoError(err)
+	require.Len(mutexes, 2)
+	mutexes, err = store.ListMutexes(rqx, "prod", "critical")
+	require.NoError(err)
+	require.Len(mutexes, 1)
+	require.Equal(api, mutexes[0].Name)
+	mutexes, err = store.ListMutexes(rqx, "staging")
+	require.NoError(err)
+	require.Empty(mutexes)
+}
+
+func TestReservations(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storagetest.NewStore(t, svc)
+
+	rqx1 := newRequest("UAlice")
+	rqx2 := newRequest("UBob")
+
+	name := randomString()
+	err := store.CreateMutex(rqx1, name, "a test mutex")
+	require.NoError(err)
+
+	// GIVEN two reservations back to back
+	now := time.Now()
+	first, err := store.ReserveMutex(rqx1, name, "deploy", now.Add(time.Hour), now.Add(2*time.Hour))
+	require.NoError(err)
+	second, err := store.ReserveMutex(rqx2, name, "migrate", now.Add(2*time.Hour), now.Add(3*time.Hour))
+	require.NoError(err)
+
+	// overlapping reservations are rejected
+	_, err = store.ReserveMutex(rqx2, name, "", now.Add(90*time.Minute), now.Add(150*time.Minute))
+	require.ErrorIs(err, storage.ErrReservationConflict)
+	_, err = store.ReserveMutex(rqx2, name, "", now.Add(2*time.Hour), now.Add(time.Hour))
+	require.Error(err)
+	_, err = store.ReserveMutex(rqx2, randomString(), "", now.Add(time.Hour), now.Add(2*time.Hour))
+	require.ErrorIs(err, storage.ErrMutexNotFound)
+
+	reservations, err := store.ListReservations(rqx1, name)
+	require.NoError(err)
+	require.Len(reservations, 2)
+	require.Equal(first.ID, reservations[0].ID)
+	require.Equal("UAlice", reservations[0].SlackID)
+	require.Equal("deploy", reservations[0].Message)
+	require.Equal(second.ID, reservations[1].ID)
+
+	// only the reserver can cancel a reservation
+	err = store.CancelReservation(rqx1, name, second.ID)
+	require.ErrorIs(err, storage.ErrReservationNotFound)
+
+	// WHEN the first reservation starts
+	scheduler := store.NewScheduler()
+	scheduler.Now = func() time.Time { return now.Add(90 * time.Minute) }
+	count, err := scheduler.Tick(context.TODO())
+	require.NoError(err)
+	require.Equal(1, count)
+
+	// THEN the mutex is locked for its reserver
+	m, err := store.GetMutex(rqx1, name, true)
+	require.NoError(err)
+	require.True(m.Locked)
+	require.Equal("UAlice", m.LockedBy)
+	require.Equal("deploy", m.Message)
+
+	err = store.CancelReservation(rqx1, name, first.ID)
+	require.Error(err)
+
+	// WHEN the first reservation ends and the second starts
+	scheduler.Now = func() time.Time { return now.Add(150 * time.Minute) }
+	count, err = scheduler.Tick(context.TODO())
+	require.NoError(err)
+	require.Equal(2, count)
+
+	// THEN the mutex is handed to the second reserver
+	m, err = store.GetMutex(rqx1, name, true)
+	require.NoError(err)
+	require.True(m.Locked)
+	require.Equal("UBob", m.LockedBy)
+
+	// WHEN the second reservation ends
+	scheduler.Now = func() time.Time { return now.Add(4 * time.Hour) }
+	count, err = scheduler.Tick(context.TODO())
+	require.NoError(err)
+	require.Equal(1, count)
+
+	// THEN the mutex is unlocked and nothing is reserved
+	m, err = store.GetMutex(rqx1, name, true)
+	require.NoError(err)
+	require.False(m.Locked)
+	reservations, err = store.ListReservations(rqx1, name)
+	require.NoError(err)
+	require.Empty(reservations)
+
+	events, err := store.GetReservationHistory(rqx1, name, true)
+	require.NoError(err)
+	types := make([]string, 0, len(events))
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	require.Equal([]string{
+		"reservation-created",
+		"reservation-created",
+		"reservation-started",
+		"reservation-ended",
+		"reservation-started",
+		"reservation-ended",
+	}, types)
+	require.Equal("true", events[3].Data["unlocked"])
+	require.Equal("UBob", events[4].EUser.SlackID)
+	require.Equal("scheduler", events[4].Client.Type)
+}
+
+func TestReservationEndsAfterHandOver(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storagetest.NewStore(t, svc)
+
+	alice := newRequest("UAlice")
+	bob := newRequest("UBob")
+	transferred := randomString()
+	released := randomString()
+	now := time.Now()
+	for _, name := range []string{transferred, released} {
+		err := store.CreateMutex(alice, name, "a test mutex")
+		require.NoError(err)
+		_, err = store.ReserveMutex(alice, name, "deploy", now.Add(time.Hour), now.Add(2*time.Hour))
+		require.NoError(err)
+	}
+
+	scheduler := store.NewScheduler()
+	scheduler.Now = func() time.Time { return now.Add(90 * time.Minute) }
+	count, err := scheduler.Tick(context.TODO())
+	require.NoError(err)
+	require.Equal(2, count)
+
+	// GIVEN one mutex transferred, and another unlocked early and locked
+	// by someone else
+	err = store.TransferMutex(alice, transferred, "UCarol", "taking over")
+	require.NoError(err)
+	err = store.UnlockMutex(alice, released)
+	require.NoError(err)
+	err = store.LockMutex(bob, released, "hotfix", storage.LockExclusive)
+	require.NoError(err)
+
+	// WHEN the reservations end
+	scheduler.Now = func() time.Time { return now.Add(3 * time.Hour) }
+	count, err = scheduler.Tick(context.TODO())
+	require.NoError(err)
+	require.Equal(2, count)
+
+	// THEN the new holders keep their locks
+	for name, holder := range map[string]string{
+		transferred: "UCarol",
+		released:    "UBob",
+	} {
+		m, err := store.GetMutex(alice, name, true)
+		require.NoError(err)
+		require.True(m.Locked)
+		require.Equal(holder, m.LockedBy)
+
+		events, err := store.GetReservationHistory(alice, name, true)
+		require.NoError(err)
+		require.Len(events, 3)
+		require.Equal("reservation-ended", events[2].Type)
+		require.Equal("false", events[2].Data["unlocked"])
+	}
+}
+
+// flakyAPI fails reads of the entities it's told to, and the next
+// failUpdates updates of any item.
+type flakyAPI struct {
+	storage.DynamoDBAPI
+
+	failing     map[string]bool
+	failUpdates int
+}
+
+func (f *flakyAPI) GetItem(
+	ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.GetItemOutput, error) {
+	entity := params.Key["entity"].(*types.AttributeValueMemberS).Value
+	if f.failing[entity] {
+		return nil, errors.New("throttled: " + entity)
+	}
+	return f.DynamoDBAPI.GetItem(ctx, params, optFns...)
+}
+
+func (f *flakyAPI) UpdateItem(
+	ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options),
+) (*dynamodb.UpdateItemOutput, error) {
+	if f.failUpdates > 0 {
+		f.failUpdates--
+		return nil, errors.New("throttled")
+	}
+	return f.DynamoDBAPI.UpdateItem(ctx, params, optFns...)
+}
+
+func TestSchedulerSkipsFailures(t *testing.T) {
+	require := require.New(t)
+
+	svc := &flakyAPI{
+		DynamoDBAPI: createClient(),
+		failing:     map[string]bool{},
+	}
+	store := storagetest.NewStore(t, svc)
+
+	rqx := newRequest("UAlice")
+	broken := randomString()
+	working := randomString()
+	now := time.Now()
+	reservations := map[string]*storage.Reservation{}
+	for _, name := range []string{broken, working} {
+		err := store.CreateMutex(rqx, name, "a test mutex")
+		require.NoError(err)
+		reservations[name], err = store.ReserveMutex(rqx, name, "", now.Add(time.Hour), now.Add(2*time.Hour))
+		require.NoError(err)
+	}
+
+	// GIVEN a mutex that can't be read
+	svc.failing["mutex:"+broken] = true
+
+	// WHEN both reservations start
+	scheduler := store.NewScheduler()
+	scheduler.Now = func() time.Time { return now.Add(90 * time.Minute) }
+	count, err := scheduler.Tick(context.TODO())
+
+	// THEN the other reservation still starts
+	require.Equal(1, count)
+	var failed storage.ReservationErrors
+	require.ErrorAs(err, &failed)
+	require.Len(failed, 1)
+	require.Contains(failed[reservations[broken].ID].Error(), "throttled")
+
+	m, err := store.GetMutex(rqx, working, true)
+	require.NoError(err)
+	require.True(m.Locked)
+
+	// and the failed reservation is retried
+	delete(svc.failing, "mutex:"+broken)
+	count, err = scheduler.Tick(context.TODO())
+	require.NoError(err)
+	require.Equal(1, count)
+
+	// WHEN Run hits the same failure
+	svc.failing["mutex:"+broken] = true
+	ctx, cancel := context.WithCancel(context.TODO())
+	scheduler.PollInterval = time.Millisecond
+	scheduler.Now = func() time.Time { return now.Add(3 * time.Hour) }
+	calls := 0
+	scheduler.OnError = func(failed storage.ReservationErrors) {
+		calls++
+		if calls > 1 {
+			cancel()
+		}
+	}
+
+	// THEN it keeps running until canceled
+	err = scheduler.Run(ctx)
+	require.ErrorIs(err, context.Canceled)
+	require.Equal(2, calls)
+	m, err = store.GetMutex(rqx, working, true)
+	require.NoError(err)
+	require.False(m.Locked)
+}
+
+func TestStreamConsumer(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storagetest.NewStore(t, svc)
+
+	name := randomString()
+	user := rqx.User{
+		Name:    "Test User",
+		SlackID: "UFoo42",
+	}
+	rqx := &rqx.RequestContext{
+		Ctx: context.TODO(),
+		Client: rqx.Client{
+			Type: "test case",
+		},
+		EUser: user,
+		RUser: user,
+	}
+
+	var received []*storage.Event
+	handler := func(ctx context.Context, e *storage.Event) error {
+		if e.Entity == "mutex:"+name {
+			received = append(received, e)
+		}
+		return nil
+	}
+	consumer := store.NewStreamConsumer(createStreamsClient(), name).Handle(handler)
+
+	err := store.CreateMutex(rqx, name, "a test mutex")
+	require.NoError(err)
+	err = store.LockMutex(rqx, name, "first attempt", storage.LockExclusive)
+	require.NoError(err)
+	err = store.UnlockMutex(rqx, name)
+	require.NoError(err)
+
+	_, err = consumer.Poll(context.TODO())
+	require.NoError(err)
+	require.Len(received, 3)
+	require.Equal("mutex-created", received[0].Type)
+	require.Equal("mutex-locked", received[1].Type)
+	require.Equal("first attempt", received[1].Data["message"])
+	require.Equal(user.SlackID, received[1].EUser.SlackID)
+	require.Equal("mutex-unlocked", received[2].Type)
+
+	// a restarted consumer resumes where it left off
+	received = nil
+	consumer = store.NewStreamConsumer(createStreamsClient(), name).Handle(handler)
+	_, err = consumer.Poll(context.TODO())
+	require.NoError(err)
+	require.Empty(received)
+
+	err = store.LockMutex(rqx, name, "second attempt", storage.LockExclusive)
+	require.NoError(err)
+
+	// events aren't lost when a handler fails
+	failing := store.NewStreamConsumer(createStreamsClient(), name).Handle(
+		func(ctx context.Context, e *storage.Event) error {
+			return errors.New("handler failed")
+		},
+	)
+	_, err = failing.Poll(context.TODO())
+	require.Error(err)
+
+	_, err = consumer.Poll(context.TODO())
+	require.NoError(err)
+	require.Len(received, 1)
+	require.Equal(int64(4), received[0].Revision)
+	require.Equal("second attempt", received[0].Data["message"])
+}
+
+func TestOutbox(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storagetest.NewStore(t, svc).WithOutbox()
+
+	name := randomString()
+	user := rqx.User{
+		Name:    "Test User",
+		SlackID: "UFoo42",
+	}
+	rqx := &rqx.RequestContext{
+		Ctx: context.TODO(),
+		Client: rqx.Client{
+			Type: "test case",
+		},
+		EUser: user,
+		RUser: user,
+	}
+
+	err := store.CreateMutex(rqx, name, "a test mutex")
+	require.NoError(err)
+	err = store.LockMutex(rqx, name, "first attempt", storage.LockExclusive)
+	require.NoError(err)
+
+	var delivered []*storage.Event
+	failing := true
+	now := time.Now()
+	dispatcher := store.NewDispatcher(func(ctx context.Context, e *storage.Event) error {
+		if failing && e.Type == "mutex-locked" {
+			return errors.New("slack is down")
+		}
+		delivered = append(delivered, e)
+		return nil
+	})
+	dispatcher.MaxAttempts = 2
+	dispatcher.Now = func() time.Time { return now }
+
+	n, err := dispatcher.Dispatch(context.TODO())
+	require.NoError(err)
+	require.Equal(1, n)
+	require.Len(delivered, 1)
+	require.Equal("mutex-created", delivered[0].Type)
+
+	// failed deliveries wait before they are retried
+	n, err = dispatcher.Dispatch(context.TODO())
+	require.NoError(err)
+	require.Equal(0, n)
+
+	dead, err := store.DeadLetters(context.TODO())
+	require.NoError(err)
+	require.Empty(dead)
+
+	now = now.Add(time.Hour)
+	n, err = dispatcher.Dispatch(context.TODO())
+	require.NoError(err)
+	require.Equal(0, n)
+
+	dead, err = store.DeadLetters(context.TODO())
+	require.NoError(err)
+	require.Len(dead, 1)
+	require.Equal("mutex:"+name, dead[0].Entity)
+	require.Equal(int64(2), dead[0].Revision)
+	require.Equal(2, dead[0].Attempts)
+	require.Equal("slack is down", dead[0].LastError)
+
+	failing = false
+	err = store.RequeueDeadLetter(context.TODO(), dead[0].ID)
+	require.NoError(err)
+	n, err = dispatcher.Dispatch(context.TODO())
+	require.NoError(err)
+	require.Equal(1, n)
+	require.Len(delivered, 2)
+	require.Equal("first attempt", delivered[1].Data["message"])
+
+	dead, err = store.DeadLetters(context.TODO())
+	require.NoError(err)
+	require.Empty(dead)
+	n, err = dispatcher.Dispatch(context.TODO())
+	require.NoError(err)
+	require.Equal(0, n)
+}
+
+func TestDispatcherSkipsFailures(t *testing.T) {
+	require := require.New(t)
+
+	svc := &flakyAPI{
+		DynamoDBAPI: createClient(),
+		failing:     map[string]bool{},
+	}
+	store := storagetest.NewStore(t, svc).WithOutbox()
+
+	rqx := newRequest("UAlice")
+	name := randomString()
+	err := store.CreateMutex(rqx, name, "a test mutex")
+	require.NoError(err)
+	err = store.LockMutex(rqx, name, "first attempt", storage.LockExclusive)
+	require.NoError(err)
+
+	var delivered []string
+	dispatcher := store.NewDispatcher(func(ctx context.Context, e *storage.Event) error {
+		delivered = append(delivered, e.Type)
+		return nil
+	})
+
+	// GIVEN an outbox entry that can't be claimed
+	svc.failUpdates = 1
+
+	// WHEN the entries are dispatched
+	n, err := dispatcher.Dispatch(context.TODO())
+
+	// THEN the other entry is still delivered
+	require.Equal(1, n)
+	var failed storage.OutboxErrors
+	require.ErrorAs(err, &failed)
+	require.Len(failed, 1)
+	require.Len(delivered, 1)
+
+	// AND the failed entry is delivered on the next attempt
+	n, err = dispatcher.Dispatch(context.TODO())
+	require.NoError(err)
+	require.Equal(1, n)
+	require.ElementsMatch([]string{"mutex-created", "mutex-locked"}, delivered)
+
+	// GIVEN dispatching keeps failing
+	err = store.UnlockMutex(rqx, name)
+	require.NoError(err)
+	svc.failUpdates = 2
+
+	// WHEN the dispatcher runs
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	var errs []error
+	dispatcher.PollInterval = time.Millisecond
+	dispatcher.OnError = func(err error) {
+		errs = append(errs, err)
+		if len(errs) >= 2 {
+			cancel()
+		}
+	}
+	err = dispatcher.Run(ctx)
+
+	// THEN it keeps polling until it's stopped
+	require.ErrorIs(err, context.Canceled)
+	require.Len(errs, 2)
+	n, err = dispatcher.Dispatch(context.TODO())
+	require.NoError(err)
+	require.Equal(1, n)
+	require.Equal("mutex-unlocked", delivered[2])
+}
+
+func TestEnsureTable(t *testing.T) {
+	require := require.New(t)
+
+	svc := createClient()
+	require.NotNil(svc)
+
+	store := storage.NewWithTableName(svc, storagetest.NewTableName(t, svc))
+
+	opts := storage.TableOptions{
+		Capacity:            &storage.Capacity{Read: 5, Write: 5},
+		PointInTimeRecovery: true,
+		Encryption:          &storage.Encryption{},
+		Tags:                map[string]string{"team": "infra"},
+		Indexes: []storage.Index{{
+			Name:         "by-type",
+			PartitionKey: "entity_type",
+		}},
+	}
+	drifts, err := store.EnsureTable(context.TODO(), opts)
+	require.NoError(err)
+	require.Empty(drifts)
+
+	drifts, err = store.EnsureTable(context.TODO(), opts)
+	require.NoError(err)
+	require.Empty(drifts)
+
+	opts.Capacity = nil
+	opts.Tags["team"] = "ops"
+	opts.Indexes = append(opts.Indexes, storage.Index{
+		Name:         "by-created",
+		PartitionKey: "entity_type",
+		SortKey:      "created",
+		SortKeyType:  types.ScalarAttributeTypeN,
+	})
+	opts.DryRun = true
+	expected := []storage.Drift{
+		{Setting: "billing mode", Current: "PROVISIONED 5/5", Desired: "PAY_PER_REQUEST"},
+		{Setting: "index by-created", Current: "missing", Desired: "entity_type HASH, created RANGE"},
+		{Setting: "tag team", Current: "infra", Desired: "ops"},
+	}
+	for i := 0; i < 2; i++ {
+		drifts, err = store.EnsureTable(context.TODO(), opts)
+		require.NoError(err)
+		require.Equal(expected, drifts)
+	}
+
+	opts.DryRun = false
+	drifts, err = store.EnsureTable(context.TODO(), opts)
+	require.NoError(err)
+	for i := range expected {
+		expected[i].Fixed = true
+	}
+	require.Equal(expected, drifts)
+
+	// indexes are never deleted, and protection is never turned off
+	opts.Indexes = opts.Indexes[1:]
+	opts.PointInTimeRecovery = false
+	drifts, err = store.EnsureTable(context.TODO(), opts)
+	require.NoError(err)
+	require.Equal([]storage.Drift{
+		{Setting: "index by-type", Current: "entity_type HASH", Desired: "missing"},
+	}, drifts)
+
+	// a customer managed key is never replaced by one owned by DynamoDB
+	opts.Encryption = nil
+	for i := 0; i < 2; i++ {
+		drifts, err = store.EnsureTable(context.TODO(), opts)
+		require.NoError(err)
+		require.Len(drifts, 2)
+		require.Equal("encryption", drifts[1].Setting)
+		require.True(strings.HasPrefix(drifts[1].Current, "KMS"))
+		require.Equal("owned by DynamoDB", drifts[1].Desired)
+		require.False(drifts[1].Fixed)
+	}
+}
@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	streamtypes "github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+	"github.com/pkg/errors"
+)
+
+// ErrStreamDisabled is returned when the table doesn't have a stream.
+var ErrStreamDisabled = errors.New("table stream not enabled")
+
+// DefaultPollInterval is used when a stream consumer doesn't specify one.
+const DefaultPollInterval = 1 * time.Second
+
+// shardClosed is recorded as the checkpoint of a shard that has been
+// read to the end.
+const shardClosed = "closed"
+
+// StreamHandler is called for each new event read from the table stream.
+// Returning an error stops the consumer, and the event will be delivered
+// again when it resumes.
+type StreamHandler func(ctx context.Context, e *Event) error
+
+// CheckpointStore records how far a stream consumer has read each shard.
+type CheckpointStore interface {
+	LoadCheckpoints(ctx context.Context, consumer string) (map[string]string, error)
+	SaveCheckpoints(ctx context.Context, consumer string, checkpoints map[string]string) error
+}
+
+var _ CheckpointStore = &DynamoStore{}
+
+// StreamConsumer tails the table stream and passes new events to its
+// handlers, in order within each mutex. Events are delivered at least
+// once: a checkpoint is only saved after its events have been handled.
+type StreamConsumer struct {
+	Name         string
+	PollInterval time.Duration
+
+	store       *DynamoStore
+	streams     StreamsAPI
+	checkpoints CheckpointStore
+	handlers    []StreamHandler
+
+	arn       string
+	positions map[string]string
+}
+
+// NewStreamConsumer creates a named stream consumer. Restarting a consumer
+// with the same name resumes where it left off.
+func (s *DynamoStore) NewStreamConsumer(streams StreamsAPI, name string) *StreamConsumer {
+	return &StreamConsumer{
+		Name:         name,
+		PollInterval: DefaultPollInterval,
+		store:        s,
+		streams:      streams,
+		checkpoints:  s,
+	}
+}
+
+// WithCheckpoints replaces where checkpoints are stored. By default they
+// are stored in the table.
+func (c *StreamConsumer) WithCheckpoints(checkpoints CheckpointStore) *StreamConsumer {
+	c.checkpoints = checkpoints
+	return c
+}
+
+// Handle registers a handler. Handlers are called in the order they were
+// registered.
+func (c *StreamConsumer) Handle(h StreamHandler) *StreamConsumer {
+	c.handlers = append(c.handlers, h)
+	return c
+}
+
+// Run polls the stream until the context is canceled or a handler fails.
+func (c *StreamConsumer) Run(ctx context.Context) error {
+	for {
+		if _, err := c.Poll(ctx); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.PollInterval):
+		}
+	}
+}
+
+// Poll reads every shard that is ready to be read, and returns the number
+// of events delivered.
+func (c *StreamConsumer) Poll(ctx context.Context) (int, error) {
+	if c.positions == nil {
+		positions, err := c.checkpoints.LoadCheckpoints(ctx, c.Name)
+		if err != nil {
+			return 0, err
+		}
+		if positions == nil {
+			positions = map[string]string{}
+		}
+		c.positions = positions
+	}
+	if c.arn == "" {
+		arn, err := c.store.streamARN(ctx)
+		if err != nil {
+			return 0, err
+		}
+		c.arn = arn
+	}
+
+	shards, err := c.describeShards(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// A child shard must not be read until its parent is finished.
+	ready := func(shard streamtypes.Shard) bool {
+		parent := aws.ToString(shard.ParentShardId)
+		if _, ok := shards[parent]; !ok {
+			return true
+		}
+		return c.positions[parent] == shardClosed
+	}
+
+	count := 0
+	done := make(map[string]bool, len(shards))
+	for progress := true; progress; {
+		progress = false
+		for id, shard := range shards {
+			if done[id] || !ready(shard) {
+				continue
+			}
+			n, err := c.readShard(ctx, id)
+			count += n
+			if err != nil {
+				return count, err
+			}
+			done[id] = true
+			progress = true
+		}
+	}
+	return count, nil
+}
+
+func (c *StreamConsumer) describeShards(ctx context.Context) (map[string]streamtypes.Shard, error) {
+	input := &dynamodbstreams.DescribeStreamInput{
+		StreamArn: aws.String(c.arn),
+	}
+	shards := map[string]streamtypes.Shard{}
+	for {
+		result, err := c.streams.DescribeStream(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, shard := range result.StreamDescription.Shards {
+			shards[aws.ToString(shard.ShardId)] = shard
+		}
+		if result.StreamDescription.LastEvaluatedShardId == nil {
+			break
+		}
+		input.ExclusiveStartShardId = result.StreamDescription.LastEvaluatedShardId
+	}
+
+	// Forget shards that have been trimmed from the stream.
+	for id := range c.positions {
+		if _, ok := shards[id]; !ok {
+			delete(c.positions, id)
+		}
+	}
+	return shards, nil
+}
+
+func (c *StreamConsumer) readShard(ctx context.Context, shard string) (int, error) {
+	position := c.positions[shard]
+	if position == shardClosed {
+		return 0, nil
+	}
+
+	input := &dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         aws.String(c.arn),
+		ShardId:           aws.String(shard),
+		ShardIteratorType: streamtypes.ShardIteratorTypeTrimHorizon,
+	}
+	if position != "" {
+		input.ShardIteratorType = streamtypes.ShardIteratorTypeAfterSequenceNumber
+		input.SequenceNumber = aws.String(position)
+	}
+	result, err := c.streams.GetShardIterator(ctx, input)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	iterator := result.ShardIterator
+	for iterator != nil {
+		page, err := c.streams.GetRecords(ctx, &dynamodbstreams.GetRecordsInput{
+			ShardIterator: iterator,
+		})
+		if err != nil {
+			return count, err
+		}
+
+		// Saving a checkpoint writes to the table, which adds a record to
+		// the stream, so only save when there's something worth saving.
+		dirty := false
+		for _, r := range page.Records {
+			n, err := c.deliver(ctx, r)
+			if err != nil {
+				if dirty {
+					// the handler's error is more interesting
+					_ = c.checkpoints.SaveCheckpoints(ctx, c.Name, c.positions)
+				}
+				return count, err
+			}
+			count += n
+			dirty = dirty || n > 0
+			c.positions[shard] = aws.ToString(r.Dynamodb.SequenceNumber)
+		}
+		iterator = page.NextShardIterator
+		if iterator == nil {
+			c.positions[shard] = shardClosed
+			dirty = true
+		}
+		if dirty {
+			err = c.checkpoints.SaveCheckpoints(ctx, c.Name, c.positions)
+			if err != nil {
+				return count, err
+			}
+		}
+		if len(page.Records) < 1 {
+			break
+		}
+	}
+	return count, nil
+}
+
+func (c *StreamConsumer) deliver(ctx context.Context, r streamtypes.Record) (int, error) {
+	e, err := c.store.decodeStreamRecord(r)
+	if err != nil || e == nil {
+		return 0, err
+	}
+	for _, h := range c.handlers {
+		if err := h(ctx, e); err != nil {
+			return 0, err
+		}
+	}
+	return 1, nil
+}
+
+// decodeStreamRecord returns the event added by a stream record, or nil
+// if the record isn't a new event.
+func (s *DynamoStore) decodeStreamRecord(r streamtypes.Record) (*Event, error) {
+	if r.EventName != streamtypes.OperationTypeInsert || r.Dynamodb == nil {
+		return nil, nil
+	}
+	image, err := attributevalue.FromDynamoDBStreamsMap(r.Dynamodb.NewImage)
+	if err != nil {
+		return nil, err
+	}
+	item := &event{}
+	if err := attributevalue.UnmarshalMap(image, item); err != nil {
+		return nil, err
+	}
+	if item.Revision < 1 || item.Type == "" {
+		return nil, nil
+	}
+
+	e, err := item.export()
+	if err != nil {
+		return nil, err
+	}
+	e.Data, err = s.keys.decryptData(eventContext(item.ID, e.Revision), e.Data)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// LoadCheckpoints returns the checkpoints saved by the named consumer.
+func (s *DynamoStore) LoadCheckpoints(ctx context.Context, consumer string) (map[string]string, error) {
+	result, err := s.svc.GetItem(ctx, &dynamodb.GetItemInput{
+		ConsistentRead: aws.Bool(true),
+		TableName:      s.table,
+		Key: map[string]types.AttributeValue{
+			"entity":   &types.AttributeValueMemberS{Value: consumerEntityID(consumer)},
+			"revision": &types.AttributeValueMemberN{Value: "0"},
+		},
+		ProjectionExpression: aws.String("shards"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	item := &checkpoints{}
+	if err := attributevalue.UnmarshalMap(result.Item, item); err != nil {
+		return nil, err
+	}
+	return item.Shards, nil
+}
+
+// SaveCheckpoints replaces the checkpoints saved by the named consumer.
+func (s *DynamoStore) SaveCheckpoints(ctx context.Context, consumer string, shards map[string]string) error {
+	item, err := attributevalue.MarshalMap(&checkpoints{
+		base: base{
+			ID: consumerEntityID(consumer),
+		},
+		EntityType: "consumer",
+		Shards:     shards,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.svc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: s.table,
+		Item:      item,
+	})
+	return err
+}
+
+func (s *DynamoStore) streamARN(ctx context.Context) (string, error) {
+	result, err := s.svc.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: s.table,
+	})
+	if err != nil {
+		return "", err
+	}
+	spec := result.Table.StreamSpecification
+	if spec == nil || !aws.ToBool(spec.StreamEnabled) || result.Table.LatestStreamArn == nil {
+		return "", ErrStreamDisabled
+	}
+	return *result.Table.LatestStreamArn, nil
+}
+
+func consumerEntityID(name string) string {
+	return "consumer:" + name
+}
+
+type checkpoints struct {
+	base
+	EntityType string            `dynamodbav:"entity_type"`
+	Shards     map[string]string `dynamodbav:"shards"`
+}
@@ -0,0 +1,780 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/pkg/errors"
+)
+
+// createTimeout limits how long CreateTable waits for the table.
+const createTimeout = 60 * time.Second
+
+// tablePollInterval is how often table status is checked while waiting.
+var tablePollInterval = 1 * time.Second
+
+var streamSpecification = &types.StreamSpecification{
+	StreamEnabled:  aws.Bool(true),
+	StreamViewType: types.StreamViewTypeNewImage,
+}
+
+// TableOptions describes how the DynamoStore table should be provisioned.
+// The zero value describes a pay-per-request table encrypted with a key
+// owned by DynamoDB.
+type TableOptions struct {
+	// Capacity selects provisioned mode. Nil selects pay-per-request mode.
+	Capacity *Capacity
+	// PointInTimeRecovery enables continuous backups.
+	PointInTimeRecovery bool
+	// DeletionProtection prevents the table from being deleted.
+	DeletionProtection bool
+	// Encryption selects a KMS key. Nil selects a key owned by DynamoDB.
+	Encryption *Encryption
+	// Tags are added to the table. Other tags are left alone.
+	Tags map[string]string
+	// Indexes are global secondary indexes.
+	Indexes []Index
+	// DryRun reports drift without changing an existing table.
+	DryRun bool
+}
+
+// Capacity is provisioned throughput, in capacity units.
+type Capacity struct {
+	Read  int64
+	Write int64
+}
+
+// Encryption describes server-side encryption using KMS.
+type Encryption struct {
+	// KMSKeyID is the ID or ARN of a customer managed key. When empty,
+	// the AWS managed key is used.
+	KMSKeyID string
+}
+
+// Index describes a global secondary index that projects all attributes.
+type Index struct {
+	Name         string
+	PartitionKey string
+	SortKey      string
+	// SortKeyType defaults to string.
+	SortKeyType types.ScalarAttributeType
+	// Capacity defaults to the table's capacity in provisioned mode.
+	Capacity *Capacity
+}
+
+// scheduleIndex lets the scheduler find reservations that are due without
+// scanning the table. Only entities with reservations have its keys, so
+// the index stays small. It is created along with the table.
+var scheduleIndex = Index{
+	Name:         "schedule",
+	PartitionKey: "schedule",
+	SortKey:      "due",
+	SortKeyType:  types.ScalarAttributeTypeN,
+}
+
+// indexes returns the built-in indexes, followed by the requested ones.
+func (opts *TableOptions) indexes() []Index {
+	return append([]Index{scheduleIndex}, opts.Indexes...)
+}
+
+// Drift describes a table setting that doesn't match the requested options.
+type Drift struct {
+	Setting string
+	Current string
+	Desired string
+	// Fixed is false if the setting was left alone, either because of a
+	// dry run, or because fixing it would risk losing data.
+	Fixed bool
+}
+
+// CreateTable creates the DynamoStore table, if it doesn't already exist.
+// This is only intended as a convenience function to make development and
+// testing easier. Use EnsureTable to provision tables for production.
+func (s *DynamoStore) CreateTable() error {
+	// TODO: thread ctx
+	ctx, cancel := context.WithTimeout(context.TODO(), createTimeout)
+	defer cancel()
+
+	err := s.createTableIfMissing(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrCreateTimedOut
+	}
+	return err
+}
+
+func (s *DynamoStore) createTableIfMissing(ctx context.Context) error {
+	desc, err := s.describeTable(ctx)
+	if err != nil {
+		return err
+	} else if desc == nil {
+		_, err = s.EnsureTable(ctx, TableOptions{})
+		return err
+	}
+
+	// Existing tables are only changed as needed for stopgap to work.
+	r := &reconciler{ctx: ctx, store: s}
+	if desc, err = s.waitForTable(ctx); err != nil {
+		return err
+	}
+	if err = r.checkStream(desc); err != nil {
+		return err
+	}
+	// Only the built-in indexes are added. Drift in the others is ignored.
+	opts := &TableOptions{Capacity: currentCapacity(desc)}
+	if err = r.checkIndexes(desc, opts); err != nil {
+		return err
+	}
+	return r.checkTTL()
+}
+
+// currentCapacity returns the provisioned capacity of a table, or nil if
+// it's in pay-per-request mode.
+func currentCapacity(desc *types.TableDescription) *Capacity {
+	if desc.BillingModeSummary != nil &&
+		desc.BillingModeSummary.BillingMode == types.BillingModePayPerRequest {
+		return nil
+	}
+	if desc.ProvisionedThroughput == nil {
+		return nil
+	}
+	return &Capacity{
+		Read:  aws.ToInt64(desc.ProvisionedThroughput.ReadCapacityUnits),
+		Write: aws.ToInt64(desc.ProvisionedThroughput.WriteCapacityUnits),
+	}
+}
+
+// EnsureTable creates the DynamoStore table if it doesn't exist, or
+// reconciles the settings of an existing table with the options given,
+// and returns the settings that had drifted. Settings that protect data
+// are never turned off, indexes are never deleted, and the key schema of
+// an index is never changed. That kind of drift is reported, but must be
+// fixed by hand. The context controls how long to wait for changes to
+// finish.
+func (s *DynamoStore) EnsureTable(ctx context.Context, opts TableOptions) ([]Drift, error) {
+	desc, err := s.describeTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	created := false
+	if desc == nil {
+		if opts.DryRun {
+			return []Drift{{Setting: "table", Current: "missing", Desired: *s.table}}, nil
+		}
+		if err := s.createTable(ctx, &opts); err != nil {
+			var inUseErr *types.ResourceInUseException
+			if !errors.As(err, &inUseErr) {
+				return nil, err
+			}
+		} else {
+			created = true
+		}
+	}
+
+	r := &reconciler{
+		ctx:    ctx,
+		store:  s,
+		dryRun: opts.DryRun,
+	}
+	if err := r.reconcile(&opts); err != nil {
+		return nil, err
+	}
+	if created {
+		// settings that can't be given at creation are expected to drift
+		return nil, nil
+	}
+	return r.drifts, nil
+}
+
+func (s *DynamoStore) createTable(ctx context.Context, opts *TableOptions) error {
+	createTable := &dynamodb.CreateTableInput{
+		BillingMode: types.BillingModePayPerRequest,
+		TableName:   s.table,
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("entity"),
+				KeyType:       types.KeyTypeHash,
+			},
+			{
+				AttributeName: aws.String("revision"),
+				KeyType:       types.KeyTypeRange,
+			},
+		},
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("entity"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+			{
+				AttributeName: aws.String("revision"),
+				AttributeType: types.ScalarAttributeTypeN,
+			},
+		},
+		SSESpecification:    sseSpecification(opts.Encryption),
+		StreamSpecification: streamSpecification,
+	}
+	if opts.DeletionProtection {
+		createTable.DeletionProtectionEnabled = aws.Bool(true)
+	}
+	if opts.Capacity != nil {
+		createTable.BillingMode = types.BillingModeProvisioned
+		createTable.ProvisionedThroughput = opts.Capacity.throughput()
+	}
+	indexes := opts.indexes()
+	for i := range indexes {
+		index := &indexes[i]
+		createTable.AttributeDefinitions = addAttributeDefinitions(
+			createTable.AttributeDefinitions, index,
+		)
+		createTable.GlobalSecondaryIndexes = append(
+			createTable.GlobalSecondaryIndexes,
+			types.GlobalSecondaryIndex{
+				IndexName:             aws.String(index.Name),
+				KeySchema:             index.keySchema(),
+				Projection:            &types.Projection{ProjectionType: types.ProjectionTypeAll},
+				ProvisionedThroughput: index.throughput(opts),
+			},
+		)
+	}
+	for _, k := range sortedKeys(opts.Tags) {
+		createTable.Tags = append(createTable.Tags, types.Tag{
+			Key:   aws.String(k),
+			Value: aws.String(opts.Tags[k]),
+		})
+	}
+
+	if _, err := s.svc.CreateTable(ctx, createTable); err != nil {
+		return err
+	}
+	_, err := s.waitForTable(ctx)
+	return err
+}
+
+// DeleteTable deletes the DynamoStore table and everything in it, and
+// waits for the deletion to finish. It isn't an error if the table
+// doesn't exist.
+func (s *DynamoStore) DeleteTable(ctx context.Context) error {
+	_, err := s.svc.DeleteTable(ctx, &dynamodb.DeleteTableInput{
+		TableName: s.table,
+	})
+	if err != nil {
+		var notFoundErr *types.ResourceNotFoundException
+		if errors.As(err, &notFoundErr) {
+			return nil
+		}
+		var inUseErr *types.ResourceInUseException
+		if !errors.As(err, &inUseErr) {
+			return err
+		}
+		// the table is still being created or updated
+		if _, err = s.waitForTable(ctx); err != nil && err != ErrDeleteInProgress {
+			return err
+		} else if err == nil {
+			return s.DeleteTable(ctx)
+		}
+	}
+
+	for {
+		desc, err := s.describeTable(ctx)
+		if err != nil {
+			return err
+		} else if desc == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(tablePollInterval):
+		}
+	}
+}
+
+// describeTable returns nil if the table doesn't exist.
+func (s *DynamoStore) describeTable(ctx context.Context) (*types.TableDescription, error) {
+	result, err := s.svc.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: s.table,
+	})
+	if err != nil {
+		var notFoundErr *types.ResourceNotFoundException
+		if errors.As(err, &notFoundErr) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return result.Table, nil
+}
+
+// waitForTable waits until the table and its indexes are active.
+func (s *DynamoStore) waitForTable(ctx context.Context) (*types.TableDescription, error) {
+	for {
+		desc, err := s.describeTable(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if desc != nil {
+			switch desc.TableStatus {
+			case types.TableStatusCreating, types.TableStatusUpdating:
+				// continue loop
+			case types.TableStatusDeleting:
+				return nil, ErrDeleteInProgress
+			case types.TableStatusActive:
+				if indexesActive(desc) {
+					return desc, nil
+				}
+			default:
+				return nil, errors.New(
+					"unrecognized table status: " + string(desc.TableStatus),
+				)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(tablePollInterval):
+		}
+	}
+}
+
+func indexesActive(desc *types.TableDescription) bool {
+	for _, index := range desc.GlobalSecondaryIndexes {
+		if index.IndexStatus != types.IndexStatusActive {
+			return false
+		}
+	}
+	return true
+}
+
+// reconciler compares table settings one at a time, fixing them unless
+// this is a dry run.
+type reconciler struct {
+	ctx    context.Context
+	store  *DynamoStore
+	dryRun bool
+	drifts []Drift
+}
+
+func (r *reconciler) reconcile(opts *TableOptions) error {
+	desc, err := r.store.waitForTable(r.ctx)
+	if err != nil {
+		return err
+	}
+	checks := []func(*types.TableDescription, *TableOptions) error{
+		r.checkBilling,
+		r.checkIndexes,
+		r.checkDeletionProtection,
+		r.checkEncryption,
+		func(desc *types.TableDescription, _ *TableOptions) error {
+			return r.checkStream(desc)
+		},
+	}
+	for _, check := range checks {
+		if err := check(desc, opts); err != nil {
+			return err
+		}
+		// fixes change the table, so start each check with a fresh copy
+		if desc, err = r.store.waitForTable(r.ctx); err != nil {
+			return err
+		}
+	}
+	if err := r.checkTTL(); err != nil {
+		return err
+	}
+	if err := r.checkPointInTimeRecovery(opts); err != nil {
+		return err
+	}
+	return r.checkTags(desc, opts)
+}
+
+// check records drift when current doesn't match desired, and applies
+// fix unless this is a dry run. A nil fix means the drift can't be fixed
+// automatically.
+func (r *reconciler) check(setting, current, desired string, fix func() error) error {
+	if current == desired {
+		return nil
+	}
+	d := Drift{
+		Setting: setting,
+		Current: current,
+		Desired: desired,
+	}
+	if !r.dryRun && fix != nil {
+		if err := fix(); err != nil {
+			return errors.Wrap(err, "unable to update "+setting)
+		}
+		d.Fixed = true
+	}
+	r.drifts = append(r.drifts, d)
+	return nil
+}
+
+func (r *reconciler) updateTable(input *dynamodb.UpdateTableInput) error {
+	input.TableName = r.store.table
+	if _, err := r.store.svc.UpdateTable(r.ctx, input); err != nil {
+		return err
+	}
+	_, err := r.store.waitForTable(r.ctx)
+	return err
+}
+
+func (r *reconciler) checkBilling(desc *types.TableDescription, opts *TableOptions) error {
+	current := string(types.BillingModeProvisioned)
+	if desc.BillingModeSummary != nil && desc.BillingModeSummary.BillingMode != "" {
+		current = string(desc.BillingModeSummary.BillingMode)
+	}
+	if current == string(types.BillingModeProvisioned) && desc.ProvisionedThroughput != nil {
+		current += " " + formatCapacity(
+			aws.ToInt64(desc.ProvisionedThroughput.ReadCapacityUnits),
+			aws.ToInt64(desc.ProvisionedThroughput.WriteCapacityUnits),
+		)
+	}
+	desired := string(types.BillingModePayPerRequest)
+	if opts.Capacity != nil {
+		desired = string(types.BillingModeProvisioned) + " " +
+			formatCapacity(opts.Capacity.Read, opts.Capacity.Write)
+	}
+
+	return r.check("billing mode", current, desired, func() error {
+		input := &dynamodb.UpdateTableInput{
+			BillingMode: types.BillingModePayPerRequest,
+		}
+		if opts.Capacity != nil {
+			input.BillingMode = types.BillingModeProvisioned
+			input.ProvisionedThroughput = opts.Capacity.throughput()
+			// existing indexes need capacity too
+			for _, existing := range desc.GlobalSecondaryIndexes {
+				capacity := opts.Capacity
+				for _, index := range opts.Indexes {
+					if index.Name == aws.ToString(existing.IndexName) && index.Capacity != nil {
+						capacity = index.Capacity
+					}
+				}
+				input.GlobalSecondaryIndexUpdates = append(
+					input.GlobalSecondaryIndexUpdates,
+					types.GlobalSecondaryIndexUpdate{
+						Update: &types.UpdateGlobalSecondaryIndexAction{
+							IndexName:             existing.IndexName,
+							ProvisionedThroughput: capacity.throughput(),
+						},
+					},
+				)
+			}
+		}
+		return r.updateTable(input)
+	})
+}
+
+func (r *reconciler) checkIndexes(desc *types.TableDescription, opts *TableOptions) error {
+	existing := make(map[string]string, len(desc.GlobalSecondaryIndexes))
+	for _, index := range desc.GlobalSecondaryIndexes {
+		existing[aws.ToString(index.IndexName)] = formatKeySchema(index.KeySchema)
+	}
+
+	indexes := opts.indexes()
+	for i := range indexes {
+		index := &indexes[i]
+		desired := formatKeySchema(index.keySchema())
+		current, ok := existing[index.Name]
+		delete(existing, index.Name)
+
+		var fix func() error
+		if !ok {
+			current = "missing"
+			fix = func() error {
+				return r.updateTable(&dynamodb.UpdateTableInput{
+					AttributeDefinitions: addAttributeDefinitions(nil, index),
+					GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{{
+						Create: &types.CreateGlobalSecondaryIndexAction{
+							IndexName:             aws.String(index.Name),
+							KeySchema:             index.keySchema(),
+							Projection:            &types.Projection{ProjectionType: types.ProjectionTypeAll},
+							ProvisionedThroughput: index.throughput(opts),
+						},
+					}},
+				})
+			}
+		}
+		if err := r.check("index "+index.Name, current, desired, fix); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range sortedKeys(existing) {
+		if err := r.check("index "+name, existing[name], "missing", nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *reconciler) checkDeletionProtection(desc *types.TableDescription, opts *TableOptions) error {
+	current := aws.ToBool(desc.DeletionProtectionEnabled)
+	var fix func() error
+	if opts.DeletionProtection {
+		fix = func() error {
+			return r.updateTable(&dynamodb.UpdateTableInput{
+				DeletionProtectionEnabled: aws.Bool(true),
+			})
+		}
+	}
+	return r.check("deletion protection",
+		strconv.FormatBool(current),
+		strconv.FormatBool(opts.DeletionProtection),
+		fix,
+	)
+}
+
+func (r *reconciler) checkEncryption(desc *types.TableDescription, opts *TableOptions) error {
+	current := "owned by DynamoDB"
+	if sse := desc.SSEDescription; sse != nil && sse.SSEType == types.SSETypeKms &&
+		(sse.Status == types.SSEStatusEnabled || sse.Status == types.SSEStatusEnabling) {
+		current = "KMS " + aws.ToString(sse.KMSMasterKeyArn)
+	}
+	desired := "owned by DynamoDB"
+	if e := opts.Encryption; e != nil {
+		desired = strings.TrimSpace("KMS " + e.KMSKeyID)
+		// Key ARNs are reported, but key IDs may be requested. Without a
+		// key ID, any KMS key is accepted.
+		if strings.HasPrefix(current, "KMS ") &&
+			(e.KMSKeyID == "" || strings.HasSuffix(current, "/"+e.KMSKeyID)) {
+			desired = current
+		}
+	}
+
+	// Moving from a customer managed key to one owned by DynamoDB would
+	// weaken protection, so it's left alone.
+	var fix func() error
+	if spec := sseSpecification(opts.Encryption); spec != nil {
+		fix = func() error {
+			return r.updateTable(&dynamodb.UpdateTableInput{
+				SSESpecification: spec,
+			})
+		}
+	}
+	return r.check("encryption", current, desired, fix)
+}
+
+func (r *reconciler) checkStream(desc *types.TableDescription) error {
+	current := "disabled"
+	if spec := desc.StreamSpecification; spec != nil && aws.ToBool(spec.StreamEnabled) {
+		current = string(spec.StreamViewType)
+	}
+	if current == string(types.StreamViewTypeNewAndOldImages) {
+		// new images are all that's needed
+		return nil
+	}
+
+	var fix func() error
+	if current == "disabled" {
+		fix = func() error {
+			return r.updateTable(&dynamodb.UpdateTableInput{
+				StreamSpecification: streamSpecification,
+			})
+		}
+	}
+	return r.check("stream",
+		current, string(streamSpecification.StreamViewType),
+		fix,
+	)
+}
+
+func (r *reconciler) checkTTL() error {
+	result, err := r.store.svc.DescribeTimeToLive(r.ctx, &dynamodb.DescribeTimeToLiveInput{
+		TableName: r.store.table,
+	})
+	if err != nil {
+		return err
+	}
+	current := "disabled"
+	if ttl := result.TimeToLiveDescription; ttl != nil {
+		switch ttl.TimeToLiveStatus {
+		case types.TimeToLiveStatusEnabled, types.TimeToLiveStatusEnabling:
+			current = aws.ToString(ttl.AttributeName)
+		}
+	}
+
+	return r.check("time to live", current, "ttl", func() error {
+		_, err := r.store.svc.UpdateTimeToLive(r.ctx, &dynamodb.UpdateTimeToLiveInput{
+			TableName: r.store.table,
+			TimeToLiveSpecification: &types.TimeToLiveSpecification{
+				AttributeName: aws.String("ttl"),
+				Enabled:       aws.Bool(true),
+			},
+		})
+		return err
+	})
+}
+
+// checkPointInTimeRecovery only looks at backups when they are requested,
+// since they are never turned off.
+func (r *reconciler) checkPointInTimeRecovery(opts *TableOptions) error {
+	if !opts.PointInTimeRecovery {
+		return nil
+	}
+	result, err := r.store.svc.DescribeContinuousBackups(r.ctx, &dynamodb.DescribeContinuousBackupsInput{
+		TableName: r.store.table,
+	})
+	if err != nil {
+		return err
+	}
+	current := false
+	if backups := result.ContinuousBackupsDescription; backups != nil {
+		if pitr := backups.PointInTimeRecoveryDescription; pitr != nil {
+			current = pitr.PointInTimeRecoveryStatus == types.PointInTimeRecoveryStatusEnabled
+		}
+	}
+
+	return r.check("point-in-time recovery",
+		strconv.FormatBool(current), "true",
+		func() error {
+			_, err := r.store.svc.UpdateContinuousBackups(r.ctx, &dynamodb.UpdateContinuousBackupsInput{
+				TableName: r.store.table,
+				PointInTimeRecoverySpecification: &types.PointInTimeRecoverySpecification{
+					PointInTimeRecoveryEnabled: aws.Bool(true),
+				},
+			})
+			return err
+		},
+	)
+}
+
+func (r *reconciler) checkTags(desc *types.TableDescription, opts *TableOptions) error {
+	if len(opts.Tags) < 1 {
+		return nil
+	}
+
+	current := map[string]string{}
+	input := &dynamodb.ListTagsOfResourceInput{
+		ResourceArn: desc.TableArn,
+	}
+	for {
+		result, err := r.store.svc.ListTagsOfResource(r.ctx, input)
+		if err != nil {
+			return err
+		}
+		for _, tag := range result.Tags {
+			current[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+		if result.NextToken == nil {
+			break
+		}
+		input.NextToken = result.NextToken
+	}
+
+	for _, k := range sortedKeys(opts.Tags) {
+		v, ok := current[k]
+		if !ok {
+			v = "missing"
+		}
+		err := r.check("tag "+k, v, opts.Tags[k], func() error {
+			_, err := r.store.svc.TagResource(r.ctx, &dynamodb.TagResourceInput{
+				ResourceArn: desc.TableArn,
+				Tags: []types.Tag{{
+					Key:   aws.String(k),
+					Value: aws.String(opts.Tags[k]),
+				}},
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Capacity) throughput() *types.ProvisionedThroughput {
+	return &types.ProvisionedThroughput{
+		ReadCapacityUnits:  aws.Int64(c.Read),
+		WriteCapacityUnits: aws.Int64(c.Write),
+	}
+}
+
+func (i *Index) keySchema() []types.KeySchemaElement {
+	schema := []types.KeySchemaElement{{
+		AttributeName: aws.String(i.PartitionKey),
+		KeyType:       types.KeyTypeHash,
+	}}
+	if i.SortKey != "" {
+		schema = append(schema, types.KeySchemaElement{
+			AttributeName: aws.String(i.SortKey),
+			KeyType:       types.KeyTypeRange,
+		})
+	}
+	return schema
+}
+
+func (i *Index) throughput(opts *TableOptions) *types.ProvisionedThroughput {
+	switch {
+	case opts.Capacity == nil:
+		return nil
+	case i.Capacity != nil:
+		return i.Capacity.throughput()
+	default:
+		return opts.Capacity.throughput()
+	}
+}
+
+// addAttributeDefinitions adds the key attributes of an index, unless
+// they are already defined.
+func addAttributeDefinitions(defs []types.AttributeDefinition, i *Index) []types.AttributeDefinition {
+	sortKeyType := i.SortKeyType
+	if sortKeyType == "" {
+		sortKeyType = types.ScalarAttributeTypeS
+	}
+	add := func(name string, typ types.ScalarAttributeType) {
+		for _, def := range defs {
+			if aws.ToString(def.AttributeName) == name {
+				return
+			}
+		}
+		defs = append(defs, types.AttributeDefinition{
+			AttributeName: aws.String(name),
+			AttributeType: typ,
+		})
+	}
+	add(i.PartitionKey, types.ScalarAttributeTypeS)
+	if i.SortKey != "" {
+		add(i.SortKey, sortKeyType)
+	}
+	return defs
+}
+
+func sseSpecification(e *Encryption) *types.SSESpecification {
+	if e == nil {
+		return nil
+	}
+	spec := &types.SSESpecification{
+		Enabled: aws.Bool(true),
+		SSEType: types.SSETypeKms,
+	}
+	if e.KMSKeyID != "" {
+		spec.KMSMasterKeyId = aws.String(e.KMSKeyID)
+	}
+	return spec
+}
+
+func formatCapacity(read, write int64) string {
+	return strconv.FormatInt(read, 10) + "/" + strconv.FormatInt(write, 10)
+}
+
+func formatKeySchema(schema []types.KeySchemaElement) string {
+	parts := make([]string, 0, len(schema))
+	for _, k := range schema {
+		parts = append(parts, aws.ToString(k.AttributeName)+" "+string(k.KeyType))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
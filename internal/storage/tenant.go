@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/pkg/errors"
+
+	"github.com/sjansen/stopgap/internal/rqx"
+)
+
+// ErrInvalidTenant is returned when a request's tenant can't be used to
+// namespace keys. Tenants may only contain letters, digits, '-', '_'
+// and '.'.
+var ErrInvalidTenant = errors.New("invalid tenant")
+
+// Mutexes and semaphores are keyed by the tenant of the request that
+// created them, so every read and write is limited to the requester's
+// tenant. Requests without a tenant use the default namespace, which
+// predates tenants.
+const (
+	tenantPrefix    = "tenant:"
+	tenantSeparator = "#"
+)
+
+// MutexExport holds everything stored about a mutex.
+type MutexExport struct {
+	Mutex  *Mutex
+	Events []*Event
+}
+
+func tenantOf(rqx *rqx.RequestContext) (string, error) {
+	t := rqx.Tenant
+	for _, r := range t {
+		switch {
+		case r >= 'a' && r <= 'z':
+		case r >= 'A' && r <= 'Z':
+		case r >= '0' && r <= '9':
+		case r == '-' || r == '_' || r == '.':
+		default:
+			return "", errors.Wrapf(ErrInvalidTenant, "%q", t)
+		}
+	}
+	return t, nil
+}
+
+func entityID(tenant, kind, name string) string {
+	if tenant == "" {
+		return kind + ":" + name
+	}
+	return tenantPrefix + tenant + tenantSeparator + kind + ":" + name
+}
+
+func mutexEntityID(tenant, name string) string {
+	return entityID(tenant, "mutex", name)
+}
+
+// tenantEntityID returns the ID of the named entity in the requester's
+// tenant.
+func tenantEntityID(rqx *rqx.RequestContext, kind, name string) (string, error) {
+	tenant, err := tenantOf(rqx)
+	if err != nil {
+		return "", err
+	}
+	return entityID(tenant, kind, name), nil
+}
+
+// mutexID returns the ID of the named mutex in the requester's tenant.
+func mutexID(rqx *rqx.RequestContext, name string) (string, error) {
+	return tenantEntityID(rqx, "mutex", name)
+}
+
+// splitEntityID separates the tenant from the rest of an entity ID.
+func splitEntityID(id string) (tenant, rest string) {
+	if !strings.HasPrefix(id, tenantPrefix) {
+		return "", id
+	}
+	tenant, rest, _ = strings.Cut(id[len(tenantPrefix):], tenantSeparator)
+	return tenant, rest
+}
+
+// entityName is the inverse of entityID.
+func entityName(id string) (tenant, name string) {
+	tenant, rest := splitEntityID(id)
+	_, name, _ = strings.Cut(rest, ":")
+	return tenant, name
+}
+
+// ListMutexes returns every mutex in the requester's tenant, sorted by
+// name. If labels are given, only mutexes with all of them are returned.
+func (s *DynamoStore) ListMutexes(rqx *rqx.RequestContext, labels ...string) ([]*Mutex, error) {
+	tenant, err := tenantOf(rqx)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := s.scanMutexes(&tenant,
+		"entity, version, description, summary, locked_descendants, "+mutexMetadata,
+		labels...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Mutex, 0, len(items))
+	for _, item := range items {
+		m, err := s.exportMutex(item.ID, item)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, m)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// ExportTenant returns every mutex in the requester's tenant, along with
+// its event history.
+func (s *DynamoStore) ExportTenant(rqx *rqx.RequestContext) ([]*MutexExport, error) {
+	mutexes, err := s.ListMutexes(rqx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*MutexExport, 0, len(mutexes))
+	for _, m := range mutexes {
+		events, err := s.GetMutexHistory(rqx, m.Name, true)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, &MutexExport{
+			Mutex:  m,
+			Events: events,
+		})
+	}
+	return result, nil
+}
+
+// scanMutexes returns the mutexes in a tenant, or in every tenant when
+// tenant is nil, that have all of the given labels.
+func (s *DynamoStore) scanMutexes(tenant *string, projection string, labels ...string) ([]*mutex, error) {
+	input := &dynamodb.ScanInput{
+		TableName:            s.table,
+		FilterExpression:     aws.String("entity_type = :type"),
+		ProjectionExpression: aws.String(projection),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":type": &types.AttributeValueMemberS{Value: "mutex"},
+		},
+	}
+	switch {
+	case tenant == nil:
+	case *tenant == "":
+		input.FilterExpression = aws.String(
+			"entity_type = :type AND attribute_not_exists(tenant)",
+		)
+	default:
+		input.FilterExpression = aws.String(
+			"entity_type = :type AND tenant = :tenant",
+		)
+		input.ExpressionAttributeValues[":tenant"] = &types.AttributeValueMemberS{
+			Value: *tenant,
+		}
+	}
+	for i, label := range labels {
+		placeholder := ":label" + strconv.Itoa(i)
+		input.FilterExpression = aws.String(
+			*input.FilterExpression + " AND contains(labels, " + placeholder + ")",
+		)
+		input.ExpressionAttributeValues[placeholder] = &types.AttributeValueMemberS{
+			Value: label,
+		}
+	}
+
+	var items []*mutex
+	for {
+		// TODO: thread ctx
+		result, err := s.svc.Scan(context.TODO(), input)
+		if err != nil {
+			return nil, err
+		}
+		page := make([]*mutex, 0, len(result.Items))
+		if err = attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, err
+		}
+		items = append(items, page...)
+		if len(result.LastEvaluatedKey) == 0 {
+			return items, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
@@ -1,7 +1,8 @@
 package storage
 
 import (
-	"errors"
+	"sort"
+	"time"
 
 	"github.com/sjansen/stopgap/internal/rqx"
 )
@@ -10,6 +11,12 @@ import (
 type MutexRepoFake struct {
 	Retries int
 	Mutexes map[string]string
+	Queues  map[string][]string
+	History map[string][]*Event
+	Aliases map[string]string
+	Groups  map[string][]string
+	// Unlocked records the names of unlocked mutexes, in order.
+	Unlocked []string
 }
 
 // NewMutexRepoFake creates a DynamoStore instance using default values.
@@ -17,6 +24,10 @@ func NewMutexRepoFake() *MutexRepoFake {
 	return &MutexRepoFake{
 		Retries: 0,
 		Mutexes: map[string]string{"conch": "migrations"},
+		Queues:  map[string][]string{},
+		History: map[string][]*Event{},
+		Aliases: map[string]string{},
+		Groups:  map[string][]string{},
 	}
 }
 
@@ -26,16 +37,161 @@ func (r *MutexRepoFake) CreateMutex(rqx *rqx.RequestContext, name, description s
 	return nil
 }
 
+// UpdateMutex changes the named mutex's description.
+func (r *MutexRepoFake) UpdateMutex(rqx *rqx.RequestContext, name string, update *MutexUpdate) error {
+	if _, ok := r.Mutexes[name]; !ok {
+		return ErrMutexNotFound
+	}
+	if update.Description != nil {
+		r.Mutexes[name] = *update.Description
+	}
+	return nil
+}
+
 // LockMutex locks the named mutex.
-func (r *MutexRepoFake) LockMutex(rqx *rqx.RequestContext, name, message string) error {
+func (r *MutexRepoFake) LockMutex(rqx *rqx.RequestContext, name, message string, mode LockMode) error {
+	if _, ok := r.Mutexes[name]; !ok {
+		return ErrMutexNotFound
+	}
+	r.Retries--
+	if r.Retries > 0 {
+		return ErrAlreadyLocked
+	}
+	return nil
+}
+
+// LockMutexes locks all of the named mutexes, or none of them.
+func (r *MutexRepoFake) LockMutexes(rqx *rqx.RequestContext, names []string, message string) error {
+	for _, name := range names {
+		if _, ok := r.Mutexes[name]; !ok {
+			return ErrMutexNotFound
+		}
+	}
 	r.Retries--
 	if r.Retries > 0 {
-		return errors.New("already locked")
+		return ErrAlreadyLocked
 	}
 	return nil
 }
 
 // UnlockMutex unlocks the named mutex.
 func (r *MutexRepoFake) UnlockMutex(rqx *rqx.RequestContext, name string) error {
+	if _, ok := r.Mutexes[name]; !ok {
+		return ErrMutexNotFound
+	}
+	r.Unlocked = append(r.Unlocked, name)
+	return nil
+}
+
+// TransferMutex records that the named mutex was transferred.
+func (r *MutexRepoFake) TransferMutex(rqx *rqx.RequestContext, name, toUser, message string) error {
+	if _, ok := r.Mutexes[name]; !ok {
+		return ErrMutexNotFound
+	}
+	r.History[name] = append(r.History[name], &Event{
+		Type:    "mutex-transferred",
+		Created: time.Now(),
+		EUser:   rqx.EUser,
+		Data: map[string]string{
+			"from":    rqx.EUser.SlackID,
+			"to":      toUser,
+			"message": message,
+		},
+	})
+	return nil
+}
+
+// UpdateLockMessage records that the named mutex's message was updated.
+func (r *MutexRepoFake) UpdateLockMessage(rqx *rqx.RequestContext, name, message string) error {
+	if _, ok := r.Mutexes[name]; !ok {
+		return ErrMutexNotFound
+	}
+	r.History[name] = append(r.History[name], &Event{
+		Type:    "mutex-message-updated",
+		Created: time.Now(),
+		EUser:   rqx.EUser,
+		Data: map[string]string{
+			"message": message,
+		},
+	})
 	return nil
 }
+
+// GetMutexes returns the named mutexes, or nil for names that don't match.
+func (r *MutexRepoFake) GetMutexes(rqx *rqx.RequestContext, names []string, consistent bool) (map[string]*Mutex, error) {
+	result := make(map[string]*Mutex, len(names))
+	for _, name := range names {
+		result[name] = nil
+		if description, ok := r.Mutexes[name]; ok {
+			result[name] = &Mutex{
+				Name:        name,
+				Description: description,
+			}
+		}
+	}
+	return result, nil
+}
+
+// ResolveNames expands aliases and groups into the names of mutexes.
+func (r *MutexRepoFake) ResolveNames(rqx *rqx.RequestContext, name string) ([]string, error) {
+	members, ok := r.Groups[name]
+	if !ok {
+		members = []string{name}
+	}
+	result := make([]string, 0, len(members))
+	for _, member := range members {
+		if target, ok := r.Aliases[member]; ok {
+			member = target
+		}
+		result = append(result, member)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// WaitForMutex adds the requester to the named mutex's queue while
+// Retries is positive, and otherwise locks it.
+func (r *MutexRepoFake) WaitForMutex(
+	rqx *rqx.RequestContext, name, message string, mode LockMode, ttl time.Duration,
+) (int, error) {
+	if _, ok := r.Mutexes[name]; !ok {
+		return 0, ErrMutexNotFound
+	}
+	if r.Retries < 1 {
+		return 0, nil
+	}
+	if position, err := r.GetQueuePosition(rqx, name); err == nil {
+		return position, nil
+	}
+	r.Queues[name] = append(r.Queues[name], rqx.EUser.SlackID)
+	return len(r.Queues[name]), nil
+}
+
+// LeaveQueue removes the requester from the named mutex's queue.
+func (r *MutexRepoFake) LeaveQueue(rqx *rqx.RequestContext, name string) error {
+	position, err := r.GetQueuePosition(rqx, name)
+	if err != nil {
+		return err
+	}
+	queue := r.Queues[name]
+	r.Queues[name] = append(queue[:position-1:position-1], queue[position:]...)
+	return nil
+}
+
+// GetQueuePosition returns the requester's place in the named mutex's queue.
+func (r *MutexRepoFake) GetQueuePosition(rqx *rqx.RequestContext, name string) (int, error) {
+	for i, slackID := range r.Queues[name] {
+		if slackID == rqx.EUser.SlackID {
+			return i + 1, nil
+		}
+	}
+	return 0, ErrNotQueued
+}
+
+// GetMutexHistory returns the events recorded for the named mutex.
+func (r *MutexRepoFake) GetMutexHistory(rqx *rqx.RequestContext, name string, consistent bool) ([]*Event, error) {
+	if _, ok := r.Mutexes[name]; !ok {
+		return nil, ErrMutexNotFound
+	}
+	return r.History[name], nil
+}
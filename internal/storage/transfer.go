@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/sjansen/stopgap/internal/rqx"
+)
+
+// TransferMutex hands the requester's exclusive lock on the named mutex to
+// another user, without unlocking it in between. The recipient is notified
+// like any other change: through the outbox when it's enabled, or else by
+// a stream consumer watching for "mutex-transferred" events.
+func (s *DynamoStore) TransferMutex(rqx *rqx.RequestContext, name, toUser, message string) error {
+	id, err := mutexID(rqx, name)
+	if err != nil {
+		return err
+	}
+
+	slackID := rqx.EUser.SlackID
+	switch toUser {
+	case "":
+		return errors.New("unable to transfer mutex to an unknown user")
+	case slackID:
+		return errors.New("unable to transfer mutex to its holder")
+	}
+
+	for i := 0; i < maxUpdateAttempts; i++ {
+		item, m, err := s.readMutex(id)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !m.Locked:
+			return ErrNotLocked
+		case m.Mode == LockShared:
+			return errors.New("shared locks can't be transferred: " + name)
+		case m.LockedBy != slackID:
+			return ErrMutexNotHeld
+		}
+
+		event, err := s.newEvent(rqx, id, item.Version+1, item.link,
+			"mutex-transferred",
+			map[string]string{
+				"from":    slackID,
+				"to":      toUser,
+				"message": message,
+			},
+		)
+		if err != nil {
+			return err
+		}
+		m.LockedBy = toUser
+		m.Message = message
+		// The recipient no longer needs to wait.
+		m.Queue = removeWaiter(m.Queue, toUser)
+
+		err = s.putSummary(id, item.Version, m, event)
+		if !conditionFailed(err, 0) {
+			return err
+		}
+	}
+	return errors.New("mutex changed too often to transfer: " + id)
+}
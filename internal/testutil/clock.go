@@ -1,11 +1,19 @@
 package testutil
 
-import "github.com/sjansen/stopgap/internal/time"
+import (
+	"context"
+
+	"github.com/sjansen/stopgap/internal/time"
+)
 
 type Clock struct {
 	Paused time.Duration
 }
 
-func (c *Clock) Sleep(d time.Duration) {
+func (c *Clock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	c.Paused += d
+	return nil
 }
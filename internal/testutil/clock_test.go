@@ -1,6 +1,7 @@
 package testutil_test
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -15,9 +16,14 @@ func TestClock(t *testing.T) {
 	c := &testutil.Clock{}
 	require.Equal(0*time.Second, c.Paused)
 
-	c.Sleep(5 * time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(c.Sleep(ctx, 5*time.Second))
 	require.Equal(5*time.Second, c.Paused)
 
-	c.Sleep(5 * time.Second)
+	require.NoError(c.Sleep(ctx, 5*time.Second))
+	require.Equal(10*time.Second, c.Paused)
+
+	cancel()
+	require.ErrorIs(c.Sleep(ctx, 5*time.Second), context.Canceled)
 	require.Equal(10*time.Second, c.Paused)
 }
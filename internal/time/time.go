@@ -2,13 +2,31 @@ package time
 
 import "time"
 
-type Duration time.Duration
+// Duration and Time are aliases, so values pass to and from the storage
+// layer without conversion.
+type (
+	Duration = time.Duration
+	Time     = time.Time
+)
 
 const (
-	Nanosecond  = Duration(time.Nanosecond)
-	Microsecond = Duration(time.Microsecond)
-	Millisecond = Duration(time.Millisecond)
-	Second      = Duration(time.Second)
-	Minute      = Duration(time.Minute)
-	Hour        = Duration(time.Hour)
+	Nanosecond  = time.Nanosecond
+	Microsecond = time.Microsecond
+	Millisecond = time.Millisecond
+	Second      = time.Second
+	Minute      = time.Minute
+	Hour        = time.Hour
 )
+
+// UTC is the location of times in Coordinated Universal Time.
+var UTC = time.UTC
+
+// Date returns the time corresponding to the given date and clock time.
+func Date(year int, month time.Month, day, hour, min, sec, nsec int, loc *time.Location) Time {
+	return time.Date(year, month, day, hour, min, sec, nsec, loc)
+}
+
+// Now returns the current local time.
+func Now() Time {
+	return time.Now()
+}